@@ -0,0 +1,326 @@
+package jwkset
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// adminMaxBodySize is the maximum size of a request body accepted by the admin handler.
+const adminMaxBodySize = 1 << 20
+
+// AdminAction is an operation of the handler created by NewAdminHandler.
+type AdminAction string
+
+const (
+	// AdminActionDelete deletes a key with DELETE /{kid}.
+	AdminActionDelete AdminAction = "delete"
+	// AdminActionGenerate generates a new key with POST /generate.
+	AdminActionGenerate AdminAction = "generate"
+	// AdminActionImport imports a key from JWK JSON or PEM with POST /.
+	AdminActionImport AdminAction = "import"
+	// AdminActionList lists the public view of all keys with GET /.
+	AdminActionList AdminAction = "list"
+	// AdminActionRead reads the public view of a key with GET /{kid}.
+	AdminActionRead AdminAction = "read"
+)
+
+// AdminEvent describes a request to the admin handler after it was handled.
+type AdminEvent struct {
+	// Action is the requested operation.
+	Action AdminAction
+	// Err is the reason the request failed, or nil if it succeeded. It wraps ErrAdminForbidden if the request was not
+	// authorized.
+	Err error
+	// KID is the key ID the request operated on. It's empty for AdminActionList and for failed imports and generations
+	// that didn't get a key ID.
+	KID string
+	// Request is the HTTP request.
+	Request *http.Request
+}
+
+var (
+	// ErrAdminForbidden indicates that the Authorize function of the admin handler rejected a request.
+	ErrAdminForbidden = errors.New("admin request forbidden")
+)
+
+// AdminHandlerOptions are used to configure the behavior of NewAdminHandler.
+type AdminHandlerOptions struct {
+	// Audit is a function that is called after every request with the action, key ID, and outcome, including requests
+	// that were not authorized.
+	Audit func(ctx context.Context, event AdminEvent)
+
+	// Authorize is a function that decides if a request may perform the action. The key ID is empty for
+	// AdminActionList, AdminActionImport, and AdminActionGenerate. Returning an error rejects the request with 403
+	// Forbidden.
+	//
+	// This is required.
+	Authorize func(r *http.Request, action AdminAction, kid string) error
+
+	// Validate is used to validate imported keys.
+	Validate JWKValidateOptions
+}
+
+// adminGenerateRequest is the JSON body of a request to generate a key.
+type adminGenerateRequest struct {
+	ALG    ALG      `json:"alg"`
+	KEYOPS []KEYOPS `json:"key_ops,omitempty"`
+	KID    string   `json:"kid,omitempty"`
+	USE    USE      `json:"use,omitempty"`
+}
+
+type adminHandler struct {
+	createMux sync.Mutex // Held while creating a key, so two creates of the same key ID can't both succeed.
+	options   AdminHandlerOptions
+	storage   Storage
+}
+
+// NewAdminHandler creates an http.Handler for managing the keys in a Storage. Mount it with http.StripPrefix so that the
+// paths below are relative to the handler. Responses only ever contain the public view of keys, which is the public key
+// for asymmetric keys and the metadata for symmetric keys.
+//
+//   - GET / lists all keys as a JWK Set.
+//   - GET /{kid} reads a key as a JWK.
+//   - POST / imports a key. The body is a JWK with Content-Type application/json or application/jwk+json, or a PEM
+//     encoded private key, public key, or certificate with any other Content-Type. The kid query parameter sets the
+//     key ID of a PEM key. Existing key IDs are rejected with 409 Conflict.
+//   - POST /generate generates a key. The body is a JSON object with the members alg, and optionally kid, use, and
+//     key_ops. EdDSA, ES256, ES384, ES512, HS256, HS384, HS512, PS256, PS384, PS512, RS256, RS384, and RS512 are
+//     supported. RSA keys are 2048 bits.
+//   - DELETE /{kid} deletes a key.
+//
+// Keys without a key ID are given their RFC 7638 thumbprint as key ID. Successful imports and generations respond with
+// 201 Created and the public view of the key.
+func NewAdminHandler(storage Storage, options AdminHandlerOptions) (http.Handler, error) {
+	if options.Authorize == nil {
+		return nil, fmt.Errorf("%w: an Authorize function is required for the admin handler", ErrOptions)
+	}
+	return &adminHandler{
+		options: options,
+		storage: storage,
+	}, nil
+}
+
+func (a *adminHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	path := strings.TrimPrefix(request.URL.EscapedPath(), "/")
+	kid, err := url.PathUnescape(path)
+	if err != nil {
+		http.Error(writer, "Invalid key ID in path.", http.StatusBadRequest)
+		return
+	}
+	var action AdminAction
+	switch {
+	case request.Method == http.MethodGet && kid == "":
+		action = AdminActionList
+	case request.Method == http.MethodGet:
+		action = AdminActionRead
+	case request.Method == http.MethodPost && kid == "":
+		action = AdminActionImport
+	case request.Method == http.MethodPost && kid == "generate":
+		action = AdminActionGenerate
+		kid = ""
+	case request.Method == http.MethodDelete && kid != "":
+		action = AdminActionDelete
+	default:
+		http.Error(writer, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := request.Context()
+	var status int
+	var body any
+	err = a.options.Authorize(request, action, kid)
+	if err != nil {
+		status = http.StatusForbidden
+		err = fmt.Errorf("failed to authorize admin request: %w", errors.Join(err, ErrAdminForbidden))
+	} else {
+		switch action {
+		case AdminActionDelete:
+			status, err = a.delete(ctx, kid)
+		case AdminActionGenerate:
+			kid, status, body, err = a.generate(ctx, request)
+		case AdminActionImport:
+			kid, status, body, err = a.importKey(ctx, request)
+		case AdminActionList:
+			status, body, err = a.list(ctx)
+		case AdminActionRead:
+			status, body, err = a.read(ctx, kid)
+		}
+	}
+	if a.options.Audit != nil {
+		a.options.Audit(ctx, AdminEvent{
+			Action:  action,
+			Err:     err,
+			KID:     kid,
+			Request: request,
+		})
+	}
+
+	if err != nil {
+		message := err.Error()
+		if status == http.StatusForbidden || status >= http.StatusInternalServerError {
+			message = http.StatusText(status)
+		}
+		http.Error(writer, message, status)
+		return
+	}
+	if body == nil {
+		writer.WriteHeader(status)
+		return
+	}
+	if status == http.StatusCreated {
+		writer.Header().Set("Location", url.PathEscape(kid))
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	_ = json.NewEncoder(writer).Encode(body)
+}
+
+func (a *adminHandler) delete(ctx context.Context, kid string) (status int, err error) {
+	ok, err := a.storage.KeyDelete(ctx, kid)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to delete key: %w", err)
+	}
+	if !ok {
+		return http.StatusNotFound, fmt.Errorf("%w: kid %q", ErrKeyNotFound, kid)
+	}
+	return http.StatusNoContent, nil
+}
+
+func (a *adminHandler) generate(ctx context.Context, request *http.Request) (kid string, status int, body any, err error) {
+	var generate adminGenerateRequest
+	err = json.NewDecoder(http.MaxBytesReader(nil, request.Body, adminMaxBodySize)).Decode(&generate)
+	if err != nil {
+		return "", http.StatusBadRequest, nil, fmt.Errorf("failed to decode generate request: %w", err)
+	}
+	key, err := generateKey(generate.ALG)
+	if err != nil {
+		return "", http.StatusBadRequest, nil, err
+	}
+	options := JWKOptions{
+		Marshal: JWKMarshalOptions{
+			Private: true,
+		},
+		Metadata: JWKMetadataOptions{
+			ALG:    generate.ALG,
+			KEYOPS: generate.KEYOPS,
+			KID:    generate.KID,
+			USE:    generate.USE,
+		},
+	}
+	jwk, err := NewJWKFromKey(key, options)
+	if err != nil {
+		return "", http.StatusBadRequest, nil, fmt.Errorf("failed to create JWK from generated key: %w", err)
+	}
+	return a.create(ctx, jwk)
+}
+
+func (a *adminHandler) importKey(ctx context.Context, request *http.Request) (kid string, status int, body any, err error) {
+	raw, err := io.ReadAll(http.MaxBytesReader(nil, request.Body, adminMaxBodySize))
+	if err != nil {
+		return "", http.StatusBadRequest, nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	marshalOptions := JWKMarshalOptions{
+		Private: true,
+	}
+	var jwk JWK
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json", "application/jwk+json":
+		jwk, err = NewJWKFromRawJSON(raw, marshalOptions, a.options.Validate)
+		if err != nil {
+			return "", http.StatusBadRequest, nil, fmt.Errorf("failed to import JWK: %w", err)
+		}
+	default:
+		block, _ := pem.Decode(raw)
+		if block == nil {
+			return "", http.StatusBadRequest, nil, fmt.Errorf("%w: no PEM block in request body", ErrX509Infer)
+		}
+		options := JWKOptions{
+			Marshal: marshalOptions,
+			Metadata: JWKMetadataOptions{
+				KID: request.URL.Query().Get("kid"),
+			},
+			Validate: a.options.Validate,
+		}
+		if block.Type == "CERTIFICATE" {
+			certs, err := LoadCertificates(raw)
+			if err != nil {
+				return "", http.StatusBadRequest, nil, fmt.Errorf("failed to load certificates: %w", err)
+			}
+			options.X509.X5C = certs
+			jwk, err = NewJWKFromX5C(options)
+			if err != nil {
+				return "", http.StatusBadRequest, nil, fmt.Errorf("failed to create JWK from certificates: %w", err)
+			}
+		} else {
+			key, err := LoadX509KeyInfer(block)
+			if err != nil {
+				return "", http.StatusBadRequest, nil, fmt.Errorf("failed to load PEM key: %w", err)
+			}
+			jwk, err = NewJWKFromKey(key, options)
+			if err != nil {
+				return "", http.StatusBadRequest, nil, fmt.Errorf("failed to create JWK from PEM key: %w", err)
+			}
+		}
+	}
+	return a.create(ctx, jwk)
+}
+
+// create writes a new key, which must not have a key ID that is already in use.
+func (a *adminHandler) create(ctx context.Context, jwk JWK) (kid string, status int, body any, err error) {
+	if jwk.Marshal().KID == "" {
+		jwk, err = withThumbprintKeyID(jwk)
+		if err != nil {
+			return "", http.StatusBadRequest, nil, err
+		}
+	}
+	kid = jwk.Marshal().KID
+	a.createMux.Lock()
+	defer a.createMux.Unlock()
+	_, err = a.storage.KeyRead(ctx, kid)
+	if err == nil {
+		return kid, http.StatusConflict, nil, fmt.Errorf("key ID %q is already in use", kid)
+	}
+	if !errors.Is(err, ErrKeyNotFound) {
+		return kid, http.StatusInternalServerError, nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	err = a.storage.KeyWrite(ctx, jwk)
+	if err != nil {
+		return kid, http.StatusInternalServerError, nil, fmt.Errorf("failed to write key: %w", err)
+	}
+	return kid, http.StatusCreated, publicJWK(jwk.Marshal()), nil
+}
+
+func (a *adminHandler) list(ctx context.Context) (status int, body any, err error) {
+	keys, err := a.storage.KeyReadAll(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, nil, fmt.Errorf("failed to read keys: %w", err)
+	}
+	jwks := JWKSMarshal{
+		Keys: make([]JWKMarshal, 0, len(keys)),
+	}
+	for _, key := range keys {
+		jwks.Keys = append(jwks.Keys, publicJWK(key.Marshal()))
+	}
+	return http.StatusOK, jwks, nil
+}
+
+func (a *adminHandler) read(ctx context.Context, kid string) (status int, body any, err error) {
+	jwk, err := a.storage.KeyRead(ctx, kid)
+	if errors.Is(err, ErrKeyNotFound) {
+		return http.StatusNotFound, nil, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	return http.StatusOK, publicJWK(jwk.Marshal()), nil
+}
@@ -0,0 +1,248 @@
+package jwkset
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAdminHandler(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStorage()
+	var events []AdminEvent
+	options := AdminHandlerOptions{
+		Audit: func(_ context.Context, event AdminEvent) {
+			events = append(events, event)
+		},
+		Authorize: func(r *http.Request, action AdminAction, _ string) error {
+			if action != AdminActionList && action != AdminActionRead && r.Header.Get("Authorization") != "admin" {
+				return errors.New("not an admin")
+			}
+			return nil
+		},
+	}
+	_, err := NewAdminHandler(store, AdminHandlerOptions{})
+	if !errors.Is(err, ErrOptions) {
+		t.Fatalf("Expected an error without an Authorize function, but got %s.", err)
+	}
+	handler, err := NewAdminHandler(store, options)
+	if err != nil {
+		t.Fatalf("Failed to create the admin handler.\nError: %s", err)
+	}
+	serve := func(method, target, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "admin")
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := serve(http.MethodPost, "/generate", "application/json", `{"alg":"ES256","kid":"generated","use":"sig"}`)
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, but got %d.\n%s", http.StatusCreated, resp.Code, resp.Body)
+	}
+	generated := assertAdminJWK(t, resp.Body.Bytes())
+	if generated.KID != "generated" || generated.KTY != KtyEC || generated.USE != UseSig {
+		t.Fatalf("Unexpected generated key %+v.", generated)
+	}
+	jwk, err := store.KeyRead(ctx, "generated")
+	if err != nil {
+		t.Fatalf("Failed to read the generated key.\nError: %s", err)
+	}
+	if jwk.Marshal().D == "" {
+		t.Fatalf("Expected the private key to be stored.")
+	}
+
+	resp = serve(http.MethodPost, "/generate", "application/json", `{"alg":"HS256"}`)
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, but got %d.\n%s", http.StatusCreated, resp.Code, resp.Body)
+	}
+	symmetric := assertAdminJWK(t, resp.Body.Bytes())
+	jwk, err = store.KeyRead(ctx, symmetric.KID)
+	if err != nil {
+		t.Fatalf("Failed to read the generated key.\nError: %s", err)
+	}
+	thumbprint, err := jwk.Thumbprint()
+	if err != nil {
+		t.Fatalf("Failed to compute the thumbprint.\nError: %s", err)
+	}
+	if symmetric.KID != thumbprint {
+		t.Fatalf("Expected the thumbprint as key ID, but got %q.", symmetric.KID)
+	}
+
+	resp = serve(http.MethodPost, "/generate", "application/json", `{"alg":"none"}`)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d for an unsupported algorithm, but got %d.", http.StatusBadRequest, resp.Code)
+	}
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate the Ed25519 key.\nError: %s", err)
+	}
+	imported, err := json.Marshal(newStorageTestJWK(t, private, "imported").Marshal())
+	if err != nil {
+		t.Fatalf("Failed to marshal the JWK.\nError: %s", err)
+	}
+	resp = serve(http.MethodPost, "/", "application/jwk+json", string(imported))
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, but got %d.\n%s", http.StatusCreated, resp.Code, resp.Body)
+	}
+	resp = serve(http.MethodPost, "/", "application/jwk+json", string(imported))
+	if resp.Code != http.StatusConflict {
+		t.Fatalf("Expected status %d for an existing key ID, but got %d.", http.StatusConflict, resp.Code)
+	}
+
+	resp = serve(http.MethodPost, "/?kid="+url.QueryEscape("cert/1"), "application/x-pem-file", ec521Cert)
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, but got %d.\n%s", http.StatusCreated, resp.Code, resp.Body)
+	}
+	if resp.Header().Get("Location") != url.PathEscape("cert/1") {
+		t.Fatalf("Unexpected Location %q.", resp.Header().Get("Location"))
+	}
+	resp = serve(http.MethodGet, "/"+url.PathEscape("cert/1"), "", "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d.", http.StatusOK, resp.Code)
+	}
+	if cert := assertAdminJWK(t, resp.Body.Bytes()); len(cert.X5C) == 0 {
+		t.Fatalf("Expected the certificate to be kept.")
+	}
+
+	resp = serve(http.MethodGet, "/", "", "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d.", http.StatusOK, resp.Code)
+	}
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	err = json.Unmarshal(resp.Body.Bytes(), &jwks)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal the JWK Set.\nError: %s", err)
+	}
+	if len(jwks.Keys) != 4 {
+		t.Fatalf("Expected 4 keys, but got %d.", len(jwks.Keys))
+	}
+	for _, key := range jwks.Keys {
+		assertAdminJWK(t, key)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/generated", nil)
+	forbidden := httptest.NewRecorder()
+	handler.ServeHTTP(forbidden, req)
+	if forbidden.Code != http.StatusForbidden {
+		t.Fatalf("Expected status %d, but got %d.", http.StatusForbidden, forbidden.Code)
+	}
+	last := events[len(events)-1]
+	if last.Action != AdminActionDelete || last.KID != "generated" || !errors.Is(last.Err, ErrAdminForbidden) {
+		t.Fatalf("Unexpected audit event %+v.", last)
+	}
+
+	resp = serve(http.MethodDelete, "/generated", "", "")
+	if resp.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, but got %d.", http.StatusNoContent, resp.Code)
+	}
+	last = events[len(events)-1]
+	if last.Action != AdminActionDelete || last.Err != nil {
+		t.Fatalf("Unexpected audit event %+v.", last)
+	}
+	resp = serve(http.MethodDelete, "/generated", "", "")
+	if resp.Code != http.StatusNotFound {
+		t.Fatalf("Expected status %d, but got %d.", http.StatusNotFound, resp.Code)
+	}
+	resp = serve(http.MethodGet, "/generated", "", "")
+	if resp.Code != http.StatusNotFound {
+		t.Fatalf("Expected status %d, but got %d.", http.StatusNotFound, resp.Code)
+	}
+	resp = serve(http.MethodPut, "/generated", "", "")
+	if resp.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status %d, but got %d.", http.StatusMethodNotAllowed, resp.Code)
+	}
+}
+
+// barrierReadStorage is a Storage whose KeyRead waits for the other expected readers before returning, so concurrent
+// requests read before any of them writes. If the others can't arrive, it waits briefly.
+type barrierReadStorage struct {
+	Storage
+	readers *sync.WaitGroup
+}
+
+func (s barrierReadStorage) KeyRead(ctx context.Context, keyID string) (JWK, error) {
+	jwk, err := s.Storage.KeyRead(ctx, keyID)
+	s.readers.Done()
+	arrived := make(chan struct{})
+	go func() {
+		s.readers.Wait()
+		close(arrived)
+	}()
+	select {
+	case <-arrived:
+	case <-time.After(50 * time.Millisecond):
+	}
+	return jwk, err
+}
+
+func TestAdminHandlerConcurrentCreate(t *testing.T) {
+	options := AdminHandlerOptions{
+		Authorize: func(*http.Request, AdminAction, string) error {
+			return nil
+		},
+	}
+	const requests = 5
+	var readers sync.WaitGroup
+	readers.Add(requests)
+	handler, err := NewAdminHandler(barrierReadStorage{Storage: NewMemoryStorage(), readers: &readers}, options)
+	if err != nil {
+		t.Fatalf("Failed to create the admin handler.\nError: %s", err)
+	}
+	codes := make(chan int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/generate", strings.NewReader(`{"alg":"ES256","kid":"same"}`))
+			req.Header.Set("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+			codes <- resp.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	created := 0
+	for code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Fatalf("Unexpected status %d.", code)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("Expected exactly 1 of the concurrent creates to succeed, but %d did.", created)
+	}
+}
+
+func assertAdminJWK(t *testing.T, body []byte) JWKMarshal {
+	var jwk JWKMarshal
+	err := json.Unmarshal(body, &jwk)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal the JWK.\nError: %s", err)
+	}
+	if jwk.D != "" || jwk.K != "" || jwk.P != "" {
+		t.Fatalf("Expected no private key material in the response.")
+	}
+	return jwk
+}
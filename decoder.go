@@ -0,0 +1,135 @@
+package jwkset
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var (
+	// ErrDecode indicates that the keys could not be decoded from an HTTP response.
+	ErrDecode = errors.New("failed to decode keys")
+)
+
+// JWKSetDecoder decodes the keys from the body of an HTTP response. It can be used as the Decoder field of
+// HTTPClientStorageOptions.
+type JWKSetDecoder func(raw []byte) ([]JWK, error)
+
+// DecodeJWKSet decodes the keys of a JSON JWK Set, including any private key material. This is the default
+// JWKSetDecoder.
+func DecodeJWKSet(raw []byte) ([]JWK, error) {
+	var jwks JWKSMarshal
+	err := json.Unmarshal(raw, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode JWK Set response: %w", errors.Join(err, ErrDecode))
+	}
+	keys := make([]JWK, 0, len(jwks.Keys))
+	for _, marshal := range jwks.Keys {
+		marshalOptions := JWKMarshalOptions{
+			Private: true,
+		}
+		jwk, err := NewJWKFromMarshal(marshal, marshalOptions, JWKValidateOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create JWK from JWK Marshal: %w", err)
+		}
+		keys = append(keys, jwk)
+	}
+	return keys, nil
+}
+
+// DecodeJWK decodes a single JSON JWK, including any private key material. It is a JWKSetDecoder for endpoints that
+// publish one bare JWK instead of a JWK Set.
+func DecodeJWK(raw []byte) ([]JWK, error) {
+	marshalOptions := JWKMarshalOptions{
+		Private: true,
+	}
+	jwk, err := NewJWKFromRawJSON(raw, marshalOptions, JWKValidateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode JWK response: %w", errors.Join(err, ErrDecode))
+	}
+	return []JWK{jwk}, nil
+}
+
+// DecodeX509CertificateMap decodes a JSON object that maps key IDs to PEM encoded X.509 certificates, such as the one
+// published by Google for Firebase ID tokens. It is a JWKSetDecoder. Each map key is used as the key ID of the JWK
+// created from its certificate chain. The keys are returned in key ID order.
+func DecodeX509CertificateMap(raw []byte) ([]JWK, error) {
+	var certMap map[string]string
+	err := json.Unmarshal(raw, &certMap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode X.509 certificate map response: %w", errors.Join(err, ErrDecode))
+	}
+	kids := make([]string, 0, len(certMap))
+	for kid := range certMap {
+		kids = append(kids, kid)
+	}
+	slices.Sort(kids)
+	keys := make([]JWK, 0, len(kids))
+	for _, kid := range kids {
+		certs, err := LoadCertificates([]byte(certMap[kid]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load X.509 certificates for key ID %q: %w", kid, errors.Join(err, ErrDecode))
+		}
+		if len(certs) == 0 {
+			return nil, fmt.Errorf("%w: no PEM encoded X.509 certificates found for key ID %q", ErrDecode, kid)
+		}
+		options := JWKOptions{
+			Metadata: JWKMetadataOptions{
+				KID: kid,
+			},
+			X509: JWKX509Options{
+				X5C: certs,
+			},
+		}
+		jwk, err := NewJWKFromX5C(options)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create JWK for key ID %q: %w", kid, err)
+		}
+		keys = append(keys, jwk)
+	}
+	return keys, nil
+}
+
+// DecodePEM decodes a bundle of PEM encoded X.509 certificates. It is a JWKSetDecoder. Each certificate becomes its
+// own JWK, and its key ID is the base64url encoded SHA-256 thumbprint of the certificate, the same value as its
+// x5t#S256 parameter. Other PEM blocks are ignored.
+func DecodePEM(raw []byte) ([]JWK, error) {
+	var keys []JWK
+	for {
+		block, rest := pem.Decode(raw)
+		if block == nil {
+			break
+		}
+		raw = rest
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := LoadCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load X.509 certificate: %w", errors.Join(err, ErrDecode))
+		}
+		sum := sha256.Sum256(cert.Raw)
+		options := JWKOptions{
+			Metadata: JWKMetadataOptions{
+				KID: base64.RawURLEncoding.EncodeToString(sum[:]),
+			},
+			X509: JWKX509Options{
+				X5C: []*x509.Certificate{cert},
+			},
+		}
+		jwk, err := NewJWKFromX5C(options)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create JWK from X.509 certificate: %w", err)
+		}
+		keys = append(keys, jwk)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no PEM encoded X.509 certificates found", ErrDecode)
+	}
+	return keys, nil
+}
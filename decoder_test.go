@@ -0,0 +1,136 @@
+package jwkset
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDecodeJWK(t *testing.T) {
+	jwk := newStorageTestJWK(t, hmacKey1, kidWritten)
+	raw, err := json.Marshal(jwk.Marshal())
+	if err != nil {
+		t.Fatalf("Failed to marshal the JWK.\nError: %s", err)
+	}
+	keys, err := DecodeJWK(raw)
+	if err != nil {
+		t.Fatalf("Failed to decode the JWK.\nError: %s", err)
+	}
+	if len(keys) != 1 || keys[0].Marshal().KID != kidWritten {
+		t.Fatalf("Expected one JWK with key ID %q, but got %d keys.", kidWritten, len(keys))
+	}
+
+	_, err = DecodeJWK([]byte("{"))
+	if !errors.Is(err, ErrDecode) {
+		t.Fatalf("Expected a decode error, but got %s.", err)
+	}
+}
+
+func TestDecodeX509CertificateMap(t *testing.T) {
+	certMap := map[string]string{
+		"rsa": strings.TrimSpace(rsa4096Cert),
+		"ec":  strings.TrimSpace(ec521Cert),
+	}
+	raw, err := json.Marshal(certMap)
+	if err != nil {
+		t.Fatalf("Failed to marshal the certificate map.\nError: %s", err)
+	}
+	keys, err := DecodeX509CertificateMap(raw)
+	if err != nil {
+		t.Fatalf("Failed to decode the certificate map.\nError: %s", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 keys, but got %d.", len(keys))
+	}
+	for i, kid := range []string{"ec", "rsa"} {
+		if keys[i].Marshal().KID != kid {
+			t.Fatalf("Expected key %d to have key ID %q, but got %q.", i, kid, keys[i].Marshal().KID)
+		}
+		if len(keys[i].X509().X5C) != 1 {
+			t.Fatalf("Expected key %q to have its certificate.", kid)
+		}
+	}
+
+	_, err = DecodeX509CertificateMap([]byte(`{"kid": "not a certificate"}`))
+	if !errors.Is(err, ErrDecode) {
+		t.Fatalf("Expected a decode error, but got %s.", err)
+	}
+}
+
+func TestDecodePEM(t *testing.T) {
+	keys, err := DecodePEM([]byte(ec521Cert + "\n" + ed25519Cert))
+	if err != nil {
+		t.Fatalf("Failed to decode the PEM bundle.\nError: %s", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 keys, but got %d.", len(keys))
+	}
+	for _, jwk := range keys {
+		sum := sha256.Sum256(jwk.X509().X5C[0].Raw)
+		expected := base64.RawURLEncoding.EncodeToString(sum[:])
+		if jwk.Marshal().KID != expected || jwk.Marshal().X5TS256 != expected {
+			t.Fatalf("Expected key ID %q to match the thumbprint %q.", jwk.Marshal().KID, expected)
+		}
+	}
+
+	_, err = DecodePEM([]byte("not PEM"))
+	if !errors.Is(err, ErrDecode) {
+		t.Fatalf("Expected a decode error, but got %s.", err)
+	}
+}
+
+func TestStorageFromHTTPDecoder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var fail atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		_, _ = w.Write([]byte(rsa4096Cert))
+	}))
+	defer server.Close()
+	u, err := url.ParseRequestURI(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse the server URL.\nError: %s", err)
+	}
+
+	options := HTTPClientStorageOptions{
+		Ctx:                ctx,
+		Decoder:            DecodePEM,
+		PersistentCacheDir: t.TempDir(),
+	}
+	clientStore, err := NewStorageFromHTTP(u, options)
+	if err != nil {
+		t.Fatalf("Failed to create the HTTP storage.\nError: %s", err)
+	}
+	keys, err := clientStore.KeyReadAll(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read the JWKs.\nError: %s", err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("Expected 1 key, but got %d.", len(keys))
+	}
+	kid := keys[0].Marshal().KID
+
+	fail.Store(true)
+	clientStore, err = NewStorageFromHTTP(u, options)
+	if err != nil {
+		t.Fatalf("Failed to create the HTTP storage from the persistent cache.\nError: %s", err)
+	}
+	_, err = clientStore.KeyRead(ctx, kid)
+	if err != nil {
+		t.Fatalf("Failed to read the JWK from the persistent cache.\nError: %s", err)
+	}
+}
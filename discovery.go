@@ -0,0 +1,368 @@
+package jwkset
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// WellKnownOAuthAuthorizationServer is the well-known URI suffix for OAuth 2.0 Authorization Server Metadata.
+	// https://www.rfc-editor.org/rfc/rfc8414#section-3
+	WellKnownOAuthAuthorizationServer = "/.well-known/oauth-authorization-server"
+	// WellKnownOpenIDConfiguration is the well-known URI suffix for OpenID Connect Discovery.
+	// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderConfig
+	WellKnownOpenIDConfiguration = "/.well-known/openid-configuration"
+)
+
+var (
+	// ErrDiscovery indicates that the metadata of an issuer could not be discovered.
+	ErrDiscovery = errors.New("failed to discover issuer metadata")
+	// ErrIssuerMismatch indicates that the issuer in discovered metadata does not match the expected issuer.
+	ErrIssuerMismatch = errors.New("issuer in metadata does not match expected issuer")
+)
+
+// IssuerMetadata contains the members of OpenID Connect Discovery and OAuth 2.0 Authorization Server Metadata
+// documents that are relevant to JWK Sets.
+type IssuerMetadata struct {
+	Issuer  string `json:"issuer"`   // https://www.rfc-editor.org/rfc/rfc8414#section-2
+	JWKSURI string `json:"jwks_uri"` // https://www.rfc-editor.org/rfc/rfc8414#section-2
+}
+
+// DiscoveryOptions are used to configure the behavior of NewStorageFromIssuer.
+type DiscoveryOptions struct {
+	// Client is the HTTP client to use for metadata requests.
+	//
+	// This defaults to http.DefaultClient.
+	Client *http.Client
+
+	// Ctx is used when performing HTTP requests. It is also used to end the rediscovery goroutine and the refresh
+	// goroutine of the JWK Set Storage when they're no longer needed.
+	//
+	// This defaults to context.Background().
+	Ctx context.Context
+
+	// HTTPTimeout is the timeout for each metadata request.
+	//
+	// This defaults to time.Minute.
+	HTTPTimeout time.Duration
+
+	// NoOpenIDConfiguration skips the OpenID Connect Discovery well-known URI and only uses the OAuth 2.0 Authorization
+	// Server Metadata well-known URI.
+	NoOpenIDConfiguration bool
+
+	// RediscoveryErrorHandler is a function that consumes errors that happen during rediscovery. This is only effectual
+	// if RediscoveryInterval is set.
+	RediscoveryErrorHandler func(ctx context.Context, err error)
+
+	// RediscoveryInterval is the interval at which the issuer metadata is discovered again. If the jwks_uri changed, a
+	// new JWK Set Storage is created for it and, once its first HTTP request succeeds, the old one is closed. This option
+	// will launch a "rediscovery goroutine".
+	RediscoveryInterval time.Duration
+
+	// Storage are the options for the JWK Set Storage created from the discovered jwks_uri. The Client and Ctx options
+	// default to the Client and Ctx of these options.
+	Storage HTTPClientStorageOptions
+}
+
+// DiscoverIssuerMetadata requests the metadata of the given issuer. The OpenID Connect Discovery well-known URI is tried
+// first and, if it does not respond with HTTP 200 OK, the OAuth 2.0 Authorization Server Metadata well-known URI is
+// tried. The issuer in the metadata must exactly match the given issuer.
+func DiscoverIssuerMetadata(ctx context.Context, issuer string, options DiscoveryOptions) (IssuerMetadata, error) {
+	if options.Client == nil {
+		options.Client = http.DefaultClient
+	}
+	u, err := url.ParseRequestURI(issuer)
+	if err != nil {
+		return IssuerMetadata{}, fmt.Errorf("failed to parse issuer URL %q: %w", issuer, errors.Join(err, ErrDiscovery))
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return IssuerMetadata{}, fmt.Errorf("%w: issuer URL %q must not have a query or fragment", ErrDiscovery, issuer)
+	}
+
+	var wellKnown []string
+	if !options.NoOpenIDConfiguration {
+		wellKnown = append(wellKnown, strings.TrimSuffix(issuer, "/")+WellKnownOpenIDConfiguration)
+	}
+	oauth := *u
+	oauth.Path = WellKnownOAuthAuthorizationServer + strings.TrimSuffix(u.Path, "/")
+	oauth.RawPath = ""
+	wellKnown = append(wellKnown, oauth.String())
+
+	var errs []error
+	for _, w := range wellKnown {
+		metadata, err := getIssuerMetadata(ctx, options.Client, w)
+		if err != nil {
+			errs = append(errs, err)
+			if errors.Is(err, ErrInvalidHTTPStatusCode) {
+				continue
+			}
+			break
+		}
+		if metadata.Issuer != issuer {
+			return IssuerMetadata{}, fmt.Errorf("%w: expected %q but got %q from %q", errors.Join(ErrDiscovery, ErrIssuerMismatch), issuer, metadata.Issuer, w)
+		}
+		_, err = url.ParseRequestURI(metadata.JWKSURI)
+		if err != nil {
+			return IssuerMetadata{}, fmt.Errorf("failed to parse jwks_uri from %q: %w", w, errors.Join(err, ErrDiscovery))
+		}
+		return metadata, nil
+	}
+	return IssuerMetadata{}, fmt.Errorf("failed to get metadata for issuer %q: %w", issuer, errors.Join(append(errs, ErrDiscovery)...))
+}
+
+func getIssuerMetadata(ctx context.Context, client *http.Client, u string) (IssuerMetadata, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return IssuerMetadata{}, fmt.Errorf("failed to create HTTP request for issuer metadata: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return IssuerMetadata{}, fmt.Errorf("failed to perform HTTP request for issuer metadata: %w", err)
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return IssuerMetadata{}, httpStatusError{statusCode: resp.StatusCode}
+	}
+	var metadata IssuerMetadata
+	err = json.NewDecoder(resp.Body).Decode(&metadata)
+	if err != nil {
+		return IssuerMetadata{}, fmt.Errorf("failed to decode issuer metadata response: %w", err)
+	}
+	return metadata, nil
+}
+
+var (
+	_ KeyQuery          = &discoveryStorage{}
+	_ onDemandRefresher = &discoveryStorage{}
+)
+
+type discoveryStorage struct {
+	issuer  string
+	options DiscoveryOptions
+
+	mux     sync.RWMutex
+	handle  HTTPStorageHandle
+	jwksURI string
+	store   Storage
+}
+
+// NewStorageFromIssuer creates a new Storage implementation for the JWK Set of the given issuer. The jwks_uri is found
+// with DiscoverIssuerMetadata and is then used the same way as NewStorageFromHTTP. If the RediscoveryInterval option
+// is set, a background goroutine periodically discovers the issuer metadata again and follows a changed jwks_uri.
+func NewStorageFromIssuer(issuer string, options DiscoveryOptions) (Storage, error) {
+	if options.Client == nil {
+		options.Client = http.DefaultClient
+	}
+	if options.Ctx == nil {
+		options.Ctx = context.Background()
+	}
+	if options.HTTPTimeout == 0 {
+		options.HTTPTimeout = time.Minute
+	}
+	if options.Storage.Client == nil {
+		options.Storage.Client = options.Client
+	}
+	if options.Storage.Ctx == nil {
+		options.Storage.Ctx = options.Ctx
+	}
+
+	d := &discoveryStorage{
+		issuer:  issuer,
+		options: options,
+	}
+	err := d.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	if options.RediscoveryInterval != 0 {
+		go func() { // Rediscovery goroutine.
+			ticker := time.NewTicker(options.RediscoveryInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-options.Ctx.Done():
+					return
+				case <-ticker.C:
+					err := d.discover()
+					if err != nil && options.RediscoveryErrorHandler != nil {
+						options.RediscoveryErrorHandler(options.Ctx, err)
+					}
+				}
+			}
+		}()
+	}
+
+	return d, nil
+}
+
+// discover requests the issuer metadata and replaces the JWK Set Storage if the jwks_uri changed.
+func (d *discoveryStorage) discover() error {
+	ctx, cancel := context.WithTimeout(d.options.Ctx, d.options.HTTPTimeout)
+	defer cancel()
+	metadata, err := DiscoverIssuerMetadata(ctx, d.issuer, d.options)
+	if err != nil {
+		return err
+	}
+
+	d.mux.RLock()
+	unchanged := d.jwksURI == metadata.JWKSURI
+	d.mux.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	u, err := url.ParseRequestURI(metadata.JWKSURI)
+	if err != nil {
+		return fmt.Errorf("failed to parse jwks_uri %q: %w", metadata.JWKSURI, errors.Join(err, ErrDiscovery))
+	}
+	store, handle, err := NewStorageFromHTTPWithHandle(u, d.options.Storage)
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP storage for jwks_uri %q: %w", metadata.JWKSURI, err)
+	}
+	if status := handle.LastRefresh(); d.current() != nil && status.Succeeded.IsZero() {
+		// The NoErrorReturnFirstHTTPReq option hid the error. Keep the keys of the previous jwks_uri.
+		_ = handle.Close()
+		return fmt.Errorf("failed to perform first HTTP request for changed jwks_uri %q, keeping %q: %w", metadata.JWKSURI, d.currentURI(), errors.Join(status.Err, ErrDiscovery))
+	}
+
+	d.mux.Lock()
+	old := d.handle
+	d.handle = handle
+	d.jwksURI = metadata.JWKSURI
+	d.store = store
+	d.mux.Unlock()
+	if old != nil {
+		_ = old.Close()
+	}
+	return nil
+}
+
+func (d *discoveryStorage) currentURI() string {
+	d.mux.RLock()
+	defer d.mux.RUnlock()
+	return d.jwksURI
+}
+func (d *discoveryStorage) current() Storage {
+	d.mux.RLock()
+	defer d.mux.RUnlock()
+	return d.store
+}
+
+func (d *discoveryStorage) refreshOnDemand(ctx context.Context) error {
+	r, ok := d.current().(onDemandRefresher)
+	if !ok {
+		return nil
+	}
+	return r.refreshOnDemand(ctx)
+}
+
+func (d *discoveryStorage) KeyDelete(ctx context.Context, keyID string) (ok bool, err error) {
+	return d.current().KeyDelete(ctx, keyID)
+}
+func (d *discoveryStorage) KeyQuery(ctx context.Context, filter KeyFilter) ([]JWK, error) {
+	return QueryKeys(ctx, d.current(), filter)
+}
+func (d *discoveryStorage) KeyRead(ctx context.Context, keyID string) (JWK, error) {
+	return d.current().KeyRead(ctx, keyID)
+}
+func (d *discoveryStorage) KeyReadAll(ctx context.Context) ([]JWK, error) {
+	return d.current().KeyReadAll(ctx)
+}
+func (d *discoveryStorage) KeyWrite(ctx context.Context, jwk JWK) error {
+	return d.current().KeyWrite(ctx, jwk)
+}
+
+func (d *discoveryStorage) JSON(ctx context.Context) (json.RawMessage, error) {
+	return d.current().JSON(ctx)
+}
+func (d *discoveryStorage) JSONPublic(ctx context.Context) (json.RawMessage, error) {
+	return d.current().JSONPublic(ctx)
+}
+func (d *discoveryStorage) JSONPrivate(ctx context.Context) (json.RawMessage, error) {
+	return d.current().JSONPrivate(ctx)
+}
+func (d *discoveryStorage) JSONWithOptions(ctx context.Context, marshalOptions JWKMarshalOptions, validationOptions JWKValidateOptions) (json.RawMessage, error) {
+	return d.current().JSONWithOptions(ctx, marshalOptions, validationOptions)
+}
+func (d *discoveryStorage) Marshal(ctx context.Context) (JWKSMarshal, error) {
+	return d.current().Marshal(ctx)
+}
+func (d *discoveryStorage) MarshalWithOptions(ctx context.Context, marshalOptions JWKMarshalOptions, validationOptions JWKValidateOptions) (JWKSMarshal, error) {
+	return d.current().MarshalWithOptions(ctx, marshalOptions, validationOptions)
+}
+
+// NewDefaultHTTPClientFromIssuers creates a new JWK Set client with default options from the JWK Sets of the given
+// issuers. The jwks_uri of each issuer is found with DiscoverIssuerMetadata. Reads with a context from
+// ContextWithIssuer only use the keys of that issuer.
+//
+// The default behavior is the same as NewDefaultHTTPClient and also to:
+// 1. Discover the issuer metadata again every 24 hours to follow a changed jwks_uri.
+// 2. Log to slog.Default() if a rediscovery fails.
+func NewDefaultHTTPClientFromIssuers(issuers []string) (Storage, error) {
+	return NewDefaultHTTPClientFromIssuersCtx(context.Background(), issuers)
+}
+
+// NewDefaultHTTPClientFromIssuersCtx is the same as NewDefaultHTTPClientFromIssuers, but with a context that can end the
+// refresh and rediscovery goroutines.
+func NewDefaultHTTPClientFromIssuersCtx(ctx context.Context, issuers []string) (Storage, error) {
+	clientOptions := HTTPClientOptions{
+		RefreshUnknownKID:       rate.NewLimiter(rate.Every(5*time.Minute), 1),
+		UnknownKIDCacheDuration: 5 * time.Minute,
+	}
+	for _, issuer := range issuers {
+		source, err := newDefaultIssuerSource(ctx, issuer)
+		if err != nil {
+			return nil, err
+		}
+		clientOptions.Sources = append(clientOptions.Sources, source)
+	}
+	return NewHTTPClient(clientOptions)
+}
+
+// newDefaultIssuerSource creates the source of the issuer for NewDefaultHTTPClientFromIssuersCtx.
+func newDefaultIssuerSource(ctx context.Context, issuer string) (HTTPSource, error) {
+	refreshErrorHandler := func(ctx context.Context, err error) {
+		slog.Default().ErrorContext(ctx, "Failed to refresh HTTP JWK Set from remote HTTP resource.",
+			"error", err,
+			"issuer", issuer,
+		)
+	}
+	rediscoveryErrorHandler := func(ctx context.Context, err error) {
+		slog.Default().ErrorContext(ctx, "Failed to rediscover issuer metadata.",
+			"error", err,
+			"issuer", issuer,
+		)
+	}
+	options := DiscoveryOptions{
+		Ctx:                     ctx,
+		RediscoveryErrorHandler: rediscoveryErrorHandler,
+		RediscoveryInterval:     24 * time.Hour,
+		Storage: HTTPClientStorageOptions{
+			NoErrorReturnFirstHTTPReq: true,
+			RefreshErrorHandler:       refreshErrorHandler,
+			RefreshInterval:           time.Hour,
+		},
+	}
+	store, err := NewStorageFromIssuer(issuer, options)
+	if err != nil {
+		return HTTPSource{}, fmt.Errorf("failed to create HTTP client storage for issuer %q: %w", issuer, errors.Join(err, ErrNewClient))
+	}
+	source := HTTPSource{
+		Issuer:  issuer,
+		Name:    issuer,
+		Storage: store,
+	}
+	return source, nil
+}
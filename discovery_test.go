@@ -0,0 +1,213 @@
+package jwkset
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type discoveryTestServer struct {
+	issuerPath string
+	mux        sync.Mutex
+	metadata   IssuerMetadata
+	oauthOnly  bool
+	server     *httptest.Server
+	stores     map[string]Storage
+}
+
+func newDiscoveryTestServer(t *testing.T, issuerPath string, oauthOnly bool) *discoveryTestServer {
+	d := &discoveryTestServer{
+		issuerPath: issuerPath,
+		oauthOnly:  oauthOnly,
+		stores:     make(map[string]Storage),
+	}
+	d.server = httptest.NewServer(http.HandlerFunc(d.handle))
+	t.Cleanup(d.server.Close)
+	return d
+}
+
+func (d *discoveryTestServer) handle(w http.ResponseWriter, r *http.Request) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	switch r.URL.Path {
+	case d.issuerPath + WellKnownOpenIDConfiguration:
+		if d.oauthOnly {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(d.metadata)
+	case WellKnownOAuthAuthorizationServer + d.issuerPath:
+		_ = json.NewEncoder(w).Encode(d.metadata)
+	default:
+		store, ok := d.stores[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rawJWKS, err := store.JSONPrivate(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(rawJWKS)
+	}
+}
+
+func (d *discoveryTestServer) setJWKS(t *testing.T, path string, key []byte, keyID string) {
+	store := NewMemoryStorage()
+	err := store.KeyWrite(context.Background(), newStorageTestJWK(t, key, keyID))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the server store.\nError: %s", err)
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.stores[path] = store
+	d.metadata = IssuerMetadata{
+		Issuer:  d.server.URL + d.issuerPath,
+		JWKSURI: d.server.URL + path,
+	}
+}
+
+func TestNewStorageFromIssuer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := newDiscoveryTestServer(t, "", false)
+	d.setJWKS(t, "/jwks-1", hmacKey1, kidWritten)
+	issuer := d.server.URL
+
+	store, err := NewStorageFromIssuer(issuer, DiscoveryOptions{Ctx: ctx})
+	if err != nil {
+		t.Fatalf("Failed to create storage from issuer.\nError: %s", err)
+	}
+	_, err = store.KeyRead(ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Failed to read the JWK.\nError: %s", err)
+	}
+
+	d.setJWKS(t, "/jwks-2", hmacKey2, kidWritten2)
+	err = store.(*discoveryStorage).discover()
+	if err != nil {
+		t.Fatalf("Failed to rediscover.\nError: %s", err)
+	}
+	_, err = store.KeyRead(ctx, kidWritten2)
+	if err != nil {
+		t.Fatalf("Failed to read the JWK from the changed jwks_uri.\nError: %s", err)
+	}
+	_, err = store.KeyRead(ctx, kidWritten)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Should have specific error when reading missing key.\n  Actual: %s\n  Expected: %s", err, ErrKeyNotFound)
+	}
+
+	_, err = NewStorageFromIssuer(issuer+"/other", DiscoveryOptions{Ctx: ctx})
+	if !errors.Is(err, ErrDiscovery) {
+		t.Fatalf("Expected a discovery error for an unknown issuer, but got %s.", err)
+	}
+}
+
+func TestNewStorageFromIssuerFailedChange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := newDiscoveryTestServer(t, "", false)
+	d.setJWKS(t, "/jwks-1", hmacKey1, kidWritten)
+	options := DiscoveryOptions{
+		Ctx: ctx,
+		Storage: HTTPClientStorageOptions{
+			NoErrorReturnFirstHTTPReq: true,
+		},
+	}
+	store, err := NewStorageFromIssuer(d.server.URL, options)
+	if err != nil {
+		t.Fatalf("Failed to create storage from issuer.\nError: %s", err)
+	}
+
+	d.mux.Lock()
+	d.metadata.JWKSURI = d.server.URL + "/unavailable"
+	d.mux.Unlock()
+	err = store.(*discoveryStorage).discover()
+	if !errors.Is(err, ErrDiscovery) {
+		t.Fatalf("Expected a discovery error when the changed jwks_uri fails, but got %v.", err)
+	}
+	_, err = store.KeyRead(ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Expected the keys of the previous jwks_uri to be kept.\nError: %s", err)
+	}
+
+	d.setJWKS(t, "/unavailable", hmacKey2, kidWritten2)
+	err = store.(*discoveryStorage).discover()
+	if err != nil {
+		t.Fatalf("Failed to rediscover after the changed jwks_uri recovered.\nError: %s", err)
+	}
+	_, err = store.KeyRead(ctx, kidWritten2)
+	if err != nil {
+		t.Fatalf("Failed to read the JWK from the changed jwks_uri.\nError: %s", err)
+	}
+}
+
+func TestNewStorageFromIssuerStale(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	d := newDiscoveryTestServer(t, "", false)
+	d.setJWKS(t, "/jwks", hmacKey1, kidWritten)
+	staleChanges := make(chan bool, 1)
+	options := DiscoveryOptions{
+		Ctx: ctx,
+		Storage: HTTPClientStorageOptions{
+			MaxStaleness: 100 * time.Millisecond,
+			StaleHandler: func(_ context.Context, stale bool) {
+				staleChanges <- stale
+			},
+		},
+	}
+	store, err := NewStorageFromIssuer(d.server.URL, options)
+	if err != nil {
+		t.Fatalf("Failed to create storage from issuer.\nError: %s", err)
+	}
+	client, err := NewHTTPClient(HTTPClientOptions{
+		Sources: []HTTPSource{{Name: "issuer", Storage: store}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the HTTP client.\nError: %s", err)
+	}
+	if stale := <-staleChanges; !stale {
+		t.Fatalf("Expected the storage to become stale.")
+	}
+	for _, s := range []Storage{store, client} {
+		_, err = QueryKeys(ctx, s, KeyFilter{})
+		if !errors.Is(err, ErrStaleJWKSet) {
+			t.Fatalf("Unexpected error when querying a stale storage.\n  Actual: %v\n  Expected: %s", err, ErrStaleJWKSet)
+		}
+	}
+}
+
+func TestDiscoverIssuerMetadataOAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := newDiscoveryTestServer(t, "/tenant", true)
+	d.setJWKS(t, "/jwks", hmacKey1, kidWritten)
+	issuer := d.server.URL + "/tenant"
+
+	metadata, err := DiscoverIssuerMetadata(ctx, issuer, DiscoveryOptions{})
+	if err != nil {
+		t.Fatalf("Failed to discover issuer metadata.\nError: %s", err)
+	}
+	if metadata.JWKSURI != d.server.URL+"/jwks" {
+		t.Fatalf("Unexpected jwks_uri %q.", metadata.JWKSURI)
+	}
+
+	d.mux.Lock()
+	d.metadata.Issuer = "https://attacker.example.com"
+	d.mux.Unlock()
+	_, err = DiscoverIssuerMetadata(ctx, issuer, DiscoveryOptions{})
+	if !errors.Is(err, ErrIssuerMismatch) {
+		t.Fatalf("Expected an issuer mismatch error, but got %s.", err)
+	}
+}
@@ -47,18 +47,8 @@ func main() {
 		logger.Fatalf(logFmt, "Failed to store RSA key.", err)
 	}
 
-	http.HandleFunc("/jwks.json", func(writer http.ResponseWriter, request *http.Request) {
-		// TODO Cache the JWK Set so storage isn't called for every request.
-		response, err := jwkSet.JSONPublic(request.Context())
-		if err != nil {
-			logger.Printf(logFmt, "Failed to get JWK Set JSON.", err)
-			writer.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		writer.Header().Set("Content-Type", "application/json")
-		_, _ = writer.Write(response)
-	})
+	// The handler only serves public keys and answers If-None-Match with 304 Not Modified.
+	http.Handle("/jwks.json", jwkset.NewHandler(jwkSet, jwkset.HandlerOptions{}))
 
 	logger.Print("Visit: http://localhost:8080/jwks.json")
 	logger.Fatalf("Failed to listen and serve: %s", http.ListenAndServe(":8080", nil))
@@ -0,0 +1,301 @@
+package jwkset
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrFetchNotAllowed indicates that a URL or the network address it resolved to is not allowed by a SafeFetcher.
+	ErrFetchNotAllowed = errors.New("fetching the URL is not allowed")
+)
+
+// blockedPrefixes are special-purpose address ranges that are not covered by the methods of netip.Addr.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "This network", RFC 791.
+	netip.MustParsePrefix("100.64.0.0/10"), // Shared address space, RFC 6598.
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments, RFC 6890.
+	netip.MustParsePrefix("198.18.0.0/15"), // Benchmarking, RFC 2544.
+	netip.MustParsePrefix("64:ff9b::/96"),  // IPv4/IPv6 translation, RFC 6052.
+}
+
+// SafeFetcherOptions are used to configure the behavior of NewSafeFetcher.
+type SafeFetcherOptions struct {
+	// AllowedHosts are host names that may be fetched. A host name that starts with "*." also allows all of its
+	// subdomains, but not itself. Host names are compared without the port.
+	AllowedHosts []string
+
+	// AllowedURLPrefixes are prefixes of URLs that may be fetched. The scheme and host of a URL must equal those of the
+	// prefix, and its path must start with the path of the prefix. URLs whose paths have "." or ".." segments are not
+	// allowed by a prefix, because the server may resolve them outside of it. To avoid matching unintended paths, each
+	// prefix should end with "/".
+	AllowedURLPrefixes []string
+
+	// AllowPrivateNetworks disables blocking of loopback, link-local, private, and other special-purpose network
+	// addresses. This should only be used for testing.
+	AllowPrivateNetworks bool
+
+	// CacheTTL is the amount of time a successful response is cached for.
+	//
+	// By default, responses are not cached.
+	CacheTTL time.Duration
+
+	// HTTPTimeout is the timeout for each fetch, including redirects.
+	//
+	// This defaults to 10 seconds.
+	HTTPTimeout time.Duration
+
+	// MaxBodySize is the maximum size of a response body in bytes.
+	//
+	// This defaults to 1 MiB.
+	MaxBodySize int64
+
+	// MaxRedirects is the maximum number of redirects to follow. Each redirect must also be allowed.
+	//
+	// By default, redirects are not followed.
+	MaxRedirects int
+
+	// RootCAs are the root certificate authorities used to verify servers. If nil, the system pool is used.
+	RootCAs *x509.CertPool
+}
+
+// SafeFetcher fetches remote resources referenced by untrusted input, such as the jku JWT header and the x5u JWK
+// parameter, while protecting against server-side request forgery (SSRF). Only https URLs that match an allowlist
+// are fetched. After DNS resolution, connections to loopback, link-local, private, and other special-purpose network
+// addresses are refused. Proxies from the environment are not used.
+type SafeFetcher struct {
+	client   *http.Client
+	options  SafeFetcherOptions
+	prefixes []*url.URL
+
+	mux   sync.Mutex
+	cache map[string]safeFetcherEntry
+}
+
+type safeFetcherEntry struct {
+	body    []byte
+	expires time.Time
+}
+
+// NewSafeFetcher creates a new SafeFetcher. At least one of the AllowedHosts and AllowedURLPrefixes options must be set.
+func NewSafeFetcher(options SafeFetcherOptions) (*SafeFetcher, error) {
+	if len(options.AllowedHosts) == 0 && len(options.AllowedURLPrefixes) == 0 {
+		return nil, fmt.Errorf("%w: an allowlist of hosts or URL prefixes is required", ErrOptions)
+	}
+	if options.HTTPTimeout == 0 {
+		options.HTTPTimeout = 10 * time.Second
+	}
+	if options.MaxBodySize == 0 {
+		options.MaxBodySize = 1 << 20
+	}
+	f := &SafeFetcher{
+		options: options,
+		cache:   make(map[string]safeFetcherEntry),
+	}
+	for _, raw := range options.AllowedURLPrefixes {
+		prefix, err := url.Parse(raw)
+		if err != nil || prefix.Scheme == "" || prefix.Host == "" {
+			return nil, fmt.Errorf("%w: invalid allowed URL prefix %q", ErrOptions, raw)
+		}
+		f.prefixes = append(f.prefixes, prefix)
+	}
+	dialer := &net.Dialer{
+		Timeout: options.HTTPTimeout,
+		Control: f.control,
+	}
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+		TLSClientConfig:     &tls.Config{RootCAs: options.RootCAs},
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	f.client = &http.Client{
+		CheckRedirect: f.checkRedirect,
+		Timeout:       options.HTTPTimeout,
+		Transport:     transport,
+	}
+	return f, nil
+}
+
+// Fetch gets the body of the resource at the given URL. The URL must be allowed and the response must have HTTP 200 OK
+// status. Any pointers returned should be considered read-only, because the response may be cached.
+func (f *SafeFetcher) Fetch(ctx context.Context, u *url.URL) ([]byte, error) {
+	err := f.checkURL(u)
+	if err != nil {
+		return nil, err
+	}
+	key := u.String()
+	if f.options.CacheTTL > 0 {
+		f.mux.Lock()
+		entry, ok := f.cache[key]
+		f.mux.Unlock()
+		if ok && time.Now().Before(entry.expires) {
+			return entry.body, nil
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to perform HTTP request: %w", err)
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, httpStatusError{statusCode: resp.StatusCode}
+	}
+	body, err := readBody(resp.Body, f.options.MaxBodySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HTTP response: %w", err)
+	}
+
+	if f.options.CacheTTL > 0 {
+		f.mux.Lock()
+		now := time.Now()
+		for k, entry := range f.cache {
+			if now.After(entry.expires) {
+				delete(f.cache, k)
+			}
+		}
+		f.cache[key] = safeFetcherEntry{
+			body:    body,
+			expires: now.Add(f.options.CacheTTL),
+		}
+		f.mux.Unlock()
+	}
+	return body, nil
+}
+
+// GetX5U fetches the X.509 certificate chain at the given x5u URI. It can be used as the GetX5U field of
+// JWKValidateOptions.
+func (f *SafeFetcher) GetX5U(u *url.URL) ([]*x509.Certificate, error) {
+	body, err := f.Fetch(context.Background(), u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch X5U: %w", errors.Join(ErrGetX5U, err))
+	}
+	certs, err := LoadCertificates(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse X5U response body: %w", errors.Join(ErrGetX5U, err))
+	}
+	return certs, nil
+}
+
+// JKUStorage fetches the JWK Set at the given jku URL and returns a new in-memory Storage with its keys. The Storage is
+// not refreshed, so it is meant to be used for a single JWT.
+func (f *SafeFetcher) JKUStorage(ctx context.Context, jku string) (Storage, error) {
+	u, err := url.ParseRequestURI(jku)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse jku URL %q: %w", jku, err)
+	}
+	body, err := f.Fetch(ctx, u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch jku URL %q: %w", jku, err)
+	}
+	keys, err := DecodeJWKSet(body)
+	if err != nil {
+		return nil, err
+	}
+	store := NewMemoryStorage()
+	for _, jwk := range keys {
+		err = store.KeyWrite(ctx, jwk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write JWK to storage: %w", err)
+		}
+	}
+	return store, nil
+}
+
+func (f *SafeFetcher) checkURL(u *url.URL) error {
+	if u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme must be https: %q", ErrFetchNotAllowed, u.String())
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: URL must not have user information", ErrFetchNotAllowed)
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range f.options.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return nil
+			}
+		} else if host == allowed {
+			return nil
+		}
+	}
+	if !hasDotSegment(u.Path) {
+		for _, prefix := range f.prefixes {
+			if urlHasPrefix(u, prefix) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: URL is not in the allowlist: %q", ErrFetchNotAllowed, u.String())
+}
+
+// urlHasPrefix reports whether the URL has the same scheme and host as the prefix and a path that starts with its
+// path. If the prefix has a query, the path must be equal and the query must start with it.
+func urlHasPrefix(u, prefix *url.URL) bool {
+	if !strings.EqualFold(u.Scheme, prefix.Scheme) || !strings.EqualFold(u.Host, prefix.Host) {
+		return false
+	}
+	if prefix.RawQuery != "" || prefix.ForceQuery {
+		return u.Path == prefix.Path && strings.HasPrefix(u.RawQuery, prefix.RawQuery)
+	}
+	return strings.HasPrefix(u.Path, prefix.Path)
+}
+
+// hasDotSegment reports whether the decoded path has a "." or ".." segment. Backslashes count as separators, because
+// some servers treat them like slashes.
+func hasDotSegment(path string) bool {
+	for _, segment := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *SafeFetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > f.options.MaxRedirects {
+		return fmt.Errorf("%w: stopped after %d redirects", ErrFetchNotAllowed, f.options.MaxRedirects)
+	}
+	return f.checkURL(req.URL)
+}
+
+// control is called after DNS resolution with the network address that is about to be connected to.
+func (f *SafeFetcher) control(_, address string, _ syscall.RawConn) error {
+	if f.options.AllowPrivateNetworks {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("failed to parse network address %q: %w", address, errors.Join(err, ErrFetchNotAllowed))
+	}
+	addr := addrPort.Addr().Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return fmt.Errorf("%w: network address %s is not public", ErrFetchNotAllowed, addr)
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return fmt.Errorf("%w: network address %s is reserved", ErrFetchNotAllowed, addr)
+		}
+	}
+	return nil
+}
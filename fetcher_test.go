@@ -0,0 +1,185 @@
+package jwkset
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSafeFetcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverStore := NewMemoryStorage()
+	err := serverStore.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the server store.\nError: %s", err)
+	}
+	rawJWKS, err := serverStore.JSONPrivate(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get the JSON.\nError: %s", err)
+	}
+	var requests atomic.Int64
+	var certPEM []byte
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/jwks.json":
+			_, _ = w.Write(rawJWKS)
+		case "/x5u":
+			_, _ = w.Write(certPEM)
+		case "/redirect":
+			http.Redirect(w, r, "/jwks.json", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+
+	options := SafeFetcherOptions{
+		AllowedURLPrefixes:   []string{server.URL + "/"},
+		AllowPrivateNetworks: true,
+		CacheTTL:             time.Minute,
+		RootCAs:              rootCAs,
+	}
+	fetcher, err := NewSafeFetcher(options)
+	if err != nil {
+		t.Fatalf("Failed to create the fetcher.\nError: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		store, err := fetcher.JKUStorage(ctx, server.URL+"/jwks.json")
+		if err != nil {
+			t.Fatalf("Failed to create storage from jku.\nError: %s", err)
+		}
+		_, err = store.KeyRead(ctx, kidWritten)
+		if err != nil {
+			t.Fatalf("Failed to read the JWK.\nError: %s", err)
+		}
+	}
+	if actual := requests.Load(); actual != 1 {
+		t.Fatalf("Expected the second fetch to be cached, but got %d requests.", actual)
+	}
+
+	u, err := url.ParseRequestURI(server.URL + "/x5u")
+	if err != nil {
+		t.Fatalf("Failed to parse the X5U URL.\nError: %s", err)
+	}
+	certs, err := fetcher.GetX5U(u)
+	if err != nil {
+		t.Fatalf("Failed to get X5U.\nError: %s", err)
+	}
+	if len(certs) != 1 || !certs[0].Equal(server.Certificate()) {
+		t.Fatalf("Unexpected X5U certificates.")
+	}
+
+	for _, disallowed := range []string{
+		"https://attacker.example.com/jwks.json",
+		"http" + server.URL[len("https"):] + "/jwks.json",
+		server.URL + "/redirect",
+	} {
+		_, err = fetcher.JKUStorage(ctx, disallowed)
+		if !errors.Is(err, ErrFetchNotAllowed) {
+			t.Fatalf("Expected %q not to be allowed, but got %v.", disallowed, err)
+		}
+	}
+
+	options.AllowPrivateNetworks = false
+	fetcher, err = NewSafeFetcher(options)
+	if err != nil {
+		t.Fatalf("Failed to create the fetcher.\nError: %s", err)
+	}
+	_, err = fetcher.JKUStorage(ctx, server.URL+"/jwks.json")
+	if !errors.Is(err, ErrFetchNotAllowed) {
+		t.Fatalf("Expected a loopback address not to be allowed, but got %v.", err)
+	}
+
+	_, err = NewSafeFetcher(SafeFetcherOptions{})
+	if !errors.Is(err, ErrOptions) {
+		t.Fatalf("Expected an options error without an allowlist, but got %v.", err)
+	}
+}
+
+func TestSafeFetcherAllowedHosts(t *testing.T) {
+	fetcher, err := NewSafeFetcher(SafeFetcherOptions{
+		AllowedHosts: []string{"example.com", "*.example.org"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the fetcher.\nError: %s", err)
+	}
+	tc := map[string]bool{
+		"https://example.com/jwks.json":       true,
+		"https://EXAMPLE.com:8443/jwks.json":  true,
+		"https://sub.example.com/jwks.json":   false,
+		"https://a.example.org/jwks.json":     true,
+		"https://example.org/jwks.json":       false,
+		"https://evilexample.org/jwks.json":   false,
+		"https://user@example.com/jwks.json":  false,
+		"http://example.com/jwks.json":        false,
+		"https://example.com.evil/jwks.json":  false,
+		"https://a.example.org.evil/jwk.json": false,
+	}
+	for raw, allowed := range tc {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatalf("Failed to parse %q.\nError: %s", raw, err)
+		}
+		err = fetcher.checkURL(u)
+		if (err == nil) != allowed {
+			t.Fatalf("Unexpected result for %q. Allowed: %t. Error: %v.", raw, allowed, err)
+		}
+	}
+}
+
+func TestSafeFetcherAllowedURLPrefixes(t *testing.T) {
+	fetcher, err := NewSafeFetcher(SafeFetcherOptions{
+		AllowedURLPrefixes: []string{"https://idp.example/jwks/", "https://other.example/keys?tenant="},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the fetcher.\nError: %s", err)
+	}
+	tc := map[string]bool{
+		"https://idp.example/jwks/keys.json":           true,
+		"https://IDP.example/jwks/keys.json":           true,
+		"https://idp.example/jwks/../admin":            false,
+		"https://idp.example/jwks/%2e%2e/admin":        false,
+		"https://idp.example/jwks/%2E%2E%2Fadmin":      false,
+		"https://idp.example/jwks/..%5Cadmin":          false,
+		"https://idp.example/jwks/./keys.json":         false,
+		"https://idp.example/admin":                    false,
+		"https://idp.example.evil/jwks/keys.json":      false,
+		"https://idp.example:8443/jwks/keys.json":      false,
+		"http://idp.example/jwks/keys.json":            false,
+		"https://other.example/keys?tenant=a":          true,
+		"https://other.example/keys/../admin?tenant=a": false,
+		"https://other.example/keys/more?tenant=a":     false,
+		"https://other.example/keys?other=a&tenant=a":  false,
+		"https://idp.example/jwks/keys.json..":         true,
+		"https://idp.example/jwks/...":                 true,
+	}
+	for raw, allowed := range tc {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatalf("Failed to parse %q.\nError: %s", raw, err)
+		}
+		err = fetcher.checkURL(u)
+		if (err == nil) != allowed {
+			t.Fatalf("Unexpected result for %q. Allowed: %t. Error: %v.", raw, allowed, err)
+		}
+	}
+
+	_, err = NewSafeFetcher(SafeFetcherOptions{AllowedURLPrefixes: []string{"/jwks/"}})
+	if !errors.Is(err, ErrOptions) {
+		t.Fatalf("Expected an options error for a prefix without a host, but got %v.", err)
+	}
+}
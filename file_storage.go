@@ -0,0 +1,419 @@
+package jwkset
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrFileStorage indicates that a file-backed Storage could not read or write its files.
+	ErrFileStorage = errors.New("failed to use file storage")
+)
+
+// FileStorageOptions are used to configure the behavior of NewStorageFromFile and NewStorageFromDirectory.
+type FileStorageOptions struct {
+	// Ctx is used to end the reload goroutine when it's no longer needed.
+	//
+	// This defaults to context.Background().
+	Ctx context.Context
+
+	// FileMode is the permission of files created by KeyWrite. Existing files keep their permission.
+	//
+	// This defaults to 0600.
+	FileMode fs.FileMode
+
+	// ReloadErrorHandler is a function that consumes errors that happen when reloading changed files. The Storage keeps
+	// the keys it had before the failed reload.
+	ReloadErrorHandler func(ctx context.Context, err error)
+
+	// ReloadInterval is the interval at which the files are checked for changes made outside the Storage, such as a
+	// Kubernetes Secret volume swapping its symlinks. Changes are detected by content, so a swapped symlink is noticed
+	// even if the modification time is preserved. An empty JWK Set file is only applied if it's still empty at the next
+	// reload, because writers that don't replace the file atomically truncate it first. To remove all keys at once
+	// without the delay, write a JWK Set without keys, such as {"keys":[]}. A negative value disables reloading.
+	//
+	// This defaults to 10 seconds.
+	ReloadInterval time.Duration
+}
+
+// fileStorage is a Storage backed by a JWK Set file or a directory of key files. Keys are read from memory and written
+// through to the files.
+type fileStorage struct {
+	options FileStorageOptions
+	dir     bool
+	name    string
+
+	mux      sync.Mutex // Held during reloads and writes.
+	contents map[string][]byte
+	empty    bool              // Whether the last reload found an empty JWK Set file and ignored it.
+	keyFiles map[string]string // Key ID to file path, only for directories.
+	fileKeys map[string]int    // File path to number of keys, only for directories.
+
+	Storage
+}
+
+// NewStorageFromFile creates a new Storage backed by the JSON JWK Set file with the given name. If the file does not
+// exist, the Storage starts empty and KeyWrite creates the file. KeyWrite and KeyDelete rewrite the whole file
+// atomically, through a temporary file that is synced and renamed. If the name is a symlink, the file it points to is
+// rewritten.
+func NewStorageFromFile(name string, options FileStorageOptions) (Storage, error) {
+	return newFileStorage(name, false, options)
+}
+
+// NewStorageFromDirectory creates a new Storage backed by the key files in the given directory. Files ending in .json
+// contain a JWK Set or a single JWK, and files ending in .pem, .crt, or .cer contain X.509 certificates, decoded with
+// DecodePEM. Other files and files whose names start with "." are ignored, which includes the internal files of
+// Kubernetes volumes.
+//
+// KeyWrite writes each key to its own file named after its key ID, atomically, through a temporary file that is synced
+// and renamed. The key ID is escaped with url.PathEscape, and a leading "." is escaped as "%2E". KeyWrite and KeyDelete
+// fail with ErrFileStorage for keys that are in a file with other keys or that is not a JSON file. KeyWrite also fails
+// for a new key whose file already holds other keys or wasn't loaded yet, so keys are never overwritten on disk.
+func NewStorageFromDirectory(dir string, options FileStorageOptions) (Storage, error) {
+	return newFileStorage(dir, true, options)
+}
+
+func newFileStorage(name string, dir bool, options FileStorageOptions) (Storage, error) {
+	if options.Ctx == nil {
+		options.Ctx = context.Background()
+	}
+	if options.FileMode == 0 {
+		options.FileMode = 0600
+	}
+	if options.ReloadInterval == 0 {
+		options.ReloadInterval = 10 * time.Second
+	}
+	s := &fileStorage{
+		options:  options,
+		dir:      dir,
+		name:     name,
+		contents: make(map[string][]byte),
+		keyFiles: make(map[string]string),
+		fileKeys: make(map[string]int),
+		Storage:  NewMemoryStorage(),
+	}
+	err := s.reload(options.Ctx, !dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.ReloadInterval > 0 {
+		go func() { // Reload goroutine.
+			ticker := time.NewTicker(options.ReloadInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-options.Ctx.Done():
+					return
+				case <-ticker.C:
+					err := s.reload(options.Ctx, false)
+					if err != nil && options.ReloadErrorHandler != nil {
+						options.ReloadErrorHandler(options.Ctx, err)
+					}
+				}
+			}
+		}()
+	}
+
+	return s, nil
+}
+
+// reload reads the files and, if their contents changed, replaces the keys in memory.
+func (s *fileStorage) reload(ctx context.Context, allowMissing bool) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	contents, err := s.readFiles()
+	if errors.Is(err, fs.ErrNotExist) && allowMissing {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if maps.EqualFunc(contents, s.contents, bytes.Equal) {
+		return nil
+	}
+	empty := !s.dir && len(bytes.TrimSpace(contents[s.name])) == 0
+	if empty && !allowMissing && !s.empty {
+		s.empty = true
+		return nil // Likely truncated by a writer that doesn't replace the file atomically. Wait for the content.
+	}
+	s.empty = false
+
+	var keys []JWK
+	keyFiles := make(map[string]string)
+	fileKeys := make(map[string]int)
+	names := make([]string, 0, len(contents))
+	for name := range contents {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		decoded, err := s.decode(name, contents[name])
+		if err != nil {
+			return fmt.Errorf("failed to decode keys from file %q: %w", name, errors.Join(err, ErrFileStorage))
+		}
+		for _, jwk := range decoded {
+			kid := jwk.Marshal().KID
+			if other, ok := keyFiles[kid]; ok {
+				return fmt.Errorf("%w: key ID %q is in files %q and %q", ErrFileStorage, kid, other, name)
+			}
+			keyFiles[kid] = name
+		}
+		fileKeys[name] = len(decoded)
+		keys = append(keys, decoded...)
+	}
+	err = s.Storage.(BatchStorage).ReplaceAll(ctx, keys)
+	if err != nil {
+		return fmt.Errorf("failed to replace keys in memory: %w", err)
+	}
+	s.contents = contents
+	if s.dir {
+		s.keyFiles = keyFiles
+		s.fileKeys = fileKeys
+	}
+	return nil
+}
+
+// readFiles reads the contents of the JWK Set file or the key files in the directory.
+func (s *fileStorage) readFiles() (map[string][]byte, error) {
+	contents := make(map[string][]byte)
+	if !s.dir {
+		data, err := os.ReadFile(s.name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWK Set file: %w", errors.Join(err, ErrFileStorage))
+		}
+		contents[s.name] = data
+		return contents, nil
+	}
+	entries, err := os.ReadDir(s.name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key directory: %w", errors.Join(err, ErrFileStorage))
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || !isKeyFile(entry.Name()) {
+			continue
+		}
+		name := filepath.Join(s.name, entry.Name())
+		info, err := os.Stat(name) // Follows symlinks.
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat key file: %w", errors.Join(err, ErrFileStorage))
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", errors.Join(err, ErrFileStorage))
+		}
+		contents[name] = data
+	}
+	return contents, nil
+}
+
+func (s *fileStorage) decode(name string, data []byte) ([]JWK, error) {
+	if !s.dir {
+		if len(bytes.TrimSpace(data)) == 0 {
+			return nil, nil
+		}
+		return DecodeJWKSet(data)
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		var probe struct {
+			Keys json.RawMessage `json:"keys"`
+		}
+		err := json.Unmarshal(data, &probe)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode JSON: %w", err)
+		}
+		if probe.Keys != nil {
+			return DecodeJWKSet(data)
+		}
+		return DecodeJWK(data)
+	default:
+		return DecodePEM(data)
+	}
+}
+
+func (s *fileStorage) KeyDelete(ctx context.Context, keyID string) (ok bool, err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	_, err = s.Storage.KeyRead(ctx, keyID)
+	if errors.Is(err, ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if s.dir {
+		name := s.keyFiles[keyID]
+		err = s.checkWritable(name)
+		if err != nil {
+			return false, err
+		}
+		err = os.Remove(name)
+		if err != nil {
+			return false, fmt.Errorf("failed to remove key file: %w", errors.Join(err, ErrFileStorage))
+		}
+		delete(s.contents, name)
+		delete(s.fileKeys, name)
+		delete(s.keyFiles, keyID)
+		return s.Storage.KeyDelete(ctx, keyID)
+	}
+
+	keys, err := s.Storage.KeyReadAll(ctx)
+	if err != nil {
+		return false, err
+	}
+	keys = withoutKeyID(keys, keyID)
+	err = s.writeSet(ctx, keys)
+	if err != nil {
+		return false, err
+	}
+	return s.Storage.KeyDelete(ctx, keyID)
+}
+func (s *fileStorage) KeyWrite(ctx context.Context, jwk JWK) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	keyID := jwk.Marshal().KID
+
+	if s.dir {
+		if keyID == "" {
+			return fmt.Errorf("%w: a key ID is required to write a key to a directory", ErrFileStorage)
+		}
+		name, ok := s.keyFiles[keyID]
+		if ok {
+			err := s.checkWritable(name)
+			if err != nil {
+				return err
+			}
+		} else {
+			name = filepath.Join(s.name, keyFileName(keyID))
+			if s.fileKeys[name] > 0 {
+				return fmt.Errorf("%w: file %q has other keys", ErrFileStorage, name)
+			}
+			if _, ok := s.contents[name]; !ok {
+				if _, err := os.Stat(name); err == nil {
+					return fmt.Errorf("%w: file %q exists, but was not loaded yet", ErrFileStorage, name)
+				}
+			}
+		}
+		options := jwk.options
+		options.Marshal = JWKMarshalOptions{
+			Private: true,
+		}
+		marshal, err := keyMarshal(jwk.Key(), options)
+		if err != nil {
+			return fmt.Errorf("failed to marshal key: %w", err)
+		}
+		data, err := json.Marshal(marshal)
+		if err != nil {
+			return fmt.Errorf("failed to marshal key: %w", err)
+		}
+		err = writeFileAtomic(name, data, s.fileMode(name))
+		if err != nil {
+			return fmt.Errorf("failed to write key file: %w", errors.Join(err, ErrFileStorage))
+		}
+		s.contents[name] = data
+		s.fileKeys[name] = 1
+		s.keyFiles[keyID] = name
+		return s.Storage.KeyWrite(ctx, jwk)
+	}
+
+	keys, err := s.Storage.KeyReadAll(ctx)
+	if err != nil {
+		return err
+	}
+	keys = append(withoutKeyID(keys, keyID), jwk)
+	err = s.writeSet(ctx, keys)
+	if err != nil {
+		return err
+	}
+	return s.Storage.KeyWrite(ctx, jwk)
+}
+
+// checkWritable returns an error if the key file can't be rewritten or removed for a single key. The caller must hold
+// s.mux.
+func (s *fileStorage) checkWritable(name string) error {
+	if s.fileKeys[name] != 1 {
+		return fmt.Errorf("%w: file %q has other keys", ErrFileStorage, name)
+	}
+	if strings.ToLower(filepath.Ext(name)) != ".json" {
+		return fmt.Errorf("%w: file %q is not a JSON file", ErrFileStorage, name)
+	}
+	return nil
+}
+
+// writeSet atomically writes the keys to the JWK Set file. The caller must hold s.mux.
+func (s *fileStorage) writeSet(ctx context.Context, keys []JWK) error {
+	set := NewMemoryStorage()
+	err := set.(BatchStorage).ReplaceAll(ctx, keys)
+	if err != nil {
+		return err
+	}
+	data, err := set.JSONPrivate(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JWK Set: %w", err)
+	}
+	name := s.name
+	if target, err := filepath.EvalSymlinks(name); err == nil {
+		name = target
+	}
+	err = writeFileAtomic(name, data, s.fileMode(name))
+	if err != nil {
+		return fmt.Errorf("failed to write JWK Set file: %w", errors.Join(err, ErrFileStorage))
+	}
+	s.contents[s.name] = data
+	return nil
+}
+
+// fileMode returns the permission of the existing file, or the FileMode option for a new file.
+func (s *fileStorage) fileMode(name string) fs.FileMode {
+	info, err := os.Stat(name)
+	if err != nil {
+		return s.options.FileMode
+	}
+	return info.Mode().Perm()
+}
+
+func isKeyFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".cer", ".crt", ".json", ".pem":
+		return true
+	}
+	return false
+}
+
+func withoutKeyID(keys []JWK, keyID string) []JWK {
+	kept := make([]JWK, 0, len(keys))
+	for _, jwk := range keys {
+		if jwk.Marshal().KID != keyID {
+			kept = append(kept, jwk)
+		}
+	}
+	return kept
+}
+
+// keyFileName returns the name of the file a directory Storage writes the key with the key ID to. A leading "." is
+// escaped, so the file is not ignored as hidden.
+func keyFileName(keyID string) string {
+	name := url.PathEscape(keyID)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return name + ".json"
+}
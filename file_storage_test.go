@@ -0,0 +1,321 @@
+package jwkset
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorageFromFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "jwks.json")
+	store, err := NewStorageFromFile(name, FileStorageOptions{Ctx: ctx, ReloadInterval: -1})
+	if err != nil {
+		t.Fatalf("Failed to create the file storage.\nError: %s", err)
+	}
+	err = store.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK.\nError: %s", err)
+	}
+	err = store.KeyWrite(ctx, newStorageTestJWK(t, hmacKey2, kidWritten2))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK.\nError: %s", err)
+	}
+	ok, err := store.KeyDelete(ctx, kidWritten)
+	if err != nil || !ok {
+		t.Fatalf("Failed to delete the JWK.\nError: %s", err)
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatalf("Failed to stat the JWK Set file.\nError: %s", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected file mode 0600, but got %s.", info.Mode().Perm())
+	}
+
+	reopened, err := NewStorageFromFile(name, FileStorageOptions{Ctx: ctx, ReloadInterval: -1})
+	if err != nil {
+		t.Fatalf("Failed to reopen the file storage.\nError: %s", err)
+	}
+	keys, err := reopened.KeyReadAll(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read the JWKs.\nError: %s", err)
+	}
+	if len(keys) != 1 || keys[0].Marshal().KID != kidWritten2 {
+		t.Fatalf("Expected only the written JWK to be in the file, but got %d keys.", len(keys))
+	}
+}
+
+func TestStorageFromFileReload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Imitate a Kubernetes Secret volume, which swaps a symlink to a new directory on update.
+	dir := t.TempDir()
+	writeVersion := func(version string, key []byte, kid string) {
+		store := NewMemoryStorage()
+		err := store.KeyWrite(ctx, newStorageTestJWK(t, key, kid))
+		if err != nil {
+			t.Fatalf("Failed to write the JWK.\nError: %s", err)
+		}
+		raw, err := store.JSONPrivate(ctx)
+		if err != nil {
+			t.Fatalf("Failed to get the JSON.\nError: %s", err)
+		}
+		err = os.Mkdir(filepath.Join(dir, version), 0700)
+		if err != nil {
+			t.Fatalf("Failed to create the version directory.\nError: %s", err)
+		}
+		err = os.WriteFile(filepath.Join(dir, version, "jwks.json"), raw, 0600)
+		if err != nil {
+			t.Fatalf("Failed to write the JWK Set file.\nError: %s", err)
+		}
+		err = os.Symlink(version, filepath.Join(dir, "..data_tmp"))
+		if err != nil {
+			t.Fatalf("Failed to create the symlink.\nError: %s", err)
+		}
+		err = os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data"))
+		if err != nil {
+			t.Fatalf("Failed to swap the symlink.\nError: %s", err)
+		}
+	}
+	writeVersion("v1", hmacKey1, kidWritten)
+	name := filepath.Join(dir, "jwks.json")
+	err := os.Symlink(filepath.Join("..data", "jwks.json"), name)
+	if err != nil {
+		t.Fatalf("Failed to create the symlink.\nError: %s", err)
+	}
+
+	reloadErrs := make(chan error, 10)
+	options := FileStorageOptions{
+		Ctx: ctx,
+		ReloadErrorHandler: func(_ context.Context, err error) {
+			select {
+			case reloadErrs <- err:
+			default:
+			}
+		},
+		ReloadInterval: 10 * time.Millisecond,
+	}
+	store, err := NewStorageFromFile(name, options)
+	if err != nil {
+		t.Fatalf("Failed to create the file storage.\nError: %s", err)
+	}
+	_, err = store.KeyRead(ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Failed to read the JWK.\nError: %s", err)
+	}
+
+	writeVersion("v2", hmacKey2, kidWritten2)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err = store.KeyRead(ctx, kidWritten2)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the swapped JWK Set to be reloaded.\nError: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = store.KeyRead(ctx, kidWritten)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Expected the old JWK to be removed, but got %s.", err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "v2", "jwks.json"), []byte("{"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write the JWK Set file.\nError: %s", err)
+	}
+	select {
+	case err = <-reloadErrs:
+		if !errors.Is(err, ErrFileStorage) {
+			t.Fatalf("Expected a file storage error, but got %s.", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the reload error to be handled.")
+	}
+	_, err = store.KeyRead(ctx, kidWritten2)
+	if err != nil {
+		t.Fatalf("Expected the JWK to be kept after a failed reload.\nError: %s", err)
+	}
+}
+
+func TestStorageFromFileEmpty(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	name := filepath.Join(t.TempDir(), "jwks.json")
+	store, err := NewStorageFromFile(name, FileStorageOptions{Ctx: ctx, ReloadInterval: -1})
+	if err != nil {
+		t.Fatalf("Failed to create the file storage.\nError: %s", err)
+	}
+	s := store.(*fileStorage)
+	write := func(data string) {
+		err := store.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+		if err != nil {
+			t.Fatalf("Failed to write the JWK.\nError: %s", err)
+		}
+		err = os.WriteFile(name, []byte(data), 0600)
+		if err != nil {
+			t.Fatalf("Failed to write the JWK Set file.\nError: %s", err)
+		}
+	}
+	reload := func() int {
+		err := s.reload(ctx, false)
+		if err != nil {
+			t.Fatalf("Failed to reload.\nError: %s", err)
+		}
+		keys, err := store.KeyReadAll(ctx)
+		if err != nil {
+			t.Fatalf("Failed to read the JWKs.\nError: %s", err)
+		}
+		return len(keys)
+	}
+
+	write("")
+	if count := reload(); count != 1 {
+		t.Fatalf("Expected a newly empty file to be ignored once, but got %d keys.", count)
+	}
+	if count := reload(); count != 0 {
+		t.Fatalf("Expected a file that stays empty to remove all keys, but got %d keys.", count)
+	}
+
+	write(`{"keys":[]}`)
+	if count := reload(); count != 0 {
+		t.Fatalf("Expected a JWK Set without keys to remove all keys at once, but got %d keys.", count)
+	}
+}
+
+func TestStorageFromDirectory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "bundle.pem"), []byte(ec521Cert+"\n"+ed25519Cert), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write the PEM file.\nError: %s", err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "README.txt"), []byte("Ignored."), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write the ignored file.\nError: %s", err)
+	}
+	store, err := NewStorageFromDirectory(dir, FileStorageOptions{Ctx: ctx, ReloadInterval: -1})
+	if err != nil {
+		t.Fatalf("Failed to create the directory storage.\nError: %s", err)
+	}
+	keys, err := store.KeyReadAll(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read the JWKs.\nError: %s", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 keys from the PEM file, but got %d.", len(keys))
+	}
+	_, err = store.KeyDelete(ctx, keys[0].Marshal().KID)
+	if !errors.Is(err, ErrFileStorage) {
+		t.Fatalf("Expected an error deleting a key from a shared file, but got %s.", err)
+	}
+
+	err = store.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK.\nError: %s", err)
+	}
+	name := filepath.Join(dir, url.PathEscape(kidWritten)+".json")
+	_, err = os.Stat(name)
+	if err != nil {
+		t.Fatalf("Expected the JWK to be written to its own file.\nError: %s", err)
+	}
+	reopened, err := NewStorageFromDirectory(dir, FileStorageOptions{Ctx: ctx, ReloadInterval: -1})
+	if err != nil {
+		t.Fatalf("Failed to reopen the directory storage.\nError: %s", err)
+	}
+	_, err = reopened.KeyRead(ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Failed to read the written JWK.\nError: %s", err)
+	}
+
+	ok, err := store.KeyDelete(ctx, kidWritten)
+	if err != nil || !ok {
+		t.Fatalf("Failed to delete the JWK.\nError: %s", err)
+	}
+	_, err = os.Stat(name)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected the JWK file to be removed, but got %s.", err)
+	}
+
+	const hiddenKID = ".hidden"
+	err = store.KeyWrite(ctx, newStorageTestJWK(t, hmacKey2, hiddenKID))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK.\nError: %s", err)
+	}
+	err = store.(*fileStorage).reload(ctx, false)
+	if err != nil {
+		t.Fatalf("Failed to reload.\nError: %s", err)
+	}
+	_, err = store.KeyRead(ctx, hiddenKID)
+	if err != nil {
+		t.Fatalf("Expected a JWK whose key ID starts with a dot to survive a reload.\nError: %s", err)
+	}
+}
+
+func TestStorageFromDirectoryOccupiedFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	set := NewMemoryStorage()
+	for kid, key := range map[string][]byte{"x": hmacKey1, "y": hmacKey2} {
+		err := set.KeyWrite(ctx, newStorageTestJWK(t, key, kid))
+		if err != nil {
+			t.Fatalf("Failed to write the JWK.\nError: %s", err)
+		}
+	}
+	data, err := set.JSONPrivate(ctx)
+	if err != nil {
+		t.Fatalf("Failed to marshal the JWK Set.\nError: %s", err)
+	}
+	dir := t.TempDir()
+	err = os.WriteFile(filepath.Join(dir, "foo.json"), data, 0600)
+	if err != nil {
+		t.Fatalf("Failed to write the JWK Set file.\nError: %s", err)
+	}
+	store, err := NewStorageFromDirectory(dir, FileStorageOptions{Ctx: ctx, ReloadInterval: -1})
+	if err != nil {
+		t.Fatalf("Failed to create the directory storage.\nError: %s", err)
+	}
+
+	err = store.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, "foo"))
+	if !errors.Is(err, ErrFileStorage) {
+		t.Fatalf("Expected an error writing a key to a file with other keys, but got %v.", err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "bar.json"), data, 0600)
+	if err != nil {
+		t.Fatalf("Failed to write the JWK Set file.\nError: %s", err)
+	}
+	err = store.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, "bar"))
+	if !errors.Is(err, ErrFileStorage) {
+		t.Fatalf("Expected an error writing a key to a file that was not loaded yet, but got %v.", err)
+	}
+
+	err = os.Remove(filepath.Join(dir, "bar.json"))
+	if err != nil {
+		t.Fatalf("Failed to remove the JWK Set file.\nError: %s", err)
+	}
+	reopened, err := NewStorageFromDirectory(dir, FileStorageOptions{Ctx: ctx, ReloadInterval: -1})
+	if err != nil {
+		t.Fatalf("Failed to reopen the directory storage.\nError: %s", err)
+	}
+	keys, err := reopened.KeyReadAll(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read the JWKs.\nError: %s", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("Expected the keys of the occupied file to be kept, but got %d keys.", len(keys))
+	}
+}
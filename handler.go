@@ -0,0 +1,285 @@
+package jwkset
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// handlerCacheSize is the number of serialized JWK Sets a handler keeps, keyed by ETag. A multi-tenant handler needs one
+// per tenant to avoid serializing on every request.
+const handlerCacheSize = 64
+
+// HandlerOptions are used to configure the behavior of NewHandler and NewTenantHandler.
+type HandlerOptions struct {
+	// CacheControl is the value of the Cache-Control header sent with the JWK Set.
+	//
+	// This defaults to "public, max-age=300".
+	CacheControl string
+
+	// CORSOrigin is the value of the Access-Control-Allow-Origin header, such as "*". If empty, no CORS headers are sent
+	// and preflight requests are rejected.
+	CORSOrigin string
+
+	// ErrorHandler is a function that consumes errors that happen when serving the JWK Set. The client gets a 500 Internal
+	// Server Error response without details.
+	ErrorHandler func(ctx context.Context, err error)
+
+	// Gzip compresses the JWK Set for clients that accept gzip.
+	Gzip bool
+}
+
+// handlerResponse is a serialized JWK Set ready to be written.
+type handlerResponse struct {
+	body []byte
+	etag string
+	gzip []byte // Only if HandlerOptions.Gzip is true.
+}
+
+type handler struct {
+	options HandlerOptions
+	storage func(r *http.Request) (Storage, error)
+
+	mux   sync.Mutex
+	cache map[string]*handlerResponse // ETag of the Storage JSON to response.
+}
+
+// NewHandler creates an http.Handler that serves the public keys of the Storage as an application/jwk-set+json
+// document. It answers GET and HEAD requests, supports If-None-Match with the ETag of the JWK Set, and optionally
+// compresses the response and sends CORS headers.
+//
+// Private key members are never served. They are removed from asymmetric keys, and symmetric keys are left out, even if
+// the Storage includes them in its public JSON.
+//
+// If the Storage implements JSONSnapshotter, as the in-memory Storage does, the serialized JWK Set is reused until the
+// keys change. Otherwise, the keys are marshaled for every request.
+func NewHandler(storage Storage, options HandlerOptions) http.Handler {
+	return NewTenantHandler(func(*http.Request) (Storage, error) {
+		return storage, nil
+	}, options)
+}
+
+// NewTenantHandler creates an http.Handler like NewHandler that serves a different Storage for each request, such as
+// one per tenant selected by a path parameter. If the storage function returns a nil Storage without an error, the
+// handler responds with 404 Not Found.
+func NewTenantHandler(storage func(r *http.Request) (Storage, error), options HandlerOptions) http.Handler {
+	if options.CacheControl == "" {
+		options.CacheControl = "public, max-age=300"
+	}
+	return &handler{
+		options: options,
+		storage: storage,
+		cache:   make(map[string]*handlerResponse),
+	}
+}
+
+func (h *handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	header := writer.Header()
+	if h.options.CORSOrigin != "" {
+		header.Set("Access-Control-Allow-Origin", h.options.CORSOrigin)
+		header.Set("Access-Control-Expose-Headers", "ETag")
+	}
+	switch request.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions:
+		if h.options.CORSOrigin == "" {
+			h.methodNotAllowed(writer)
+			return
+		}
+		header.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+		header.Set("Access-Control-Allow-Headers", "If-None-Match")
+		header.Set("Access-Control-Max-Age", "86400")
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		h.methodNotAllowed(writer)
+		return
+	}
+
+	ctx := request.Context()
+	storage, err := h.storage(request)
+	if err != nil {
+		h.internalError(ctx, writer, fmt.Errorf("failed to get storage for request: %w", err))
+		return
+	}
+	if storage == nil {
+		http.NotFound(writer, request)
+		return
+	}
+	response, err := h.response(ctx, storage)
+	if err != nil {
+		h.internalError(ctx, writer, err)
+		return
+	}
+
+	body, etag := response.body, response.etag
+	if h.options.Gzip {
+		header.Add("Vary", "Accept-Encoding")
+		if acceptsGzip(request.Header.Get("Accept-Encoding")) {
+			body = response.gzip
+			etag = strings.TrimSuffix(etag, `"`) + `-gzip"`
+			header.Set("Content-Encoding", "gzip")
+		}
+	}
+	header.Set("Cache-Control", h.options.CacheControl)
+	header.Set("ETag", etag)
+	if etagMatches(request.Header.Get("If-None-Match"), etag) {
+		header.Del("Content-Encoding")
+		writer.WriteHeader(http.StatusNotModified)
+		return
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	header.Set("Content-Type", "application/jwk-set+json")
+	writer.WriteHeader(http.StatusOK)
+	if request.Method != http.MethodHead {
+		_, _ = writer.Write(body)
+	}
+}
+
+// response gets the serialized public JWK Set of the Storage, from the cache if its content is unchanged.
+func (h *handler) response(ctx context.Context, storage Storage) (*handlerResponse, error) {
+	var snapshot JSONSnapshot
+	if snapshotter, ok := storage.(JSONSnapshotter); ok {
+		var err error
+		snapshot, err = snapshotter.JSONSnapshot(ctx, JWKMarshalOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get JWK Set JSON snapshot: %w", err)
+		}
+	} else {
+		jwks, err := storage.MarshalWithOptions(ctx, JWKMarshalOptions{}, JWKValidateOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal JWK Set: %w", err)
+		}
+		raw, err := json.Marshal(publicJWKS(jwks))
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal JWK Set: %w", err)
+		}
+		snapshot = newJSONSnapshot(raw, 0)
+	}
+
+	h.mux.Lock()
+	response, ok := h.cache[snapshot.ETag]
+	h.mux.Unlock()
+	if ok {
+		return response, nil
+	}
+
+	// Don't trust the snapshot to be public. Decoding again only happens once per change to the keys.
+	var jwks JWKSMarshal
+	err := json.Unmarshal(snapshot.JSON, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal JWK Set JSON snapshot: %w", err)
+	}
+	body, err := json.Marshal(publicJWKS(jwks))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JWK Set: %w", err)
+	}
+	response = &handlerResponse{
+		body: body,
+		etag: snapshot.ETag,
+	}
+	if h.options.Gzip {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err = gz.Write(body)
+		if err == nil {
+			err = gz.Close()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to gzip JWK Set: %w", err)
+		}
+		response.gzip = buf.Bytes()
+	}
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if len(h.cache) >= handlerCacheSize {
+		clear(h.cache)
+	}
+	h.cache[snapshot.ETag] = response
+	return response, nil
+}
+
+func (h *handler) internalError(ctx context.Context, writer http.ResponseWriter, err error) {
+	if h.options.ErrorHandler != nil {
+		h.options.ErrorHandler(ctx, err)
+	}
+	http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+func (h *handler) methodNotAllowed(writer http.ResponseWriter) {
+	allow := "GET, HEAD"
+	if h.options.CORSOrigin != "" {
+		allow += ", OPTIONS"
+	}
+	writer.Header().Set("Allow", allow)
+	http.Error(writer, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+// publicJWKS removes the private members of asymmetric keys and leaves out symmetric keys.
+func publicJWKS(jwks JWKSMarshal) JWKSMarshal {
+	public := JWKSMarshal{
+		Keys: make([]JWKMarshal, 0, len(jwks.Keys)),
+	}
+	for _, key := range jwks.Keys {
+		if key.KTY == KtyOct || key.K != "" {
+			continue
+		}
+		public.Keys = append(public.Keys, publicJWK(key))
+	}
+	return public
+}
+
+// publicJWK removes the private members of a key. Only the metadata of a symmetric key remains.
+func publicJWK(key JWKMarshal) JWKMarshal {
+	key.D, key.P, key.Q, key.DP, key.DQ, key.QI, key.OTH, key.K = "", "", "", "", "", "", nil, ""
+	return key
+}
+
+// acceptsGzip reports whether an Accept-Encoding header value allows gzip.
+func acceptsGzip(acceptEncoding string) bool {
+	gzipQ, wildcardQ := -1.0, -1.0
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(key) == "q" {
+				parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err == nil {
+					q = parsed
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			wildcardQ = q
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return wildcardQ > 0
+}
+
+// etagMatches reports whether an If-None-Match header value matches the ETag, using the weak comparison of RFC 9110.
+func etagMatches(ifNoneMatch, etag string) bool {
+	ifNoneMatch = strings.TrimSpace(ifNoneMatch)
+	if ifNoneMatch == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+package jwkset
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStorage()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate the Ed25519 key.\nError: %s", err)
+	}
+	err = store.KeyWrite(ctx, newStorageTestJWK(t, private, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK.\nError: %s", err)
+	}
+	err = store.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten2))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK.\nError: %s", err)
+	}
+	handler := NewHandler(store, HandlerOptions{CORSOrigin: "*", Gzip: true})
+
+	resp := serveHandler(handler, http.MethodGet, nil)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d.", http.StatusOK, resp.Code)
+	}
+	if resp.Header().Get("Content-Type") != "application/jwk-set+json" {
+		t.Fatalf("Unexpected Content-Type %q.", resp.Header().Get("Content-Type"))
+	}
+	if resp.Header().Get("Cache-Control") != "public, max-age=300" {
+		t.Fatalf("Unexpected Cache-Control %q.", resp.Header().Get("Cache-Control"))
+	}
+	if resp.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("Expected the CORS header to be sent.")
+	}
+	body := resp.Body.Bytes()
+	assertPublicJWKS(t, body, kidWritten)
+	etag := resp.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("Expected an ETag.")
+	}
+
+	resp = serveHandler(handler, http.MethodGet, http.Header{"If-None-Match": {"\"other\", " + etag}})
+	if resp.Code != http.StatusNotModified {
+		t.Fatalf("Expected status %d, but got %d.", http.StatusNotModified, resp.Code)
+	}
+	if resp.Body.Len() != 0 {
+		t.Fatalf("Expected no body for a 304 response.")
+	}
+
+	resp = serveHandler(handler, http.MethodHead, nil)
+	if resp.Code != http.StatusOK || resp.Body.Len() != 0 {
+		t.Fatalf("Expected a 200 response without a body for HEAD, but got %d with %d bytes.", resp.Code, resp.Body.Len())
+	}
+
+	resp = serveHandler(handler, http.MethodGet, http.Header{"Accept-Encoding": {"br;q=1.0, gzip;q=0.8"}})
+	if resp.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected a gzip response.")
+	}
+	if resp.Header().Get("ETag") == etag {
+		t.Fatalf("Expected the gzip response to have its own ETag.")
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read the gzip response.\nError: %s", err)
+	}
+	decompressed, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("Failed to decompress the response.\nError: %s", err)
+	}
+	if !bytes.Equal(decompressed, body) {
+		t.Fatalf("Expected the decompressed response to match the uncompressed response.")
+	}
+	resp = serveHandler(handler, http.MethodGet, http.Header{"Accept-Encoding": {"gzip;q=0, *"}})
+	if resp.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("Expected no gzip response when gzip has a q-value of 0.")
+	}
+
+	resp = serveHandler(handler, http.MethodOptions, nil)
+	if resp.Code != http.StatusNoContent || resp.Header().Get("Access-Control-Allow-Methods") == "" {
+		t.Fatalf("Expected a CORS preflight response, but got %d.", resp.Code)
+	}
+	resp = serveHandler(handler, http.MethodPost, nil)
+	if resp.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status %d, but got %d.", http.StatusMethodNotAllowed, resp.Code)
+	}
+
+	_, err = store.KeyDelete(ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Failed to delete the JWK.\nError: %s", err)
+	}
+	resp = serveHandler(handler, http.MethodGet, http.Header{"If-None-Match": {etag}})
+	if resp.Code != http.StatusOK || resp.Header().Get("ETag") == etag {
+		t.Fatalf("Expected a new JWK Set after a delete, but got %d.", resp.Code)
+	}
+	assertPublicJWKS(t, resp.Body.Bytes())
+}
+
+func TestHandlerPrivateStorage(t *testing.T) {
+	ctx := context.Background()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate the Ed25519 key.\nError: %s", err)
+	}
+	store := privateStorage{NewMemoryStorage()}
+	err = store.KeyWrite(ctx, newStorageTestJWK(t, private, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK.\nError: %s", err)
+	}
+	err = store.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten2))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK.\nError: %s", err)
+	}
+
+	resp := serveHandler(NewHandler(store, HandlerOptions{}), http.MethodGet, nil)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d.", http.StatusOK, resp.Code)
+	}
+	assertPublicJWKS(t, resp.Body.Bytes(), kidWritten)
+}
+
+func TestTenantHandler(t *testing.T) {
+	ctx := context.Background()
+	tenants := map[string]Storage{
+		"a": NewMemoryStorage(),
+		"b": NewMemoryStorage(),
+	}
+	for tenant, store := range tenants {
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("Failed to generate the Ed25519 key.\nError: %s", err)
+		}
+		err = store.KeyWrite(ctx, newStorageTestJWK(t, private, tenant))
+		if err != nil {
+			t.Fatalf("Failed to write the JWK.\nError: %s", err)
+		}
+	}
+	handler := NewTenantHandler(func(r *http.Request) (Storage, error) {
+		tenant := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), "/jwks.json")
+		return tenants[tenant], nil
+	}, HandlerOptions{})
+
+	for tenant := range tenants {
+		req := httptest.NewRequest(http.MethodGet, "/"+tenant+"/jwks.json", nil)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, but got %d.", http.StatusOK, resp.Code)
+		}
+		assertPublicJWKS(t, resp.Body.Bytes(), tenant)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/missing/jwks.json", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotFound {
+		t.Fatalf("Expected status %d, but got %d.", http.StatusNotFound, resp.Code)
+	}
+}
+
+// privateStorage is a Storage that does not implement JSONSnapshotter and wrongly includes private key material in its
+// public JWK Set.
+type privateStorage struct {
+	Storage
+}
+
+func (p privateStorage) MarshalWithOptions(ctx context.Context, _ JWKMarshalOptions, validationOptions JWKValidateOptions) (JWKSMarshal, error) {
+	return p.Storage.MarshalWithOptions(ctx, JWKMarshalOptions{Private: true}, validationOptions)
+}
+
+func serveHandler(handler http.Handler, method string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/jwks.json", nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	return resp
+}
+
+func assertPublicJWKS(t *testing.T, body []byte, kids ...string) {
+	var jwks JWKSMarshal
+	err := json.Unmarshal(body, &jwks)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal the JWK Set.\nError: %s", err)
+	}
+	if len(jwks.Keys) != len(kids) {
+		t.Fatalf("Expected %d keys, but got %d.", len(kids), len(jwks.Keys))
+	}
+	for i, key := range jwks.Keys {
+		if key.KID != kids[i] {
+			t.Fatalf("Expected key ID %q, but got %q.", kids[i], key.KID)
+		}
+		if key.D != "" || key.K != "" {
+			t.Fatalf("Expected no private key material in the JWK Set.")
+		}
+	}
+}
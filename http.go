@@ -7,56 +7,164 @@ import (
 	"fmt"
 	"log/slog"
 	"net/url"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/time/rate"
 )
 
 var (
+	// ErrKIDConflict indicates that more than one source of a JWK Set client has a key with the requested key ID.
+	ErrKIDConflict = errors.New("key ID found in more than one source")
 	// ErrNewClient fails to create a new JWK Set client.
 	ErrNewClient = errors.New("failed to create new JWK Set client")
 )
 
+// KIDConflictPolicy determines how a JWK Set client handles a key ID that is found in more than one of its sources.
+type KIDConflictPolicy int
+
+const (
+	// KIDConflictFirstWins returns the key from the source with the highest priority. This is the default.
+	KIDConflictFirstWins KIDConflictPolicy = iota
+	// KIDConflictError returns ErrKIDConflict if a key ID is found in more than one source.
+	KIDConflictError
+	// KIDConflictNamespace returns ErrKIDConflict if a key ID is found in more than one source, unless the key ID is
+	// namespaced with NamespacedKeyID, in which case only the named source is used.
+	KIDConflictNamespace
+)
+
+// HTTPSource is a source of keys for a JWK Set client.
+type HTTPSource struct {
+	// Issuer is the issuer whose keys are in the source. Reads with a context from ContextWithIssuer only use the
+	// sources with a matching issuer.
+	Issuer string
+	// Name identifies the source in namespaced key IDs and errors.
+	//
+	// This defaults to the URL, or the issuer if there is no URL.
+	Name string
+	// Storage is the storage implementation for the keys of the source.
+	//
+	// If nil, a Storage is created with NewStorageFromHTTP using the URL and default options.
+	Storage Storage
+	// URL is the HTTP URL of the JWK Set endpoint of the source.
+	URL string
+}
+
+// NamespacedKeyID returns the key ID that reads the given key ID from only the named source of a JWK Set client with
+// the KIDConflictNamespace policy.
+func NamespacedKeyID(source, keyID string) string {
+	return source + "#" + keyID
+}
+
+type issuerContextKey struct{}
+
+// ContextWithIssuer returns a context that restricts reads of a JWK Set client to the sources for the given issuer,
+// such as the iss claim of the JWT being verified. Keys from the given storage of the client are not used.
+func ContextWithIssuer(ctx context.Context, issuer string) context.Context {
+	return context.WithValue(ctx, issuerContextKey{}, issuer)
+}
+
+func issuerFromContext(ctx context.Context) (string, bool) {
+	issuer, ok := ctx.Value(issuerContextKey{}).(string)
+	return issuer, ok
+}
+
 // HTTPClientOptions are options for creating a new JWK Set client.
 type HTTPClientOptions struct {
 	// Given contains keys known from outside HTTP URLs.
 	Given Storage
 	// HTTPURLs are a mapping of HTTP URLs to JWK Set endpoints to storage implementations for the keys located at the
-	// URL. If empty, HTTP will not be used.
+	// URL. They have a lower priority than Sources, and among themselves are ordered by URL. If both are empty, HTTP
+	// will not be used.
 	HTTPURLs map[string]Storage
+	// KIDConflictPolicy determines how a key ID that is found in more than one source is handled.
+	//
+	// This defaults to KIDConflictFirstWins.
+	KIDConflictPolicy KIDConflictPolicy
 	// PrioritizeHTTP is a flag that indicates whether keys from the HTTP URL should be prioritized over keys from the
 	// given storage.
 	PrioritizeHTTP bool
 	// RefreshUnknownKID is non-nil to indicate that remote HTTP resources should be refreshed if a key with an unknown
 	// key ID is trying to be read. This makes reading methods block until the context is over, a key with the matching
 	// key ID is found in a refreshed remote resource, or all refreshes complete.
+	//
+	// Concurrent reads of unknown key IDs share a single refresh, so only one of them waits for the rate limiter.
+	// Remote resources are refreshed in parallel.
 	RefreshUnknownKID *rate.Limiter
+	// Sources are the sources of keys in order of priority. Keys are read from earlier sources first.
+	Sources []HTTPSource
+	// UnknownKIDCacheDuration is the amount of time a key ID that was not found after refreshing remote resources is
+	// remembered. Reading a remembered key ID does not trigger another refresh, so that tokens with made up key IDs cannot
+	// keep forcing refreshes. This is only effectual if RefreshUnknownKID is set.
+	UnknownKIDCacheDuration time.Duration
+}
+
+// onDemandRefresher is implemented by Storage implementations backed by a remote HTTP resource. A refresh on demand
+// reports errors to the Storage's own error handler and returns them.
+type onDemandRefresher interface {
+	refreshOnDemand(ctx context.Context) error
 }
 
 // Client is a JWK Set client.
 type httpClient struct {
 	given             Storage
-	httpURLs          map[string]Storage
+	sources           []HTTPSource
+	kidConflictPolicy KIDConflictPolicy
 	prioritizeHTTP    bool
 	refreshUnknownKID *rate.Limiter
+	flight            *flightGroup
+	unknownKIDs       *unknownKIDCache
 }
 
 // NewHTTPClient creates a new JWK Set client from remote HTTP resources.
 func NewHTTPClient(options HTTPClientOptions) (Storage, error) {
-	if options.Given == nil && len(options.HTTPURLs) == 0 {
+	if options.Given == nil && len(options.HTTPURLs) == 0 && len(options.Sources) == 0 {
 		return nil, fmt.Errorf("%w: no given keys or HTTP URLs", ErrNewClient)
 	}
-	for u, store := range options.HTTPURLs {
+	sources := make([]HTTPSource, 0, len(options.Sources)+len(options.HTTPURLs))
+	for _, source := range options.Sources {
+		if source.Name == "" {
+			source.Name = source.URL
+		}
+		if source.Name == "" {
+			source.Name = source.Issuer
+		}
+		if source.Storage == nil {
+			parsed, err := url.ParseRequestURI(source.URL)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse source URL %q: %w", source.URL, errors.Join(err, ErrNewClient))
+			}
+			source.Storage, err = NewStorageFromHTTP(parsed, HTTPClientStorageOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("failed to create HTTP client storage for %q: %w", parsed.String(), errors.Join(err, ErrNewClient))
+			}
+		}
+		sources = append(sources, source)
+	}
+	urls := make([]string, 0, len(options.HTTPURLs))
+	for u := range options.HTTPURLs {
+		urls = append(urls, u)
+	}
+	slices.Sort(urls)
+	for _, u := range urls {
+		store := options.HTTPURLs[u]
 		if store == nil {
 			parsed, err := url.ParseRequestURI(u)
 			if err != nil {
 				return nil, fmt.Errorf("failed to parse given URL %q: %w", u, errors.Join(err, ErrNewClient))
 			}
-			options.HTTPURLs[u], err = NewStorageFromHTTP(nil, HTTPClientStorageOptions{})
+			store, err = NewStorageFromHTTP(parsed, HTTPClientStorageOptions{})
 			if err != nil {
 				return nil, fmt.Errorf("failed to create HTTP client storage for %q: %w", parsed.String(), errors.Join(err, ErrNewClient))
 			}
 		}
+		sources = append(sources, HTTPSource{
+			Name:    u,
+			Storage: store,
+			URL:     u,
+		})
 	}
 	given := options.Given
 	if given == nil {
@@ -64,9 +172,12 @@ func NewHTTPClient(options HTTPClientOptions) (Storage, error) {
 	}
 	c := httpClient{
 		given:             given,
-		httpURLs:          options.HTTPURLs,
+		sources:           sources,
+		kidConflictPolicy: options.KIDConflictPolicy,
 		prioritizeHTTP:    options.PrioritizeHTTP,
 		refreshUnknownKID: options.RefreshUnknownKID,
+		flight:            &flightGroup{timeout: unknownKIDRefreshTimeout},
+		unknownKIDs:       newUnknownKIDCache(options.UnknownKIDCacheDuration),
 	}
 	return c, nil
 }
@@ -77,6 +188,7 @@ func NewHTTPClient(options HTTPClientOptions) (Storage, error) {
 // 1. Refresh remote HTTP resources every hour.
 // 2. Prioritize keys from remote HTTP resources over keys from the given storage.
 // 3. Refresh remote HTTP resources if a key with an unknown key ID is trying to be read, with a rate limit of 5 minutes.
+// Key IDs that are still unknown after a refresh do not trigger another refresh for 5 minutes.
 // 4. Log to slog.Default() if a refresh fails.
 func NewDefaultHTTPClient(urls []string) (Storage, error) {
 	return NewDefaultHTTPClientCtx(context.Background(), urls)
@@ -85,8 +197,8 @@ func NewDefaultHTTPClient(urls []string) (Storage, error) {
 // NewDefaultHTTPClientCtx is the same as NewDefaultHTTPClient, but with a context that can end the refresh goroutine.
 func NewDefaultHTTPClientCtx(ctx context.Context, urls []string) (Storage, error) {
 	clientOptions := HTTPClientOptions{
-		HTTPURLs:          make(map[string]Storage),
-		RefreshUnknownKID: rate.NewLimiter(rate.Every(5*time.Minute), 1),
+		RefreshUnknownKID:       rate.NewLimiter(rate.Every(5*time.Minute), 1),
+		UnknownKIDCacheDuration: 5 * time.Minute,
 	}
 	for _, u := range urls {
 		parsed, err := url.ParseRequestURI(u)
@@ -110,7 +222,10 @@ func NewDefaultHTTPClientCtx(ctx context.Context, urls []string) (Storage, error
 		if err != nil {
 			return nil, fmt.Errorf("failed to create HTTP client storage for %q: %w", u, errors.Join(err, ErrNewClient))
 		}
-		clientOptions.HTTPURLs[u] = c
+		clientOptions.Sources = append(clientOptions.Sources, HTTPSource{
+			Storage: c,
+			URL:     u,
+		})
 	}
 	return NewHTTPClient(clientOptions)
 }
@@ -123,8 +238,8 @@ func (c httpClient) KeyDelete(ctx context.Context, keyID string) (ok bool, err e
 	if ok {
 		return true, nil
 	}
-	for _, store := range c.httpURLs {
-		ok, err = store.KeyDelete(ctx, keyID)
+	for _, source := range c.sources {
+		ok, err = source.Storage.KeyDelete(ctx, keyID)
 		if err != nil && !errors.Is(err, ErrKeyNotFound) {
 			return false, fmt.Errorf("failed to delete key with ID %q from HTTP storage due to error: %w", keyID, err)
 		}
@@ -135,7 +250,15 @@ func (c httpClient) KeyDelete(ctx context.Context, keyID string) (ok bool, err e
 	return false, nil
 }
 func (c httpClient) KeyRead(ctx context.Context, keyID string) (jwk JWK, err error) {
-	if !c.prioritizeHTTP {
+	sources := c.sources
+	issuer, restricted := issuerFromContext(ctx)
+	if restricted {
+		sources = c.sourcesForIssuer(issuer)
+		if len(sources) == 0 {
+			return JWK{}, fmt.Errorf("%w %q: no source for issuer %q", ErrKeyNotFound, keyID, issuer)
+		}
+	}
+	if !c.prioritizeHTTP && !restricted {
 		jwk, err = c.given.KeyRead(ctx, keyID)
 		switch {
 		case errors.Is(err, ErrKeyNotFound):
@@ -146,67 +269,145 @@ func (c httpClient) KeyRead(ctx context.Context, keyID string) (jwk JWK, err err
 			return jwk, nil
 		}
 	}
-	for _, store := range c.httpURLs {
-		jwk, err = store.KeyRead(ctx, keyID)
+	jwk, err = c.readSources(ctx, sources, keyID)
+	if !errors.Is(err, ErrKeyNotFound) {
+		return jwk, err
+	}
+	if c.prioritizeHTTP && !restricted {
+		jwk, err = c.given.KeyRead(ctx, keyID)
 		switch {
 		case errors.Is(err, ErrKeyNotFound):
-			continue
+			// Do nothing.
 		case err != nil:
-			return JWK{}, fmt.Errorf("failed to find JWT key with ID %q in HTTP storage due to error: %w", keyID, err)
+			return JWK{}, fmt.Errorf("failed to find JWT key with ID %q in given storage due to error: %w", keyID, err)
 		default:
 			return jwk, nil
 		}
 	}
-	if c.prioritizeHTTP {
-		jwk, err = c.given.KeyRead(ctx, keyID)
+	scope := "" // Separates refreshes and unknown key IDs of reads restricted to an issuer.
+	if restricted {
+		scope = "iss\n" + issuer + "\n"
+	}
+	if c.refreshUnknownKID != nil && !c.unknownKIDs.contains(scope+keyID) {
+		refreshErr := c.flight.do(ctx, scope, func(ctx context.Context) error {
+			return c.refreshHTTP(ctx, sources)
+		})
+		jwk, err = c.readSources(ctx, sources, keyID)
+		if !errors.Is(err, ErrKeyNotFound) {
+			return jwk, err
+		}
+		if refreshErr != nil {
+			// The key ID may be unknown only because a source is unavailable, so it's not cached.
+			return JWK{}, fmt.Errorf("%w %q: failed to refresh HTTP storage: %w", ErrKeyNotFound, keyID, refreshErr)
+		}
+		c.unknownKIDs.add(scope + keyID)
+	}
+	return JWK{}, fmt.Errorf("%w %q", ErrKeyNotFound, keyID)
+}
+
+// readSources reads the key with the given key ID from the sources in order, according to the KIDConflictPolicy.
+func (c httpClient) readSources(ctx context.Context, sources []HTTPSource, keyID string) (JWK, error) {
+	if c.kidConflictPolicy == KIDConflictNamespace {
+		for _, source := range sources {
+			kid, ok := strings.CutPrefix(keyID, NamespacedKeyID(source.Name, ""))
+			if ok {
+				sources = []HTTPSource{source}
+				keyID = kid
+				break
+			}
+		}
+	}
+	var found JWK
+	foundIn := ""
+	for _, source := range sources {
+		jwk, err := source.Storage.KeyRead(ctx, keyID)
 		switch {
 		case errors.Is(err, ErrKeyNotFound):
-			// Do nothing.
+			continue
 		case err != nil:
-			return JWK{}, fmt.Errorf("failed to find JWT key with ID %q in given storage due to error: %w", keyID, err)
-		default:
+			return JWK{}, fmt.Errorf("failed to find JWT key with ID %q in HTTP storage due to error: %w", keyID, err)
+		}
+		if c.kidConflictPolicy == KIDConflictFirstWins {
 			return jwk, nil
 		}
+		if foundIn != "" {
+			return JWK{}, fmt.Errorf("%w: key ID %q is in sources %q and %q", ErrKIDConflict, keyID, foundIn, source.Name)
+		}
+		found = jwk
+		foundIn = source.Name
 	}
-	if c.refreshUnknownKID != nil {
-		err = c.refreshUnknownKID.Wait(ctx)
-		if err != nil {
-			return JWK{}, fmt.Errorf("failed to wait for JWK Set refresh rate limiter due to error: %w", err)
+	if foundIn == "" {
+		return JWK{}, fmt.Errorf("%w %q", ErrKeyNotFound, keyID)
+	}
+	return found, nil
+}
+func (c httpClient) sourcesForIssuer(issuer string) []HTTPSource {
+	var sources []HTTPSource
+	for _, source := range c.sources {
+		if source.Issuer == issuer {
+			sources = append(sources, source)
 		}
-		for _, store := range c.httpURLs {
-			s, ok := store.(httpStorage)
-			if !ok {
-				continue
-			}
-			err = s.refresh(ctx)
+	}
+	return sources
+}
+func (c httpClient) refreshHTTP(ctx context.Context, sources []HTTPSource) error {
+	err := c.refreshUnknownKID.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to wait for JWK Set refresh rate limiter due to error: %w", err)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(sources))
+	for i, source := range sources {
+		r, ok := source.Storage.(onDemandRefresher)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			err := r.refreshOnDemand(ctx)
 			if err != nil {
-				if s.options.RefreshErrorHandler != nil {
-					s.options.RefreshErrorHandler(ctx, err)
-				}
-				continue
+				errs[i] = fmt.Errorf("failed to refresh %q: %w", name, err)
 			}
-			jwk, err = store.KeyRead(ctx, keyID)
-			switch {
-			case errors.Is(err, ErrKeyNotFound):
-				// Do nothing.
-			case err != nil:
-				return JWK{}, fmt.Errorf("failed to find JWT key with ID %q in HTTP storage due to error: %w", keyID, err)
-			default:
-				return jwk, nil
-			}
-		}
+		}(i, source.Name)
 	}
-	return JWK{}, fmt.Errorf("%w %q", ErrKeyNotFound, keyID)
+	wg.Wait()
+	return errors.Join(errs...)
 }
 func (c httpClient) KeyReadAll(ctx context.Context) ([]JWK, error) {
 	jwks, err := c.given.KeyReadAll(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to snapshot given keys due to error: %w", err)
 	}
-	for u, store := range c.httpURLs {
-		j, err := store.KeyReadAll(ctx)
+	for _, source := range c.sources {
+		j, err := source.Storage.KeyReadAll(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("failed to snapshot HTTP keys from %q due to error: %w", u, err)
+			return nil, fmt.Errorf("failed to snapshot HTTP keys from %q due to error: %w", source.Name, err)
+		}
+		jwks = append(jwks, j...)
+	}
+	return jwks, nil
+}
+
+// KeyQuery queries the given Storage and the sources with QueryKeys, in the order of KeyReadAll. If the context is
+// restricted to an issuer with ContextWithIssuer, only the sources of the issuer are queried.
+func (c httpClient) KeyQuery(ctx context.Context, filter KeyFilter) ([]JWK, error) {
+	sources := c.sources
+	issuer, restricted := issuerFromContext(ctx)
+	var jwks []JWK
+	if restricted {
+		sources = c.sourcesForIssuer(issuer)
+	} else {
+		var err error
+		jwks, err = QueryKeys(ctx, c.given, filter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query given keys due to error: %w", err)
+		}
+	}
+	for _, source := range sources {
+		j, err := QueryKeys(ctx, source.Storage, filter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query HTTP keys from %q due to error: %w", source.Name, err)
 		}
 		jwks = append(jwks, j...)
 	}
@@ -273,3 +474,127 @@ func (c httpClient) combineStorage(ctx context.Context) (Storage, error) {
 	}
 	return m, nil
 }
+
+// flightGroup coalesces concurrent calls with the same key, so that only one runs at a time and all callers share its
+// result. The call runs on a context detached from its callers, so a caller whose context is over stops waiting without
+// failing the call for the others.
+type flightGroup struct {
+	mux   sync.Mutex
+	calls map[string]*flightCall
+	// stop, if not nil, ends the context of the calls, such as when the owner is closed.
+	stop context.Context
+	// timeout, if positive, limits the context of each call.
+	timeout time.Duration
+}
+
+type flightCall struct {
+	done chan struct{}
+	err  error
+}
+
+func (g *flightGroup) do(ctx context.Context, key string, fn func(ctx context.Context) error) error {
+	g.mux.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	call, ok := g.calls[key]
+	if !ok {
+		call = &flightCall{
+			done: make(chan struct{}),
+		}
+		g.calls[key] = call
+		callCtx, cancel := g.detach(ctx)
+		go func() {
+			defer cancel()
+			err := fn(callCtx)
+			g.mux.Lock()
+			delete(g.calls, key)
+			call.err = err
+			g.mux.Unlock()
+			close(call.done)
+		}()
+	}
+	g.mux.Unlock()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-call.done:
+		return call.err
+	}
+}
+
+// detach returns a context with the values of ctx that ends after the timeout or when stop is over.
+func (g *flightGroup) detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	var detached context.Context
+	var cancel context.CancelFunc
+	if g.timeout > 0 {
+		detached, cancel = context.WithTimeout(context.WithoutCancel(ctx), g.timeout)
+	} else {
+		detached, cancel = context.WithCancel(context.WithoutCancel(ctx))
+	}
+	if g.stop == nil {
+		return detached, cancel
+	}
+	stopAfter := context.AfterFunc(g.stop, cancel)
+	return detached, func() {
+		stopAfter()
+		cancel()
+	}
+}
+
+// unknownKIDRefreshTimeout limits a refresh of a JWK Set client for an unknown key ID, including the wait for the
+// rate limiter. Each Storage also limits its own refresh with its HTTPTimeout option.
+const unknownKIDRefreshTimeout = time.Minute
+
+// maxUnknownKIDs limits the memory used by an unknownKIDCache.
+const maxUnknownKIDs = 1000
+
+// unknownKIDCache remembers key IDs that were not found after a refresh. The zero duration disables it.
+type unknownKIDCache struct {
+	duration time.Duration
+	mux      sync.Mutex
+	expires  map[string]time.Time
+}
+
+func newUnknownKIDCache(duration time.Duration) *unknownKIDCache {
+	return &unknownKIDCache{
+		duration: duration,
+		expires:  make(map[string]time.Time),
+	}
+}
+
+func (u *unknownKIDCache) add(keyID string) {
+	if u == nil || u.duration <= 0 {
+		return
+	}
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	now := time.Now()
+	if len(u.expires) >= maxUnknownKIDs {
+		for kid, expires := range u.expires {
+			if now.After(expires) {
+				delete(u.expires, kid)
+			}
+		}
+		if len(u.expires) >= maxUnknownKIDs {
+			clear(u.expires)
+		}
+	}
+	u.expires[keyID] = now.Add(u.duration)
+}
+func (u *unknownKIDCache) contains(keyID string) bool {
+	if u == nil || u.duration <= 0 {
+		return false
+	}
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	expires, ok := u.expires[keyID]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(u.expires, keyID)
+		return false
+	}
+	return true
+}
@@ -3,12 +3,25 @@ package jwkset
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 func TestClient(t *testing.T) {
@@ -157,3 +170,870 @@ func TestClientJSON(t *testing.T) {
 	}
 	testJSON(context.Background(), t, c)
 }
+
+func TestClientSources(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first := NewMemoryStorage()
+	err := first.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the first store.\nError: %s", err)
+	}
+	second := NewMemoryStorage()
+	err = second.KeyWrite(ctx, newStorageTestJWK(t, hmacKey2, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the second store.\nError: %s", err)
+	}
+	err = second.KeyWrite(ctx, newStorageTestJWK(t, hmacKey2, kidWritten2))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the second store.\nError: %s", err)
+	}
+	sources := []HTTPSource{
+		{Issuer: "https://first.example.com", Name: "first", Storage: first},
+		{Issuer: "https://second.example.com", Name: "second", Storage: second},
+	}
+	readKey := func(c Storage, ctx context.Context, keyID string) []byte {
+		jwk, err := c.KeyRead(ctx, keyID)
+		if err != nil {
+			t.Fatalf("Failed to read the JWK.\nError: %s", err)
+		}
+		return jwk.Key().([]byte)
+	}
+
+	c, err := NewHTTPClient(HTTPClientOptions{Sources: sources})
+	if err != nil {
+		t.Fatalf("Failed to create the client.\nError: %s", err)
+	}
+	if !bytes.Equal(readKey(c, ctx, kidWritten), hmacKey1) {
+		t.Fatalf("Expected the key from the first source to win.")
+	}
+	if !bytes.Equal(readKey(c, ContextWithIssuer(ctx, "https://second.example.com"), kidWritten), hmacKey2) {
+		t.Fatalf("Expected the key from the source of the issuer.")
+	}
+	_, err = c.KeyRead(ContextWithIssuer(ctx, "https://first.example.com"), kidWritten2)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Expected the key of another issuer to not be found, but got %s.", err)
+	}
+	_, err = c.KeyRead(ContextWithIssuer(ctx, "https://unknown.example.com"), kidWritten)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Expected no key for an unknown issuer, but got %s.", err)
+	}
+
+	c, err = NewHTTPClient(HTTPClientOptions{Sources: []HTTPSource{sources[1], sources[0]}})
+	if err != nil {
+		t.Fatalf("Failed to create the client.\nError: %s", err)
+	}
+	if !bytes.Equal(readKey(c, ctx, kidWritten), hmacKey2) {
+		t.Fatalf("Expected the key from the reordered first source to win.")
+	}
+
+	c, err = NewHTTPClient(HTTPClientOptions{KIDConflictPolicy: KIDConflictError, Sources: sources})
+	if err != nil {
+		t.Fatalf("Failed to create the client.\nError: %s", err)
+	}
+	_, err = c.KeyRead(ctx, kidWritten)
+	if !errors.Is(err, ErrKIDConflict) {
+		t.Fatalf("Expected a key ID conflict, but got %s.", err)
+	}
+	if !bytes.Equal(readKey(c, ctx, kidWritten2), hmacKey2) {
+		t.Fatalf("Expected a key ID in one source to be read.")
+	}
+
+	c, err = NewHTTPClient(HTTPClientOptions{KIDConflictPolicy: KIDConflictNamespace, Sources: sources})
+	if err != nil {
+		t.Fatalf("Failed to create the client.\nError: %s", err)
+	}
+	_, err = c.KeyRead(ctx, kidWritten)
+	if !errors.Is(err, ErrKIDConflict) {
+		t.Fatalf("Expected a key ID conflict, but got %s.", err)
+	}
+	if !bytes.Equal(readKey(c, ctx, NamespacedKeyID("second", kidWritten)), hmacKey2) {
+		t.Fatalf("Expected the namespaced key ID to read from the named source.")
+	}
+}
+
+func TestClientKeyQuery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	given := NewMemoryStorage()
+	err := given.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, "given"))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the given store.\nError: %s", err)
+	}
+	first := NewMemoryStorage()
+	err = first.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the first store.\nError: %s", err)
+	}
+	second := unqueriedStorage{NewMemoryStorage()}
+	err = second.KeyWrite(ctx, newStorageTestJWK(t, hmacKey2, kidWritten2))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the second store.\nError: %s", err)
+	}
+	c, err := NewHTTPClient(HTTPClientOptions{
+		Given: given,
+		Sources: []HTTPSource{
+			{Issuer: "https://first.example.com", Name: "first", Storage: first},
+			{Issuer: "https://second.example.com", Name: "second", Storage: second},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the client.\nError: %s", err)
+	}
+	queryKIDs := func(ctx context.Context, filter KeyFilter) []string {
+		keys, err := QueryKeys(ctx, c, filter)
+		if err != nil {
+			t.Fatalf("Failed to query the keys.\nError: %s", err)
+		}
+		var kids []string
+		for _, jwk := range keys {
+			kids = append(kids, jwk.Marshal().KID)
+		}
+		return kids
+	}
+
+	if _, ok := c.(KeyQuery); !ok {
+		t.Fatalf("Expected the client to implement KeyQuery.")
+	}
+	kids := queryKIDs(ctx, KeyFilter{KTY: KtyOct})
+	if !slices.Equal(kids, []string{"given", kidWritten, kidWritten2}) {
+		t.Fatalf("Expected the keys of all sources in order, but got %q.", kids)
+	}
+	kids = queryKIDs(ctx, KeyFilter{Match: func(jwk JWK) bool {
+		return bytes.Equal(jwk.Key().([]byte), hmacKey2)
+	}})
+	if !slices.Equal(kids, []string{kidWritten2}) {
+		t.Fatalf("Expected the matching key of the source without KeyQuery, but got %q.", kids)
+	}
+	kids = queryKIDs(ContextWithIssuer(ctx, "https://first.example.com"), KeyFilter{})
+	if !slices.Equal(kids, []string{kidWritten}) {
+		t.Fatalf("Expected only the keys of the source of the issuer, but got %q.", kids)
+	}
+}
+
+func TestStorageFromHTTPReconcile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverStore := NewMemoryStorage()
+	writeKey := func(kid string, secret []byte) {
+		err := serverStore.KeyWrite(ctx, newStorageTestJWK(t, secret, kid))
+		if err != nil {
+			t.Fatalf("Failed to write the JWK to the server store.\nError: %s", err)
+		}
+	}
+	writeKey(kidWritten, hmacKey1)
+	writeKey(kidWritten2, hmacKey2)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawJWKS, err := serverStore.JSONPrivate(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(rawJWKS)
+	}))
+	defer server.Close()
+	u, err := url.ParseRequestURI(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse the server URL.\nError: %s", err)
+	}
+
+	var changes []KeyChanges
+	options := HTTPClientStorageOptions{
+		Ctx:                ctx,
+		RefreshGracePeriod: time.Hour,
+		RefreshChangeHandler: func(_ context.Context, c KeyChanges) {
+			changes = append(changes, c)
+		},
+	}
+	clientStore, err := NewStorageFromHTTP(u, options)
+	if err != nil {
+		t.Fatalf("Failed to create the HTTP storage.\nError: %s", err)
+	}
+	s := clientStore.(*httpStorage)
+	if len(changes) != 1 || len(changes[0].Added) != 2 {
+		t.Fatalf("Expected the first refresh to add 2 keys, but got %+v.", changes)
+	}
+
+	_, err = serverStore.KeyDelete(ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Failed to delete the JWK from the server store.\nError: %s", err)
+	}
+	writeKey(kidWritten2, []byte("rotated secret"))
+	err = s.refresh(ctx)
+	if err != nil {
+		t.Fatalf("Failed to refresh.\nError: %s", err)
+	}
+	if len(changes) != 2 || !slices.Equal(changes[1].Changed, []string{kidWritten2}) || len(changes[1].Removed) != 0 {
+		t.Fatalf("Expected the second refresh to only change %q, but got %+v.", kidWritten2, changes[1])
+	}
+	_, err = clientStore.KeyRead(ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Expected the removed key to be kept during the grace period.\nError: %s", err)
+	}
+
+	s.mux.Lock()
+	s.removedAt[kidWritten] = time.Now().Add(-2 * time.Hour)
+	s.mux.Unlock()
+	err = s.refresh(ctx)
+	if err != nil {
+		t.Fatalf("Failed to refresh.\nError: %s", err)
+	}
+	if len(changes) != 3 || !slices.Equal(changes[2].Removed, []string{kidWritten}) {
+		t.Fatalf("Expected the third refresh to remove %q, but got %+v.", kidWritten, changes)
+	}
+	_, err = clientStore.KeyRead(ctx, kidWritten)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Expected the removed key to be missing after the grace period.\nError: %s", err)
+	}
+
+	err = s.refresh(ctx)
+	if err != nil {
+		t.Fatalf("Failed to refresh.\nError: %s", err)
+	}
+	if len(changes) != 3 {
+		t.Fatalf("Expected no change handler call for an unchanged refresh, but got %+v.", changes[3:])
+	}
+}
+
+func TestStorageFromHTTPReconcileRestore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverStore := NewMemoryStorage()
+	err := serverStore.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the server store.\nError: %s", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawJWKS, err := serverStore.JSONPrivate(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(rawJWKS)
+	}))
+	defer server.Close()
+	u, err := url.ParseRequestURI(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse the server URL.\nError: %s", err)
+	}
+
+	inner := failingWriteStorage{Storage: NewMemoryStorage(), failKID: kidMissing}
+	clientStore, err := NewStorageFromHTTP(u, HTTPClientStorageOptions{Ctx: ctx, Storage: inner})
+	if err != nil {
+		t.Fatalf("Failed to create the HTTP storage.\nError: %s", err)
+	}
+	s := clientStore.(*httpStorage)
+
+	for _, kid := range []string{kidWritten, kidWritten2, kidMissing} {
+		err = serverStore.KeyWrite(ctx, newStorageTestJWK(t, hmacKey2, kid))
+		if err != nil {
+			t.Fatalf("Failed to write the JWK to the server store.\nError: %s", err)
+		}
+	}
+	err = s.refresh(ctx)
+	if !errors.Is(err, errFailingWrite) || !strings.Contains(err.Error(), "restored the previous keys") {
+		t.Fatalf("Expected a refresh error that reports the restored keys, but got %v.", err)
+	}
+	keys, err := clientStore.KeyReadAll(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read the JWKs.\nError: %s", err)
+	}
+	if len(keys) != 1 || keys[0].Marshal().KID != kidWritten || !bytes.Equal(keys[0].Key().([]byte), hmacKey1) {
+		t.Fatalf("Expected only the previous key after a failed reconcile, but got %d keys.", len(keys))
+	}
+}
+
+// errFailingWrite is returned by failingWriteStorage.
+var errFailingWrite = errors.New("failing write")
+
+// failingWriteStorage is a Storage without BatchStorage support that fails to write the key with failKID.
+type failingWriteStorage struct {
+	Storage
+	failKID string
+}
+
+func (f failingWriteStorage) KeyWrite(ctx context.Context, jwk JWK) error {
+	if jwk.Marshal().KID == f.failKID {
+		return errFailingWrite
+	}
+	return f.Storage.KeyWrite(ctx, jwk)
+}
+
+func TestStorageFromHTTPConditional(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverStore := NewMemoryStorage()
+	err := serverStore.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the server store.\nError: %s", err)
+	}
+	rawJWKS, err := serverStore.JSONPrivate(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get the JSON.\nError: %s", err)
+	}
+
+	const etag = `"v1"`
+	var full, notModified int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=30")
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full++
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write(rawJWKS)
+	}))
+	defer server.Close()
+	u, err := url.ParseRequestURI(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse the server URL.\nError: %s", err)
+	}
+
+	options := HTTPClientStorageOptions{
+		Ctx:                 ctx,
+		RefreshCacheHeaders: true,
+		RefreshInterval:     time.Hour,
+		RefreshIntervalMin:  time.Second,
+	}
+	clientStore, err := NewStorageFromHTTP(u, options)
+	if err != nil {
+		t.Fatalf("Failed to create the HTTP storage.\nError: %s", err)
+	}
+	s := clientStore.(*httpStorage)
+	err = s.refresh(ctx)
+	if err != nil {
+		t.Fatalf("Failed to refresh.\nError: %s", err)
+	}
+	if full != 1 || notModified != 1 {
+		t.Fatalf("Expected 1 full and 1 conditional response, but got %d and %d.", full, notModified)
+	}
+	_, err = clientStore.KeyRead(ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Expected the key to be kept after a 304 response.\nError: %s", err)
+	}
+	if next := s.nextRefresh(); next != 30*time.Second {
+		t.Fatalf("Expected the next refresh in 30s from the max-age directive, but got %s.", next)
+	}
+}
+
+func TestCacheLifetime(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tc := []struct {
+		name     string
+		header   http.Header
+		expected time.Duration
+	}{
+		{name: "none", header: http.Header{}, expected: -1},
+		{name: "max-age", header: http.Header{"Cache-Control": {"public, max-age=600"}}, expected: 10 * time.Minute},
+		{name: "max-age with age", header: http.Header{"Cache-Control": {"max-age=600"}, "Age": {"60"}}, expected: 9 * time.Minute},
+		{name: "no-store", header: http.Header{"Cache-Control": {"no-store"}}, expected: 0},
+		{name: "expires", header: http.Header{"Expires": {now.Add(time.Hour).Format(http.TimeFormat)}, "Date": {now.Format(http.TimeFormat)}}, expected: time.Hour},
+		{name: "invalid expires", header: http.Header{"Expires": {"0"}}, expected: 0},
+		{name: "max-age over expires", header: http.Header{"Cache-Control": {"max-age=5"}, "Expires": {"0"}}, expected: 5 * time.Second},
+	}
+	for _, c := range tc {
+		t.Run(c.name, func(t *testing.T) {
+			actual := cacheLifetime(c.header, now)
+			if actual != c.expected {
+				t.Fatalf("Unexpected cache lifetime.\n  Actual: %s\n  Expected: %s", actual, c.expected)
+			}
+		})
+	}
+}
+
+func TestStorageFromHTTPRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverStore := NewMemoryStorage()
+	err := serverStore.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the server store.\nError: %s", err)
+	}
+	rawJWKS, err := serverStore.JSONPrivate(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get the JSON.\nError: %s", err)
+	}
+
+	var requests int
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= 2 {
+			w.WriteHeader(status)
+			return
+		}
+		_, _ = w.Write(rawJWKS)
+	}))
+	defer server.Close()
+	u, err := url.ParseRequestURI(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse the server URL.\nError: %s", err)
+	}
+
+	options := HTTPClientStorageOptions{
+		Ctx:           ctx,
+		RefreshJitter: 0.5,
+		RefreshRetry: RetryOptions{
+			InitialBackoff: time.Millisecond,
+			MaxRetries:     2,
+		},
+	}
+	clientStore, err := NewStorageFromHTTP(u, options)
+	if err != nil {
+		t.Fatalf("Failed to create the HTTP storage after retries.\nError: %s", err)
+	}
+	if requests != 3 {
+		t.Fatalf("Expected 3 requests, but got %d.", requests)
+	}
+	_, err = clientStore.KeyRead(ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Failed to read the JWK.\nError: %s", err)
+	}
+
+	requests = 0
+	status = http.StatusNotFound
+	_, err = NewStorageFromHTTP(u, options)
+	if !errors.Is(err, ErrInvalidHTTPStatusCode) {
+		t.Fatalf("Expected an invalid HTTP status code error, but got %s.", err)
+	}
+	if requests != 1 {
+		t.Fatalf("Expected a non-transient error not to be retried, but got %d requests.", requests)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Second, 0.1)
+		if d < 900*time.Millisecond || d > 1100*time.Millisecond {
+			t.Fatalf("Jitter out of bounds: %s.", d)
+		}
+	}
+	if d := jitter(time.Second, 0); d != time.Second {
+		t.Fatalf("Expected no jitter, but got %s.", d)
+	}
+}
+
+func TestClientRefreshUnknownKID(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	serverStore := NewMemoryStorage()
+	var requests atomic.Int64
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 2 {
+			<-release
+		}
+		rawJWKS, err := serverStore.JSONPrivate(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(rawJWKS)
+	}))
+	defer server.Close()
+	u, err := url.ParseRequestURI(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse the server URL.\nError: %s", err)
+	}
+	httpStore, err := NewStorageFromHTTP(u, HTTPClientStorageOptions{Ctx: ctx})
+	if err != nil {
+		t.Fatalf("Failed to create the HTTP storage.\nError: %s", err)
+	}
+	clientStore, err := NewHTTPClient(HTTPClientOptions{
+		HTTPURLs:                map[string]Storage{server.URL: httpStore},
+		RefreshUnknownKID:       rate.NewLimiter(rate.Inf, 1),
+		UnknownKIDCacheDuration: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the HTTP client.\nError: %s", err)
+	}
+
+	err = serverStore.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the server store.\nError: %s", err)
+	}
+	const readers = 10
+	errs := make(chan error, readers)
+	for i := 0; i < readers; i++ {
+		go func() {
+			_, err := clientStore.KeyRead(ctx, kidWritten)
+			errs <- err
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	for i := 0; i < readers; i++ {
+		err = <-errs
+		if err != nil {
+			t.Fatalf("Failed to read the JWK.\nError: %s", err)
+		}
+	}
+	if actual := requests.Load(); actual != 2 {
+		t.Fatalf("Expected concurrent reads to share 1 refresh, but got %d requests in total.", actual)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err = clientStore.KeyRead(ctx, kidMissing)
+		if !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("Should have specific error when reading missing key.\n  Actual: %s\n  Expected: %s", err, ErrKeyNotFound)
+		}
+	}
+	if actual := requests.Load(); actual != 3 {
+		t.Fatalf("Expected an unknown key ID to only be refreshed once, but got %d requests in total.", actual)
+	}
+}
+
+func TestClientRefreshUnknownKIDFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	serverStore := NewMemoryStorage()
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rawJWKS, err := serverStore.JSONPrivate(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(rawJWKS)
+	}))
+	defer server.Close()
+	u, err := url.ParseRequestURI(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse the server URL.\nError: %s", err)
+	}
+	httpStore, err := NewStorageFromHTTP(u, HTTPClientStorageOptions{Ctx: ctx})
+	if err != nil {
+		t.Fatalf("Failed to create the HTTP storage.\nError: %s", err)
+	}
+	clientStore, err := NewHTTPClient(HTTPClientOptions{
+		HTTPURLs:                map[string]Storage{server.URL: httpStore},
+		RefreshUnknownKID:       rate.NewLimiter(rate.Inf, 1),
+		UnknownKIDCacheDuration: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the HTTP client.\nError: %s", err)
+	}
+
+	failing.Store(true)
+	err = serverStore.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the server store.\nError: %s", err)
+	}
+	_, err = clientStore.KeyRead(ctx, kidWritten)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Expected the key to not be found while the server fails, but got %v.", err)
+	}
+	failing.Store(false)
+	_, err = clientStore.KeyRead(ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Expected a key ID that was unknown during a failed refresh to not be cached.\nError: %s", err)
+	}
+}
+
+func TestStorageFromHTTPRefreshCanceledCaller(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	serverStore := NewMemoryStorage()
+	var requests atomic.Int64
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 2 {
+			close(started)
+			<-release
+		}
+		rawJWKS, err := serverStore.JSONPrivate(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(rawJWKS)
+	}))
+	defer server.Close()
+	u, err := url.ParseRequestURI(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse the server URL.\nError: %s", err)
+	}
+	clientStore, handle, err := NewStorageFromHTTPWithHandle(u, HTTPClientStorageOptions{Ctx: ctx})
+	if err != nil {
+		t.Fatalf("Failed to create the HTTP storage.\nError: %s", err)
+	}
+	err = serverStore.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the server store.\nError: %s", err)
+	}
+
+	firstCtx, cancelFirst := context.WithCancel(ctx)
+	first := make(chan error, 1)
+	go func() {
+		first <- handle.Refresh(firstCtx)
+	}()
+	<-started
+	cancelFirst()
+	err = <-first
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the canceled caller to stop waiting, but got %v.", err)
+	}
+	close(release)
+	for {
+		_, err = clientStore.KeyRead(ctx, kidWritten)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("Expected the refresh to finish after its caller was canceled.\nError: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if actual := requests.Load(); actual != 2 {
+		t.Fatalf("Expected 1 refresh after the initial request, but got %d requests in total.", actual)
+	}
+}
+
+func TestStorageFromHTTPWithHandle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverStore := NewMemoryStorage()
+	err := serverStore.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the server store.\nError: %s", err)
+	}
+	var fail atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		rawJWKS, err := serverStore.JSONPrivate(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write(rawJWKS)
+	}))
+	defer server.Close()
+	u, err := url.ParseRequestURI(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse the server URL.\nError: %s", err)
+	}
+
+	options := HTTPClientStorageOptions{
+		Ctx:                   ctx,
+		NoConditionalRequests: true,
+		RefreshInterval:       time.Hour,
+	}
+	clientStore, handle, err := NewStorageFromHTTPWithHandle(u, options)
+	if err != nil {
+		t.Fatalf("Failed to create the HTTP storage.\nError: %s", err)
+	}
+	status := handle.LastRefresh()
+	if status.Err != nil || status.StatusCode != http.StatusOK || status.KeyCount != 1 || status.ETag != `"v1"` || status.Succeeded.IsZero() {
+		t.Fatalf("Unexpected status after the first refresh: %+v.", status)
+	}
+
+	err = serverStore.KeyWrite(ctx, newStorageTestJWK(t, hmacKey2, kidWritten2))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the server store.\nError: %s", err)
+	}
+	err = handle.Refresh(ctx)
+	if err != nil {
+		t.Fatalf("Failed to refresh.\nError: %s", err)
+	}
+	_, err = clientStore.KeyRead(ctx, kidWritten2)
+	if err != nil {
+		t.Fatalf("Failed to read the JWK after a manual refresh.\nError: %s", err)
+	}
+
+	fail.Store(true)
+	succeeded := handle.LastRefresh().Succeeded
+	err = handle.Refresh(ctx)
+	if !errors.Is(err, ErrInvalidHTTPStatusCode) {
+		t.Fatalf("Expected an invalid HTTP status code error, but got %s.", err)
+	}
+	status = handle.LastRefresh()
+	if status.Err == nil || status.StatusCode != http.StatusBadGateway || status.KeyCount != 2 || !status.Succeeded.Equal(succeeded) {
+		t.Fatalf("Unexpected status after a failed refresh: %+v.", status)
+	}
+
+	err = handle.Close()
+	if err != nil {
+		t.Fatalf("Failed to close the HTTP storage.\nError: %s", err)
+	}
+	err = handle.Refresh(ctx)
+	if !errors.Is(err, ErrHTTPStorageClosed) {
+		t.Fatalf("Expected a closed error, but got %s.", err)
+	}
+	_, err = clientStore.KeyRead(ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Failed to read the JWK after closing.\nError: %s", err)
+	}
+}
+
+func TestStorageFromHTTPRequestOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverStore := NewMemoryStorage()
+	err := serverStore.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the server store.\nError: %s", err)
+	}
+	rawJWKS, err := serverStore.JSONPrivate(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get the JSON.\nError: %s", err)
+	}
+	contentType := "application/jwk-set+json; charset=utf-8"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("Authorization") != "Bearer my-token",
+			r.Header.Get("X-Custom") != "custom",
+			r.Header.Get("X-Hook") != "hook",
+			r.UserAgent() != "my-agent":
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		_, _ = w.Write(rawJWKS)
+	}))
+	defer server.Close()
+	u, err := url.ParseRequestURI(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse the server URL.\nError: %s", err)
+	}
+
+	options := HTTPClientStorageOptions{
+		BearerToken: func(ctx context.Context) (string, error) {
+			return "my-token", nil
+		},
+		Ctx:                  ctx,
+		HTTPCheckContentType: true,
+		HTTPHeader:           http.Header{"X-Custom": {"custom"}},
+		HTTPMaxBodySize:      int64(len(rawJWKS)),
+		HTTPRequestHook: func(req *http.Request) error {
+			req.Header.Set("X-Hook", "hook")
+			return nil
+		},
+		HTTPUserAgent: "my-agent",
+	}
+	clientStore, err := NewStorageFromHTTP(u, options)
+	if err != nil {
+		t.Fatalf("Failed to create the HTTP storage.\nError: %s", err)
+	}
+	_, err = clientStore.KeyRead(ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Failed to read the JWK.\nError: %s", err)
+	}
+
+	options.HTTPMaxBodySize--
+	_, err = NewStorageFromHTTP(u, options)
+	if !errors.Is(err, ErrHTTPResponseTooLarge) {
+		t.Fatalf("Expected a response too large error, but got %s.", err)
+	}
+
+	options.HTTPMaxBodySize = 0
+	contentType = "text/html"
+	_, err = NewStorageFromHTTP(u, options)
+	if !errors.Is(err, ErrHTTPContentType) {
+		t.Fatalf("Expected a Content-Type error, but got %s.", err)
+	}
+}
+
+func TestStorageFromHTTPClientCertificates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate a key.\nError: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("Failed to create a certificate.\nError: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse the certificate.\nError: %s", err)
+	}
+	options := JWKOptions{
+		Metadata: JWKMetadataOptions{
+			KID: kidWritten,
+		},
+		X509: JWKX509Options{
+			X5C: []*x509.Certificate{cert},
+		},
+	}
+	jwk, err := NewJWKFromKey(priv, options)
+	if err != nil {
+		t.Fatalf("Failed to create a JWK from a private key and certificate.\nError: %s", err)
+	}
+	tlsCert, err := TLSCertificateFromJWK(jwk)
+	if err != nil {
+		t.Fatalf("Failed to create a TLS certificate from the JWK.\nError: %s", err)
+	}
+
+	serverStore := NewMemoryStorage()
+	err = serverStore.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the server store.\nError: %s", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || !r.TLS.PeerCertificates[0].Equal(cert) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		rawJWKS, err := serverStore.JSONPrivate(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(rawJWKS)
+	}))
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAnyClientCert,
+	}
+	server.StartTLS()
+	defer server.Close()
+	u, err := url.ParseRequestURI(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse the server URL.\nError: %s", err)
+	}
+
+	storageOptions := HTTPClientStorageOptions{
+		Client:             server.Client(),
+		ClientCertificates: []tls.Certificate{tlsCert},
+		Ctx:                ctx,
+	}
+	clientStore, err := NewStorageFromHTTP(u, storageOptions)
+	if err != nil {
+		t.Fatalf("Failed to create the HTTP storage with mutual TLS.\nError: %s", err)
+	}
+	_, err = clientStore.KeyRead(ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Failed to read the JWK.\nError: %s", err)
+	}
+}
@@ -5,8 +5,12 @@ import (
 	"context"
 	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -55,7 +59,7 @@ type JWKValidateOptions struct {
 	// CheckX509ValidTime is used to indicate that the X.509 certificate's valid time should be checked.
 	CheckX509ValidTime bool
 	// GetX5U is used to get and validate the X.509 certificate from the X5U URI. Use DefaultGetX5U for the default
-	// behavior.
+	// behavior. Use the GetX5U method of a SafeFetcher if the X5U URI comes from untrusted input.
 	GetX5U func(x5u *url.URL) ([]*x509.Certificate, error)
 	// SkipAll is used to skip all validation.
 	SkipAll bool
@@ -212,6 +216,55 @@ func (j JWK) X509() JWKX509Options {
 	return j.options.X509
 }
 
+// Thumbprint returns the base64url encoded SHA-256 JWK Thumbprint of the JWK.
+// https://www.rfc-editor.org/rfc/rfc7638
+func (j JWK) Thumbprint() (string, error) {
+	options := j.options
+	options.Marshal = JWKMarshalOptions{
+		Private: true, // The "k" member of symmetric keys is required.
+	}
+	marshal, err := keyMarshal(j.key, options)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal JSON Web Key: %w", err)
+	}
+	// The required members of each key type, in lexicographic order.
+	var members any
+	switch marshal.KTY {
+	case KtyEC:
+		members = struct {
+			CRV CRV    `json:"crv"`
+			KTY KTY    `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{CRV: marshal.CRV, KTY: marshal.KTY, X: marshal.X, Y: marshal.Y}
+	case KtyOKP:
+		members = struct {
+			CRV CRV    `json:"crv"`
+			KTY KTY    `json:"kty"`
+			X   string `json:"x"`
+		}{CRV: marshal.CRV, KTY: marshal.KTY, X: marshal.X}
+	case KtyRSA:
+		members = struct {
+			E   string `json:"e"`
+			KTY KTY    `json:"kty"`
+			N   string `json:"n"`
+		}{E: marshal.E, KTY: marshal.KTY, N: marshal.N}
+	case KtyOct:
+		members = struct {
+			K   string `json:"k"`
+			KTY KTY    `json:"kty"`
+		}{K: marshal.K, KTY: marshal.KTY}
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnsupportedKey, marshal.KTY)
+	}
+	raw, err := json.Marshal(members)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal JWK Thumbprint members: %w", err)
+	}
+	sum := sha256.Sum256(raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
 // Validate validates the JWK. The JWK is automatically validated when created from a function in this package.
 func (j JWK) Validate() error {
 	if j.options.Validate.SkipAll {
@@ -251,7 +304,16 @@ func (j JWK) Validate() error {
 	if len(j.options.X509.X5C) > 0 {
 		cert := j.options.X509.X5C[0]
 		i := cert.PublicKey
-		switch k := j.key.(type) {
+		key := j.key
+		switch k := key.(type) {
+		case *ecdsa.PrivateKey:
+			key = &k.PublicKey
+		case ed25519.PrivateKey:
+			key = k.Public()
+		case *rsa.PrivateKey:
+			key = &k.PublicKey
+		}
+		switch k := key.(type) {
 		// ECDH keys are not used to sign certificates.
 		case *ecdsa.PublicKey:
 			pub, ok := i.(*ecdsa.PublicKey)
@@ -376,3 +438,37 @@ func DefaultGetX5U(u *url.URL) ([]*x509.Certificate, error) {
 	}
 	return certs, nil
 }
+
+// withThumbprintKeyID returns a copy of the JWK with its RFC 7638 thumbprint as key ID.
+func withThumbprintKeyID(jwk JWK) (JWK, error) {
+	thumbprint, err := jwk.Thumbprint()
+	if err != nil {
+		return JWK{}, fmt.Errorf("failed to compute thumbprint for key ID: %w", err)
+	}
+	marshal := jwk.Marshal()
+	marshal.KID = thumbprint
+	return NewJWKFromMarshal(marshal, jwk.options.Marshal, jwk.options.Validate)
+}
+
+// generateKey generates a new key for the algorithm.
+func generateKey(alg ALG) (any, error) {
+	switch alg {
+	case AlgEdDSA:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	case AlgES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgES384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case AlgES512:
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case AlgHS256, AlgHS384, AlgHS512:
+		size := map[ALG]int{AlgHS256: 32, AlgHS384: 48, AlgHS512: 64}[alg]
+		key := make([]byte, size)
+		_, err := rand.Read(key)
+		return key, err
+	case AlgPS256, AlgPS384, AlgPS512, AlgRS256, AlgRS384, AlgRS512:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+	return nil, fmt.Errorf("%w: unsupported algorithm for key generation %q", ErrOptions, alg)
+}
@@ -0,0 +1,446 @@
+package jwkset
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrKVRevision indicates that a conditional KVBackend operation failed because the revision of the key did not
+	// match. For a KV Storage, it means that a key was changed by another writer since the Storage last read or wrote
+	// it.
+	ErrKVRevision = errors.New("key-value revision does not match")
+)
+
+// KVRevisionAny makes a KVBackend operation unconditional.
+const KVRevisionAny int64 = -1
+
+// KVEntry is a key and its value in a KVBackend.
+type KVEntry struct {
+	Key string
+	// Revision changes every time the key is put. It is never 0 for an existing key.
+	Revision int64
+	Value    []byte
+}
+
+// KVEvent is a change of a key in a KVBackend. For a deletion, the entry has no value.
+type KVEvent struct {
+	Deleted bool
+	Entry   KVEntry
+}
+
+// KVBackend is a minimal interface to a key-value store, such as etcd, Consul, or Redis. It is used by
+// NewStorageFromKV.
+//
+// Conditional operations take the expected revision of the key. A revision of 0 expects the key to not exist and
+// KVRevisionAny makes the operation unconditional. If the revision does not match, the operation must fail with an error
+// that wraps ErrKVRevision.
+type KVBackend interface {
+	// Delete deletes the key if it has the expected revision. It returns false if the key does not exist.
+	Delete(ctx context.Context, key string, revision int64) (ok bool, err error)
+	// Get returns the entry of the key. It returns an error that wraps ErrKeyNotFound if the key does not exist.
+	Get(ctx context.Context, key string) (KVEntry, error)
+	// List returns the entries of all keys with the prefix, sorted by key.
+	List(ctx context.Context, prefix string) ([]KVEntry, error)
+	// Put sets the value of the key if it has the expected revision. It returns the new revision of the key.
+	Put(ctx context.Context, key string, value []byte, revision int64) (int64, error)
+}
+
+// KVWatcher is optionally implemented by a KVBackend that can notify about changes.
+type KVWatcher interface {
+	// Watch sends the changes of keys with the prefix until the context is over. The channel is closed when the watch
+	// ends, including when the receiver falls too far behind. Then List should be called again before starting a new
+	// watch.
+	Watch(ctx context.Context, prefix string) (<-chan KVEvent, error)
+}
+
+// KVStorageOptions are used to configure the behavior of NewStorageFromKV.
+type KVStorageOptions struct {
+	// Prefix is prepended to key IDs to create the keys of the KVBackend.
+	//
+	// This defaults to "jwkset/".
+	Prefix string
+}
+
+// kvStorage is a Storage backed by a KVBackend. Each key is stored as its marshaled private JSON.
+type kvStorage struct {
+	backend KVBackend
+	options KVStorageOptions
+
+	mux       sync.Mutex
+	revisions map[string]int64 // The revision of each key this Storage last read with KeyRead or wrote.
+}
+
+// kvWatchedStorage is a kvStorage whose KVBackend implements KVWatcher, so it implements StorageWatcher.
+type kvWatchedStorage struct {
+	*kvStorage
+	watcher KVWatcher
+}
+
+// NewStorageFromKV creates a new Storage backed by the given KVBackend. If the KVBackend implements KVWatcher, the
+// Storage implements StorageWatcher and notifies about the changes of all writers.
+//
+// KeyWrite uses optimistic concurrency. If this Storage read or wrote the key before, the write fails with
+// ErrKVRevision if another writer changed or deleted the key since, until the key is read again with KeyRead. If this
+// Storage never read or wrote the key, the write creates or overwrites it unconditionally. KeyReadAll and the other
+// reads of all keys don't change the revisions KeyWrite expects.
+func NewStorageFromKV(backend KVBackend, options KVStorageOptions) Storage {
+	if options.Prefix == "" {
+		options.Prefix = "jwkset/"
+	}
+	s := &kvStorage{
+		backend:   backend,
+		options:   options,
+		revisions: make(map[string]int64),
+	}
+	if watcher, ok := backend.(KVWatcher); ok {
+		return &kvWatchedStorage{
+			kvStorage: s,
+			watcher:   watcher,
+		}
+	}
+	return s
+}
+
+func (s *kvStorage) KeyDelete(ctx context.Context, keyID string) (ok bool, err error) {
+	ok, err = s.backend.Delete(ctx, s.options.Prefix+keyID, KVRevisionAny)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete key from key-value backend: %w", err)
+	}
+	s.mux.Lock()
+	delete(s.revisions, keyID)
+	s.mux.Unlock()
+	return ok, nil
+}
+func (s *kvStorage) KeyRead(ctx context.Context, keyID string) (JWK, error) {
+	entry, err := s.backend.Get(ctx, s.options.Prefix+keyID)
+	if errors.Is(err, ErrKeyNotFound) {
+		s.mux.Lock()
+		delete(s.revisions, keyID)
+		s.mux.Unlock()
+	}
+	if err != nil {
+		return JWK{}, fmt.Errorf("failed to read key from key-value backend: %w", err)
+	}
+	jwk, err := kvUnmarshalJWK(entry)
+	if err != nil {
+		return JWK{}, err
+	}
+	s.mux.Lock()
+	s.revisions[keyID] = entry.Revision
+	s.mux.Unlock()
+	return jwk, nil
+}
+func (s *kvStorage) KeyReadAll(ctx context.Context) ([]JWK, error) {
+	entries, err := s.backend.List(ctx, s.options.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys in key-value backend: %w", err)
+	}
+	jwks := make([]JWK, 0, len(entries))
+	for _, entry := range entries {
+		jwk, err := kvUnmarshalJWK(entry)
+		if err != nil {
+			return nil, err
+		}
+		jwks = append(jwks, jwk)
+	}
+	return jwks, nil
+}
+func (s *kvStorage) KeyWrite(ctx context.Context, jwk JWK) error {
+	options := jwk.options
+	options.Marshal = JWKMarshalOptions{
+		Private: true,
+	}
+	marshal, err := keyMarshal(jwk.Key(), options)
+	if err != nil {
+		return fmt.Errorf("failed to marshal key: %w", err)
+	}
+	value, err := json.Marshal(marshal)
+	if err != nil {
+		return fmt.Errorf("failed to marshal key: %w", err)
+	}
+	keyID := marshal.KID
+
+	s.mux.Lock()
+	revision, seen := s.revisions[keyID]
+	s.mux.Unlock()
+	if !seen {
+		revision = KVRevisionAny
+	}
+	revision, err = s.backend.Put(ctx, s.options.Prefix+keyID, value, revision)
+	if err != nil {
+		return fmt.Errorf("failed to write key %q to key-value backend: %w", keyID, err)
+	}
+	s.mux.Lock()
+	s.revisions[keyID] = revision
+	s.mux.Unlock()
+	return nil
+}
+
+func (s *kvStorage) JSON(ctx context.Context) (json.RawMessage, error) {
+	m, err := s.memory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.JSON(ctx)
+}
+func (s *kvStorage) JSONPublic(ctx context.Context) (json.RawMessage, error) {
+	m, err := s.memory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.JSONPublic(ctx)
+}
+func (s *kvStorage) JSONPrivate(ctx context.Context) (json.RawMessage, error) {
+	m, err := s.memory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.JSONPrivate(ctx)
+}
+func (s *kvStorage) JSONWithOptions(ctx context.Context, marshalOptions JWKMarshalOptions, validationOptions JWKValidateOptions) (json.RawMessage, error) {
+	m, err := s.memory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.JSONWithOptions(ctx, marshalOptions, validationOptions)
+}
+func (s *kvStorage) Marshal(ctx context.Context) (JWKSMarshal, error) {
+	m, err := s.memory(ctx)
+	if err != nil {
+		return JWKSMarshal{}, err
+	}
+	return m.Marshal(ctx)
+}
+func (s *kvStorage) MarshalWithOptions(ctx context.Context, marshalOptions JWKMarshalOptions, validationOptions JWKValidateOptions) (JWKSMarshal, error) {
+	m, err := s.memory(ctx)
+	if err != nil {
+		return JWKSMarshal{}, err
+	}
+	return m.MarshalWithOptions(ctx, marshalOptions, validationOptions)
+}
+
+// memory returns an in-memory Storage with a snapshot of all keys.
+func (s *kvStorage) memory(ctx context.Context) (Storage, error) {
+	jwks, err := s.KeyReadAll(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot keys due to error: %w", err)
+	}
+	m := NewMemoryStorage()
+	err = m.(BatchStorage).ReplaceAll(ctx, jwks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write keys to memory storage due to error: %w", err)
+	}
+	return m, nil
+}
+
+// Watch watches the KVBackend, then lists the keys to know the JWK before each change. Changes that happen between the
+// two may be reflected in the listed keys, so they are only sent if they still change a key.
+func (s *kvWatchedStorage) Watch(ctx context.Context) (<-chan KeyEvent, error) {
+	watchCtx, cancel := context.WithCancel(ctx)
+	kvEvents, err := s.watcher.Watch(watchCtx, s.options.Prefix)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to watch key-value backend: %w", err)
+	}
+	entries, err := s.backend.List(ctx, s.options.Prefix)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to list keys in key-value backend: %w", err)
+	}
+	known := make(map[string]*JWK, len(entries))
+	for _, entry := range entries {
+		jwk, err := kvUnmarshalJWK(entry)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		known[strings.TrimPrefix(entry.Key, s.options.Prefix)] = &jwk
+	}
+
+	events := make(chan KeyEvent, keyWatchBuffer)
+	go func() {
+		defer close(events)
+		defer cancel()
+		for kvEvent := range kvEvents {
+			kid := strings.TrimPrefix(kvEvent.Entry.Key, s.options.Prefix)
+			var jwk *JWK
+			if !kvEvent.Deleted {
+				j, err := kvUnmarshalJWK(kvEvent.Entry)
+				if err != nil {
+					return // The keys are unknown now, so the receiver must read them again.
+				}
+				jwk = &j
+			}
+			event, ok := keyEvent(kid, known[kid], jwk)
+			if jwk == nil {
+				delete(known, kid)
+			} else {
+				known[kid] = jwk
+			}
+			if !ok {
+				continue
+			}
+			select {
+			case events <- event:
+			default:
+				return // The receiver fell behind.
+			}
+		}
+	}()
+	return events, nil
+}
+
+func kvUnmarshalJWK(entry KVEntry) (JWK, error) {
+	marshalOptions := JWKMarshalOptions{
+		Private: true,
+	}
+	jwk, err := NewJWKFromRawJSON(entry.Value, marshalOptions, JWKValidateOptions{})
+	if err != nil {
+		return JWK{}, fmt.Errorf("failed to create JWK from key-value entry %q: %w", entry.Key, err)
+	}
+	return jwk, nil
+}
+
+// kvWatchBuffer is the number of events a memory KVBackend buffers for each watch.
+const kvWatchBuffer = 64
+
+// memoryKVBackend is an in-memory KVBackend and KVWatcher. Like etcd, every change increments a revision shared by all
+// keys.
+type memoryKVBackend struct {
+	mux      sync.Mutex
+	entries  map[string]KVEntry
+	revision int64
+	watches  map[*memoryKVWatch]struct{}
+}
+
+type memoryKVWatch struct {
+	events chan KVEvent
+	prefix string
+}
+
+// NewMemoryKVBackend creates a new in-memory KVBackend, which also implements KVWatcher. It is a reference
+// implementation meant for tests.
+func NewMemoryKVBackend() KVBackend {
+	return &memoryKVBackend{
+		entries: make(map[string]KVEntry),
+		watches: make(map[*memoryKVWatch]struct{}),
+	}
+}
+
+func (m *memoryKVBackend) Delete(_ context.Context, key string, revision int64) (ok bool, err error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	entry, ok := m.entries[key]
+	err = checkKVRevision(key, entry.Revision, revision)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, nil
+	}
+	delete(m.entries, key)
+	m.revision++
+	m.notify(KVEvent{
+		Deleted: true,
+		Entry: KVEntry{
+			Key:      key,
+			Revision: m.revision,
+		},
+	})
+	return true, nil
+}
+func (m *memoryKVBackend) Get(_ context.Context, key string) (KVEntry, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	entry, ok := m.entries[key]
+	if !ok {
+		return KVEntry{}, fmt.Errorf("%w: %q", ErrKeyNotFound, key)
+	}
+	entry.Value = bytes.Clone(entry.Value)
+	return entry, nil
+}
+func (m *memoryKVBackend) List(_ context.Context, prefix string) ([]KVEntry, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	var entries []KVEntry
+	for key, entry := range m.entries {
+		if strings.HasPrefix(key, prefix) {
+			entry.Value = bytes.Clone(entry.Value)
+			entries = append(entries, entry)
+		}
+	}
+	slices.SortFunc(entries, func(a, b KVEntry) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return entries, nil
+}
+func (m *memoryKVBackend) Put(_ context.Context, key string, value []byte, revision int64) (int64, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	err := checkKVRevision(key, m.entries[key].Revision, revision)
+	if err != nil {
+		return 0, err
+	}
+	m.revision++
+	entry := KVEntry{
+		Key:      key,
+		Revision: m.revision,
+		Value:    bytes.Clone(value),
+	}
+	m.entries[key] = entry
+	entry.Value = bytes.Clone(value) // The event must not share the stored value.
+	m.notify(KVEvent{Entry: entry})
+	return m.revision, nil
+}
+func (m *memoryKVBackend) Watch(ctx context.Context, prefix string) (<-chan KVEvent, error) {
+	w := &memoryKVWatch{
+		events: make(chan KVEvent, kvWatchBuffer),
+		prefix: prefix,
+	}
+	m.mux.Lock()
+	m.watches[w] = struct{}{}
+	m.mux.Unlock()
+	go func() {
+		<-ctx.Done()
+		m.mux.Lock()
+		defer m.mux.Unlock()
+		m.endWatch(w)
+	}()
+	return w.events, nil
+}
+
+// notify sends the event to all watches of its key. The caller must hold m.mux.
+func (m *memoryKVBackend) notify(event KVEvent) {
+	for w := range m.watches {
+		if !strings.HasPrefix(event.Entry.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.events <- event:
+		default:
+			m.endWatch(w) // The receiver fell behind.
+		}
+	}
+}
+
+// endWatch closes the watch if it's still open. The caller must hold m.mux.
+func (m *memoryKVBackend) endWatch(w *memoryKVWatch) {
+	if _, ok := m.watches[w]; ok {
+		delete(m.watches, w)
+		close(w.events)
+	}
+}
+
+func checkKVRevision(key string, current, expected int64) error {
+	if expected != KVRevisionAny && current != expected {
+		return fmt.Errorf("%w: key %q has revision %d, but expected %d", ErrKVRevision, key, current, expected)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package jwkset
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestKVKeyDelete(t *testing.T) {
+	testStorageKeyDelete(t, setupKV())
+}
+
+func TestKVKeyRead(t *testing.T) {
+	testStorageKeyRead(t, setupKV())
+}
+
+func TestKVKeyReadAll(t *testing.T) {
+	testStorageKeyReadAll(t, setupKV())
+}
+
+func TestKVKeyWrite(t *testing.T) {
+	testStorageKeyWrite(t, setupKV())
+}
+
+func TestKVSharedKeyWrite(t *testing.T) {
+	testStorageSharedKeyWrite(t, setupKV())
+}
+
+func TestKVJSON(t *testing.T) {
+	params := setupKV()
+	defer params.cancel()
+	testJSON(params.ctx, t, params.jwks)
+}
+
+func TestKVConflict(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	backend := NewMemoryKVBackend()
+	replica1 := NewStorageFromKV(backend, KVStorageOptions{})
+	replica2 := NewStorageFromKV(backend, KVStorageOptions{})
+
+	testStorageConflict(ctx, t, replica1, replica2, ErrKVRevision)
+}
+
+func TestMemoryKVBackendWatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	backend := NewMemoryKVBackend()
+	watchCtx, watchCancel := context.WithCancel(ctx)
+	events, err := backend.(KVWatcher).Watch(watchCtx, "watched/")
+	if err != nil {
+		t.Fatalf("Failed to watch.\nError: %s", err)
+	}
+	_, err = backend.Put(ctx, "other/key", []byte("ignored"), KVRevisionAny)
+	if err != nil {
+		t.Fatalf("Failed to put.\nError: %s", err)
+	}
+	revision, err := backend.Put(ctx, "watched/key", []byte("value"), 0)
+	if err != nil {
+		t.Fatalf("Failed to put.\nError: %s", err)
+	}
+	ok, err := backend.Delete(ctx, "watched/key", revision)
+	if err != nil || !ok {
+		t.Fatalf("Failed to delete.\nError: %s", err)
+	}
+
+	event := <-events
+	if event.Deleted || event.Entry.Key != "watched/key" || event.Entry.Revision != revision || string(event.Entry.Value) != "value" {
+		t.Fatalf("Unexpected put event: %+v.", event)
+	}
+	event = <-events
+	if !event.Deleted || event.Entry.Key != "watched/key" {
+		t.Fatalf("Unexpected delete event: %+v.", event)
+	}
+
+	watchCancel()
+	for range events {
+		// Drain until the watch ends.
+	}
+}
+
+func TestKVWatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	backend := NewMemoryKVBackend()
+	writer := NewStorageFromKV(backend, KVStorageOptions{})
+	err := writer.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK.\nError: %s", err)
+	}
+
+	watched := NewStorageFromKV(backend, KVStorageOptions{})
+	watchCtx, watchCancel := context.WithCancel(ctx)
+	events, err := watched.(StorageWatcher).Watch(watchCtx)
+	if err != nil {
+		t.Fatalf("Failed to watch.\nError: %s", err)
+	}
+	err = writer.KeyWrite(ctx, newStorageTestJWK(t, hmacKey2, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to update the JWK.\nError: %s", err)
+	}
+	err = writer.KeyWrite(ctx, newStorageTestJWK(t, hmacKey2, kidWritten2))
+	if err != nil {
+		t.Fatalf("Failed to write the second JWK.\nError: %s", err)
+	}
+	_, err = writer.KeyDelete(ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Failed to delete the JWK.\nError: %s", err)
+	}
+
+	expected := []struct {
+		kid       string
+		eventType KeyEventType
+	}{
+		{kidWritten, KeyUpdated},
+		{kidWritten2, KeyAdded},
+		{kidWritten, KeyRemoved},
+	}
+	for _, e := range expected {
+		event := <-events
+		if event.KID != e.kid || event.Type != e.eventType {
+			t.Fatalf("Unexpected event.\n  Actual: %s %s\n  Expected: %s %s", event.Type, event.KID, e.eventType, e.kid)
+		}
+	}
+	watchCancel()
+	for range events {
+		// Drain until the watch ends.
+	}
+
+	unwatched := NewStorageFromKV(struct{ KVBackend }{backend}, KVStorageOptions{})
+	if _, ok := unwatched.(StorageWatcher); ok {
+		t.Fatalf("Expected a Storage with a KVBackend that can't watch to not implement StorageWatcher.")
+	}
+}
+
+func setupKV() (params storageTestParams) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	backend := NewMemoryKVBackend()
+	params = storageTestParams{
+		ctx:    ctx,
+		cancel: cancel,
+		jwks:   NewStorageFromKV(backend, KVStorageOptions{}),
+		shared: NewStorageFromKV(backend, KVStorageOptions{}),
+	}
+	return params
+}
@@ -0,0 +1,141 @@
+package jwkset
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// ErrPersistentCache indicates that the persistent cache of an HTTP storage could not be used.
+	ErrPersistentCache = errors.New("failed to use persistent cache")
+)
+
+// persistentCacheEntry is the content of a persistent cache file.
+type persistentCacheEntry struct {
+	Body         []byte          `json:"body,omitempty"` // Used instead of JWKS for responses that are not JSON.
+	ETag         string          `json:"etag,omitempty"`
+	Fetched      time.Time       `json:"fetched"`
+	JWKS         json.RawMessage `json:"jwks"`
+	LastModified string          `json:"lastModified,omitempty"`
+	URL          string          `json:"url"`
+}
+
+// persistentCachePath returns the path of the persistent cache file for the HTTP storage's URL.
+func (s *httpStorage) persistentCachePath() string {
+	sum := sha256.Sum256([]byte(s.u.String()))
+	return filepath.Join(s.options.PersistentCacheDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// savePersistentCache writes the last fetched JWK Set to the persistent cache. The caller must hold s.mux. Errors are
+// passed to the RefreshErrorHandler, because they do not affect the refresh itself.
+func (s *httpStorage) savePersistentCache(ctx context.Context) {
+	if s.options.PersistentCacheDir == "" {
+		return
+	}
+	entry := persistentCacheEntry{
+		ETag:         s.etag,
+		Fetched:      time.Now(),
+		LastModified: s.lastModified,
+		URL:          s.u.String(),
+	}
+	if json.Valid(s.raw) {
+		entry.JWKS = s.raw
+	} else {
+		entry.Body = s.raw
+	}
+	data, err := json.Marshal(entry)
+	if err == nil {
+		err = writeFileAtomic(s.persistentCachePath(), data, 0600)
+	}
+	if err != nil && s.options.RefreshErrorHandler != nil {
+		s.options.RefreshErrorHandler(ctx, fmt.Errorf("failed to save persistent cache: %w", errors.Join(err, ErrPersistentCache)))
+	}
+}
+
+// loadPersistentCache reconciles the Storage with the JWK Set in the persistent cache, if it is not older than the
+// PersistentCacheMaxAge option.
+func (s *httpStorage) loadPersistentCache(ctx context.Context) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	data, err := os.ReadFile(s.persistentCachePath())
+	if err != nil {
+		return fmt.Errorf("failed to read persistent cache: %w", errors.Join(err, ErrPersistentCache))
+	}
+	var entry persistentCacheEntry
+	err = json.Unmarshal(data, &entry)
+	if err != nil {
+		return fmt.Errorf("failed to decode persistent cache: %w", errors.Join(err, ErrPersistentCache))
+	}
+	if entry.URL != s.u.String() {
+		return fmt.Errorf("%w: persistent cache is for URL %q", ErrPersistentCache, entry.URL)
+	}
+	if s.options.PersistentCacheMaxAge > 0 && time.Since(entry.Fetched) > s.options.PersistentCacheMaxAge {
+		return fmt.Errorf("%w: persistent cache was fetched at %s, which exceeds the maximum age of %s", ErrPersistentCache, entry.Fetched, s.options.PersistentCacheMaxAge)
+	}
+	raw := []byte(entry.JWKS)
+	if entry.Body != nil {
+		raw = entry.Body
+	}
+	keys, err := s.options.Decoder(raw)
+	if err != nil {
+		return fmt.Errorf("failed to decode JWK Set in persistent cache: %w", errors.Join(err, ErrPersistentCache))
+	}
+	err = s.reconcile(ctx, keys)
+	if err != nil {
+		return fmt.Errorf("failed to load persistent cache into storage: %w", errors.Join(err, ErrPersistentCache))
+	}
+	s.etag = entry.ETag
+	s.fetched = keys
+	s.lastModified = entry.LastModified
+	s.raw = raw
+
+	s.statusMux.Lock()
+	s.status.ETag = entry.ETag
+	s.status.KeyCount = len(keys)
+	s.status.Succeeded = entry.Fetched
+	s.statusMux.Unlock()
+	s.resetStaleness(entry.Fetched)
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory as name, syncs it, and renames it to name, so
+// readers never observe a partially written file.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // Fails harmlessly after a successful rename.
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed to close temporary file: %w", closeErr)
+	}
+	err = os.Rename(tmp, name)
+	if err != nil {
+		return fmt.Errorf("failed to rename temporary file: %w", err)
+	}
+	if dir, err := os.Open(filepath.Dir(name)); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package jwkset
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPersistentCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverStore := NewMemoryStorage()
+	err := serverStore.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the server store.\nError: %s", err)
+	}
+	var fail atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rawJWKS, err := serverStore.JSONPrivate(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write(rawJWKS)
+	}))
+	defer server.Close()
+	u, err := url.ParseRequestURI(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse the server URL.\nError: %s", err)
+	}
+
+	var handled error
+	options := HTTPClientStorageOptions{
+		Ctx:                   ctx,
+		PersistentCacheDir:    t.TempDir(),
+		PersistentCacheMaxAge: time.Hour,
+		RefreshErrorHandler: func(_ context.Context, err error) {
+			handled = err
+		},
+	}
+	_, err = NewStorageFromHTTP(u, options)
+	if err != nil {
+		t.Fatalf("Failed to create the HTTP storage.\nError: %s", err)
+	}
+
+	fail.Store(true)
+	clientStore, handle, err := NewStorageFromHTTPWithHandle(u, options)
+	if err != nil {
+		t.Fatalf("Failed to create the HTTP storage from the persistent cache.\nError: %s", err)
+	}
+	if !errors.Is(handled, ErrInvalidHTTPStatusCode) {
+		t.Fatalf("Expected the failed first HTTP request to be handled, but got %s.", handled)
+	}
+	_, err = clientStore.KeyRead(ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Failed to read the JWK from the persistent cache.\nError: %s", err)
+	}
+	status := handle.LastRefresh()
+	if status.ETag != `"v1"` || status.KeyCount != 1 || status.Succeeded.IsZero() {
+		t.Fatalf("Unexpected status after loading the persistent cache: %+v.", status)
+	}
+
+	s := clientStore.(*httpStorage)
+	var entry persistentCacheEntry
+	data, err := os.ReadFile(s.persistentCachePath())
+	if err != nil {
+		t.Fatalf("Failed to read the persistent cache.\nError: %s", err)
+	}
+	err = json.Unmarshal(data, &entry)
+	if err != nil {
+		t.Fatalf("Failed to decode the persistent cache.\nError: %s", err)
+	}
+	entry.Fetched = time.Now().Add(-2 * time.Hour)
+	data, err = json.Marshal(entry)
+	if err != nil {
+		t.Fatalf("Failed to encode the persistent cache.\nError: %s", err)
+	}
+	err = writeFileAtomic(s.persistentCachePath(), data, 0600)
+	if err != nil {
+		t.Fatalf("Failed to write the persistent cache.\nError: %s", err)
+	}
+	_, err = NewStorageFromHTTP(u, options)
+	if !errors.Is(err, ErrPersistentCache) {
+		t.Fatalf("Expected a stale persistent cache not to be loaded, but got %v.", err)
+	}
+}
@@ -0,0 +1,76 @@
+package jwkset
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// KeyFilter describes the keys to find with QueryKeys. The zero value matches every key. Each field that is set
+// restricts the matching keys further.
+type KeyFilter struct {
+	// ALG matches keys with the algorithm (alg).
+	ALG ALG
+	// KEYOPS matches keys that have all the key operations (key_ops).
+	KEYOPS []KEYOPS
+	// KTY matches keys with the key type (kty).
+	KTY KTY
+	// Match matches keys for which it returns true. It's applied after the other fields.
+	Match func(jwk JWK) bool
+	// Thumbprint matches keys with the RFC 7638 thumbprint, as returned by JWK.Thumbprint.
+	Thumbprint string
+	// USE matches keys with the key use (use).
+	USE USE
+	// X5T matches keys with the X.509 certificate SHA-1 thumbprint (x5t).
+	X5T string
+	// X5TS256 matches keys with the X.509 certificate SHA-256 thumbprint (x5t#S256).
+	X5TS256 string
+}
+
+// Matches reports whether the key matches the filter.
+func (f KeyFilter) Matches(jwk JWK) bool {
+	marshal := jwk.Marshal()
+	switch {
+	case f.ALG != "" && marshal.ALG != f.ALG,
+		f.KTY != "" && marshal.KTY != f.KTY,
+		f.USE != "" && marshal.USE != f.USE,
+		f.X5T != "" && marshal.X5T != f.X5T,
+		f.X5TS256 != "" && marshal.X5TS256 != f.X5TS256:
+		return false
+	}
+	for _, op := range f.KEYOPS {
+		if !slices.Contains(marshal.KEYOPS, op) {
+			return false
+		}
+	}
+	if f.Thumbprint != "" {
+		thumbprint, err := jwk.Thumbprint()
+		if err != nil || thumbprint != f.Thumbprint {
+			return false
+		}
+	}
+	return f.Match == nil || f.Match(jwk)
+}
+
+// KeyQuery is optionally implemented by a Storage that can find the keys matching a KeyFilter more efficiently than
+// filtering KeyReadAll, such as the in-memory Storage, the JWK Set client, and the Storage created by
+// NewStorageFromSQL.
+type KeyQuery interface {
+	// KeyQuery returns the keys matching the filter, in the same order as KeyReadAll.
+	KeyQuery(ctx context.Context, filter KeyFilter) ([]JWK, error)
+}
+
+// QueryKeys returns the keys in the Storage that match the filter, in the same order as KeyReadAll. It uses KeyQuery if
+// the Storage implements it and filters KeyReadAll otherwise.
+func QueryKeys(ctx context.Context, storage Storage, filter KeyFilter) ([]JWK, error) {
+	if query, ok := storage.(KeyQuery); ok {
+		return query.KeyQuery(ctx, filter)
+	}
+	keys, err := storage.KeyReadAll(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot of all keys from storage: %w", err)
+	}
+	return slices.DeleteFunc(keys, func(jwk JWK) bool {
+		return !filter.Matches(jwk)
+	}), nil
+}
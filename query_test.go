@@ -0,0 +1,119 @@
+package jwkset
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMemoryKeyQuery(t *testing.T) {
+	params := setupMemory()
+	if _, ok := params.jwks.(KeyQuery); !ok {
+		t.Fatalf("Expected the memory storage to implement KeyQuery.")
+	}
+	testStorageKeyQuery(t, params)
+}
+
+func TestQueryKeysFallback(t *testing.T) {
+	params := setupMemory()
+	params.jwks = unqueriedStorage{params.jwks}
+	testStorageKeyQuery(t, params)
+}
+
+func testStorageKeyQuery(t *testing.T, params storageTestParams) {
+	defer params.cancel()
+	store := params.jwks
+
+	write := func(key any, metadata JWKMetadataOptions, certs ...*x509.Certificate) JWK {
+		options := JWKOptions{
+			Marshal: JWKMarshalOptions{
+				Private: true,
+			},
+			Metadata: metadata,
+			X509: JWKX509Options{
+				X5C: certs,
+			},
+		}
+		jwk, err := NewJWKFromKey(key, options)
+		if err != nil {
+			t.Fatalf("Failed to create the JWK %q.\nError: %s", metadata.KID, err)
+		}
+		err = store.KeyWrite(params.ctx, jwk)
+		if err != nil {
+			t.Fatalf("Failed to write the JWK.\nError: %s", err)
+		}
+		return jwk
+	}
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate the Ed25519 key.\nError: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "query"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, public, private)
+	if err != nil {
+		t.Fatalf("Failed to create a certificate.\nError: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse the certificate.\nError: %s", err)
+	}
+
+	write(hmacKey1, JWKMetadataOptions{ALG: AlgHS256, KID: kidWritten, USE: UseSig})
+	write(hmacKey2, JWKMetadataOptions{ALG: AlgHS512, KEYOPS: []KEYOPS{KeyOpsEncrypt}, KID: kidWritten2, USE: UseEnc})
+	ed := write(private, JWKMetadataOptions{ALG: AlgEdDSA, KEYOPS: []KEYOPS{KeyOpsSign, KeyOpsVerify}, KID: "ed"}, cert)
+	thumbprint, err := ed.Thumbprint()
+	if err != nil {
+		t.Fatalf("Failed to compute the thumbprint.\nError: %s", err)
+	}
+
+	tc := []struct {
+		name   string
+		filter KeyFilter
+		kids   []string
+	}{
+		{name: "All", kids: []string{kidWritten, kidWritten2, "ed"}},
+		{name: "ALG", filter: KeyFilter{ALG: AlgHS512}, kids: []string{kidWritten2}},
+		{name: "KEYOPS", filter: KeyFilter{KEYOPS: []KEYOPS{KeyOpsVerify, KeyOpsSign}}, kids: []string{"ed"}},
+		{name: "KEYOPS missing", filter: KeyFilter{KEYOPS: []KEYOPS{KeyOpsSign, KeyOpsEncrypt}}},
+		{name: "KTY", filter: KeyFilter{KTY: KtyOct}, kids: []string{kidWritten, kidWritten2}},
+		{name: "KTY and USE", filter: KeyFilter{KTY: KtyOct, USE: UseEnc}, kids: []string{kidWritten2}},
+		{name: "Match", filter: KeyFilter{Match: func(jwk JWK) bool {
+			return jwk.Marshal().KID != kidWritten
+		}}, kids: []string{kidWritten2, "ed"}},
+		{name: "Thumbprint", filter: KeyFilter{Thumbprint: thumbprint}, kids: []string{"ed"}},
+		{name: "Thumbprint missing", filter: KeyFilter{KTY: KtyOct, Thumbprint: thumbprint}},
+		{name: "X5T", filter: KeyFilter{X5T: ed.Marshal().X5T}, kids: []string{"ed"}},
+		{name: "X5TS256", filter: KeyFilter{X5TS256: ed.Marshal().X5TS256}, kids: []string{"ed"}},
+		{name: "X5TS256 missing", filter: KeyFilter{X5TS256: "missing"}},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := QueryKeys(params.ctx, store, tt.filter)
+			if err != nil {
+				t.Fatalf("Failed to query the keys.\nError: %s", err)
+			}
+			var kids []string
+			for _, jwk := range keys {
+				kids = append(kids, jwk.Marshal().KID)
+			}
+			if !slices.Equal(kids, tt.kids) {
+				t.Fatalf("Expected key IDs %q, but got %q.", tt.kids, kids)
+			}
+		})
+	}
+}
+
+// unqueriedStorage hides the KeyQuery implementation of a Storage.
+type unqueriedStorage struct {
+	Storage
+}
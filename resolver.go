@@ -0,0 +1,375 @@
+package jwkset
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	// ErrIssuerNotAllowed indicates that an issuer is not in the allowlist of an IssuerResolver.
+	ErrIssuerNotAllowed = errors.New("issuer is not allowed")
+)
+
+// IssuerResolverOptions are used to configure the behavior of NewIssuerResolver.
+type IssuerResolverOptions struct {
+	// Ctx is used to end the refresh goroutines of all JWK Set Storages when they're no longer needed.
+	//
+	// This defaults to context.Background().
+	Ctx context.Context
+
+	// Discovery are the options used to find the JWK Set of an issuer that has no JWK Set URL in the allowlist. Its Ctx
+	// and Storage options are replaced by the Ctx and Storage options of these options.
+	Discovery DiscoveryOptions
+
+	// FailureCacheDuration is the amount of time an error creating the JWK Set Storage of an issuer is returned again
+	// without another attempt, so JWTs with the iss of a failing issuer don't cause a request each. A negative value
+	// disables it.
+	//
+	// This defaults to 30 seconds.
+	FailureCacheDuration time.Duration
+
+	// IdleTimeout is the amount of time after which the JWK Set Storage of an issuer that was not used is closed. It is
+	// created again when it is next used. A negative value disables it.
+	//
+	// This defaults to 1 hour.
+	IdleTimeout time.Duration
+
+	// Issuers is the allowlist of trusted issuers. It maps each issuer to the URL of its JWK Set. If the URL is empty, it
+	// is discovered with NewStorageFromIssuer.
+	Issuers map[string]string
+
+	// MaxIssuers is the maximum number of JWK Set Storages kept at once. When it's exceeded, the Storage of the least
+	// recently used issuer is closed and created again when it is next used.
+	//
+	// This defaults to 100.
+	MaxIssuers int
+
+	// RefreshUnknownKIDInterval is the rate limit for refreshing the JWK Set of an issuer when a key with an unknown key
+	// ID is trying to be read. Each issuer has its own rate limit. Key IDs that are still unknown after a refresh do not
+	// trigger another refresh for the same amount of time.
+	//
+	// By default, unknown key IDs do not trigger a refresh.
+	RefreshUnknownKIDInterval time.Duration
+
+	// Storage are the options for the JWK Set Storage of each issuer. Its Ctx option is replaced by a context that ends
+	// when the Storage is evicted.
+	Storage HTTPClientStorageOptions
+}
+
+// IssuerResolver reads keys by issuer and key ID, so the keys of one issuer cannot verify the JWTs of another. This is
+// meant for multi-tenant services that trust many issuers. A JWK Set Storage is created for an issuer the first time
+// one of its keys is read.
+type IssuerResolver struct {
+	options IssuerResolverOptions
+	ctx     context.Context
+	cancel  context.CancelFunc
+	flight  *flightGroup
+	now     func() time.Time
+
+	mux      sync.Mutex
+	failures map[string]issuerResolverFailure
+	issuers  map[string]string
+	lru      *list.List // Most recently used first.
+	stores   map[string]*list.Element
+}
+
+type issuerResolverEntry struct {
+	cancel   context.CancelFunc
+	issuer   string
+	lastUsed time.Time
+	store    Storage
+}
+
+type issuerResolverFailure struct {
+	err     error
+	expires time.Time
+}
+
+// NewIssuerResolver creates a new IssuerResolver.
+func NewIssuerResolver(options IssuerResolverOptions) (*IssuerResolver, error) {
+	if options.Ctx == nil {
+		options.Ctx = context.Background()
+	}
+	if options.MaxIssuers == 0 {
+		options.MaxIssuers = 100
+	}
+	if options.MaxIssuers < 0 {
+		return nil, fmt.Errorf("%w: MaxIssuers must not be negative", ErrOptions)
+	}
+	if options.FailureCacheDuration == 0 {
+		options.FailureCacheDuration = 30 * time.Second
+	}
+	if options.IdleTimeout == 0 {
+		options.IdleTimeout = time.Hour
+	}
+	issuers := make(map[string]string, len(options.Issuers))
+	for issuer, u := range options.Issuers {
+		err := checkIssuerJWKSURL(issuer, u)
+		if err != nil {
+			return nil, err
+		}
+		issuers[issuer] = u
+	}
+	ctx, cancel := context.WithCancel(options.Ctx)
+	r := &IssuerResolver{
+		options:  options,
+		ctx:      ctx,
+		cancel:   cancel,
+		flight:   &flightGroup{stop: ctx},
+		now:      time.Now,
+		failures: make(map[string]issuerResolverFailure),
+		issuers:  issuers,
+		lru:      list.New(),
+		stores:   make(map[string]*list.Element),
+	}
+
+	if options.IdleTimeout > 0 {
+		go func() { // Idle eviction goroutine.
+			ticker := time.NewTicker(options.IdleTimeout / 2)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					r.evictIdle()
+				}
+			}
+		}()
+	}
+	return r, nil
+}
+
+// AllowIssuer adds the issuer to the allowlist with the URL of its JWK Set. If the URL is empty, it is discovered. If
+// the issuer was already allowed with a different URL, its Storage is closed.
+func (r *IssuerResolver) AllowIssuer(issuer, jwksURL string) error {
+	err := checkIssuerJWKSURL(issuer, jwksURL)
+	if err != nil {
+		return err
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if u, ok := r.issuers[issuer]; ok && u != jwksURL {
+		r.evict(issuer)
+		delete(r.failures, issuer)
+	}
+	r.issuers[issuer] = jwksURL
+	return nil
+}
+
+// RemoveIssuer removes the issuer from the allowlist and closes its Storage.
+func (r *IssuerResolver) RemoveIssuer(issuer string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	delete(r.issuers, issuer)
+	delete(r.failures, issuer)
+	r.evict(issuer)
+}
+
+// Issuers returns the allowlist of issuers in sorted order.
+func (r *IssuerResolver) Issuers() []string {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	issuers := make([]string, 0, len(r.issuers))
+	for issuer := range r.issuers {
+		issuers = append(issuers, issuer)
+	}
+	slices.Sort(issuers)
+	return issuers
+}
+
+// KeyRead reads the key with the given key ID from the JWK Set of the given issuer, such as the iss claim of the JWT
+// being verified.
+func (r *IssuerResolver) KeyRead(ctx context.Context, issuer, keyID string) (JWK, error) {
+	store, err := r.Storage(ctx, issuer)
+	if err != nil {
+		return JWK{}, err
+	}
+	return store.KeyRead(ctx, keyID)
+}
+
+// Storage returns the JWK Set Storage of the given issuer, creating it if needed. The returned Storage should not be
+// kept, because it stops refreshing when it is evicted.
+func (r *IssuerResolver) Storage(ctx context.Context, issuer string) (Storage, error) {
+	store, ok, err := r.get(issuer)
+	if err != nil || ok {
+		return store, err
+	}
+	err = r.flight.do(ctx, issuer, func(context.Context) error {
+		return r.create(issuer)
+	})
+	if err != nil {
+		return nil, err
+	}
+	store, ok, err = r.get(issuer)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: issuer %q was removed", ErrIssuerNotAllowed, issuer)
+	}
+	return store, nil
+}
+
+// Close closes the Storages of all issuers. The IssuerResolver must not be used afterward.
+func (r *IssuerResolver) Close() {
+	r.cancel()
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	clear(r.stores)
+	clear(r.failures)
+	r.lru.Init()
+}
+
+// get returns the Storage of an allowed issuer, if it exists, and marks it as recently used. If the Storage recently
+// failed to be created, it returns the cached error.
+func (r *IssuerResolver) get(issuer string) (Storage, bool, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if _, ok := r.issuers[issuer]; !ok {
+		return nil, false, fmt.Errorf("%w: %q", ErrIssuerNotAllowed, issuer)
+	}
+	elem, ok := r.stores[issuer]
+	if !ok {
+		if failure, ok := r.failures[issuer]; ok {
+			if r.now().Before(failure.expires) {
+				return nil, false, failure.err
+			}
+			delete(r.failures, issuer)
+		}
+		return nil, false, nil
+	}
+	r.lru.MoveToFront(elem)
+	entry := elem.Value.(*issuerResolverEntry)
+	entry.lastUsed = r.now()
+	return entry.store, true, nil
+}
+
+// create creates the Storage of an allowed issuer and evicts the least recently used Storages beyond MaxIssuers.
+func (r *IssuerResolver) create(issuer string) error {
+	r.mux.Lock()
+	jwksURL, ok := r.issuers[issuer]
+	_, exists := r.stores[issuer]
+	r.mux.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrIssuerNotAllowed, issuer)
+	}
+	if exists {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(r.ctx)
+	storageOptions := r.options.Storage
+	storageOptions.Ctx = ctx
+	var store Storage
+	var err error
+	if jwksURL == "" {
+		discoveryOptions := r.options.Discovery
+		discoveryOptions.Ctx = ctx
+		discoveryOptions.Storage = storageOptions
+		store, err = NewStorageFromIssuer(issuer, discoveryOptions)
+	} else {
+		var u *url.URL
+		u, err = url.ParseRequestURI(jwksURL)
+		if err == nil {
+			store, err = NewStorageFromHTTP(u, storageOptions)
+		}
+	}
+	if err != nil {
+		cancel()
+		return r.fail(issuer, jwksURL, fmt.Errorf("failed to create JWK Set storage for issuer %q: %w", issuer, err))
+	}
+	if r.options.RefreshUnknownKIDInterval > 0 {
+		store, err = NewHTTPClient(HTTPClientOptions{
+			RefreshUnknownKID: rate.NewLimiter(rate.Every(r.options.RefreshUnknownKIDInterval), 1),
+			Sources: []HTTPSource{
+				{Issuer: issuer, Name: issuer, Storage: store, URL: jwksURL},
+			},
+			UnknownKIDCacheDuration: r.options.RefreshUnknownKIDInterval,
+		})
+		if err != nil {
+			cancel()
+			return r.fail(issuer, jwksURL, fmt.Errorf("failed to create JWK Set client for issuer %q: %w", issuer, err))
+		}
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if u, ok := r.issuers[issuer]; !ok || u != jwksURL {
+		cancel() // The allowlist changed while the Storage was created.
+		return nil
+	}
+	r.stores[issuer] = r.lru.PushFront(&issuerResolverEntry{
+		cancel:   cancel,
+		issuer:   issuer,
+		lastUsed: r.now(),
+		store:    store,
+	})
+	for r.lru.Len() > r.options.MaxIssuers {
+		r.evict(r.lru.Back().Value.(*issuerResolverEntry).issuer)
+	}
+	return nil
+}
+
+// fail caches the error of creating the Storage of the issuer, unless the allowlist changed meanwhile, and returns it.
+func (r *IssuerResolver) fail(issuer, jwksURL string, err error) error {
+	if r.options.FailureCacheDuration < 0 {
+		return err
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if u, ok := r.issuers[issuer]; ok && u == jwksURL {
+		r.failures[issuer] = issuerResolverFailure{
+			err:     err,
+			expires: r.now().Add(r.options.FailureCacheDuration),
+		}
+	}
+	return err
+}
+
+// evictIdle closes the Storages of the issuers that were not used within IdleTimeout.
+func (r *IssuerResolver) evictIdle() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	idleSince := r.now().Add(-r.options.IdleTimeout)
+	for elem := r.lru.Back(); elem != nil; elem = r.lru.Back() {
+		entry := elem.Value.(*issuerResolverEntry)
+		if entry.lastUsed.After(idleSince) {
+			return // The remaining Storages were used more recently.
+		}
+		r.evict(entry.issuer)
+	}
+}
+
+// evict closes the Storage of the issuer, if it exists. The caller must hold r.mux.
+func (r *IssuerResolver) evict(issuer string) {
+	elem, ok := r.stores[issuer]
+	if !ok {
+		return
+	}
+	elem.Value.(*issuerResolverEntry).cancel()
+	r.lru.Remove(elem)
+	delete(r.stores, issuer)
+}
+
+func checkIssuerJWKSURL(issuer, jwksURL string) error {
+	if issuer == "" {
+		return fmt.Errorf("%w: issuer must not be empty", ErrOptions)
+	}
+	if jwksURL == "" {
+		return nil
+	}
+	_, err := url.ParseRequestURI(jwksURL)
+	if err != nil {
+		return fmt.Errorf("failed to parse JWK Set URL %q of issuer %q: %w", jwksURL, issuer, errors.Join(err, ErrOptions))
+	}
+	return nil
+}
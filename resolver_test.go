@@ -0,0 +1,170 @@
+package jwkset
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIssuerResolver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newServer := func(key []byte, requests *atomic.Int64) *httptest.Server {
+		serverStore := NewMemoryStorage()
+		err := serverStore.KeyWrite(ctx, newStorageTestJWK(t, key, kidWritten))
+		if err != nil {
+			t.Fatalf("Failed to write the JWK to the server store.\nError: %s", err)
+		}
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			rawJWKS, err := serverStore.JSONPrivate(r.Context())
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = w.Write(rawJWKS)
+		}))
+	}
+	var requestsA, requestsB atomic.Int64
+	serverA := newServer(hmacKey1, &requestsA)
+	defer serverA.Close()
+	serverB := newServer(hmacKey2, &requestsB)
+	defer serverB.Close()
+
+	const (
+		issuerA = "https://a.example.com"
+		issuerB = "https://b.example.com"
+	)
+	r, err := NewIssuerResolver(IssuerResolverOptions{
+		Ctx: ctx,
+		Issuers: map[string]string{
+			issuerA: serverA.URL,
+		},
+		MaxIssuers: 1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the issuer resolver.\nError: %s", err)
+	}
+	defer r.Close()
+
+	_, err = r.KeyRead(ctx, issuerB, kidWritten)
+	if !errors.Is(err, ErrIssuerNotAllowed) {
+		t.Fatalf("Expected an issuer not allowed error, but got %s.", err)
+	}
+	err = r.AllowIssuer(issuerB, serverB.URL)
+	if err != nil {
+		t.Fatalf("Failed to allow the issuer.\nError: %s", err)
+	}
+
+	for _, tc := range []struct {
+		issuer   string
+		key      []byte
+		requests *atomic.Int64
+		expected int64
+	}{
+		{issuer: issuerA, key: hmacKey1, requests: &requestsA, expected: 1},
+		{issuer: issuerA, key: hmacKey1, requests: &requestsA, expected: 1},
+		{issuer: issuerB, key: hmacKey2, requests: &requestsB, expected: 1},
+		{issuer: issuerA, key: hmacKey1, requests: &requestsA, expected: 2}, // Evicted by issuer B.
+	} {
+		jwk, err := r.KeyRead(ctx, tc.issuer, kidWritten)
+		if err != nil {
+			t.Fatalf("Failed to read the JWK of issuer %q.\nError: %s", tc.issuer, err)
+		}
+		if !bytes.Equal(jwk.Key().([]byte), tc.key) {
+			t.Fatalf("Expected the key of issuer %q.", tc.issuer)
+		}
+		if tc.requests.Load() != tc.expected {
+			t.Fatalf("Expected %d requests for issuer %q, but got %d.", tc.expected, tc.issuer, tc.requests.Load())
+		}
+	}
+
+	r.RemoveIssuer(issuerA)
+	_, err = r.KeyRead(ctx, issuerA, kidWritten)
+	if !errors.Is(err, ErrIssuerNotAllowed) {
+		t.Fatalf("Expected an issuer not allowed error after removal, but got %s.", err)
+	}
+	issuers := r.Issuers()
+	if len(issuers) != 1 || issuers[0] != issuerB {
+		t.Fatalf("Unexpected issuers: %v.", issuers)
+	}
+}
+
+func TestIssuerResolverIdleAndFailures(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverStore := NewMemoryStorage()
+	err := serverStore.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the server store.\nError: %s", err)
+	}
+	var requests atomic.Int64
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rawJWKS, err := serverStore.JSONPrivate(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(rawJWKS)
+	}))
+	defer server.Close()
+
+	const issuer = "https://a.example.com"
+	r, err := NewIssuerResolver(IssuerResolverOptions{
+		Ctx:     ctx,
+		Issuers: map[string]string{issuer: server.URL},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the issuer resolver.\nError: %s", err)
+	}
+	defer r.Close()
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	read := func(expected int64) error {
+		_, err := r.KeyRead(ctx, issuer, kidWritten)
+		if actual := requests.Load(); actual != expected {
+			t.Fatalf("Expected %d requests in total, but got %d.", expected, actual)
+		}
+		return err
+	}
+
+	failing.Store(true)
+	for i := 0; i < 2; i++ {
+		err = read(1)
+		if err == nil {
+			t.Fatalf("Expected an error while the JWK Set is unavailable.")
+		}
+	}
+	now = now.Add(time.Minute)
+	failing.Store(false)
+	err = read(2)
+	if err != nil {
+		t.Fatalf("Failed to read the JWK after the cached failure expired.\nError: %s", err)
+	}
+
+	now = now.Add(30 * time.Minute)
+	r.evictIdle()
+	err = read(2)
+	if err != nil {
+		t.Fatalf("Failed to read the JWK.\nError: %s", err)
+	}
+	now = now.Add(2 * time.Hour)
+	r.evictIdle()
+	err = read(3)
+	if err != nil {
+		t.Fatalf("Failed to read the JWK after the idle Storage was evicted.\nError: %s", err)
+	}
+}
@@ -0,0 +1,452 @@
+package jwkset
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrRotation indicates that the RotationManager could not read or change the keys or its state.
+	ErrRotation = errors.New("failed to rotate keys")
+)
+
+// KeyState is the lifecycle state of a key managed by a RotationManager.
+type KeyState string
+
+const (
+	// KeyStatePending is a key that is published, but not yet used for signing, so verifiers can fetch it before it's
+	// used.
+	KeyStatePending KeyState = "pending"
+	// KeyStateActive is the key used for signing.
+	KeyStateActive KeyState = "active"
+	// KeyStateRetired is a key that is no longer used for signing, but still published so verifiers can verify
+	// signatures made before it was retired. It's deleted after its grace period.
+	KeyStateRetired KeyState = "retired"
+)
+
+// KeyLifecycle is the lifecycle metadata of a key managed by a RotationManager.
+type KeyLifecycle struct {
+	// Activated is when the key becomes or became the active signing key.
+	Activated time.Time `json:"activated"`
+	// Created is when the key was generated and published.
+	Created time.Time `json:"created"`
+	// DeleteAfter is when the retired key is deleted. It's zero until the key is retired.
+	DeleteAfter time.Time `json:"deleteAfter,omitempty"`
+	// KID is the key ID of the key.
+	KID string `json:"kid"`
+	// Retired is when the key stopped being the active signing key. It's zero until the key is retired.
+	Retired time.Time `json:"retired,omitempty"`
+}
+
+// State returns the state of the key at the given time.
+func (k KeyLifecycle) State(now time.Time) KeyState {
+	switch {
+	case !k.Retired.IsZero() && !now.Before(k.Retired):
+		return KeyStateRetired
+	case now.Before(k.Activated):
+		return KeyStatePending
+	}
+	return KeyStateActive
+}
+
+// rotationState is the persisted state of a RotationManager.
+type rotationState struct {
+	Keys []KeyLifecycle `json:"keys"`
+}
+
+// active returns the index of the key activated most recently before the given time, or -1 if there is none. Keys that
+// were active before it are retired at the next check.
+func (s rotationState) active(now time.Time) int {
+	active := -1
+	for i, lifecycle := range s.Keys {
+		if lifecycle.State(now) == KeyStateActive && (active == -1 || !lifecycle.Activated.Before(s.Keys[active].Activated)) {
+			active = i
+		}
+	}
+	return active
+}
+
+// RotationOptions are used to configure the behavior of NewRotationManager.
+type RotationOptions struct {
+	// ALG is the algorithm of generated keys. It's ignored if Generate is set.
+	//
+	// This defaults to ES256.
+	ALG ALG
+
+	// CheckInterval is the interval at which the RotationManager checks if a key should be published, activated, or
+	// deleted. A negative value disables the schedule, so only Rotate changes the keys.
+	//
+	// This defaults to 1 minute.
+	CheckInterval time.Duration
+
+	// Ctx is used to end the schedule goroutine when it's no longer needed.
+	//
+	// This defaults to context.Background().
+	Ctx context.Context
+
+	// ErrorHandler is a function that consumes errors that happen during scheduled checks.
+	ErrorHandler func(ctx context.Context, err error)
+
+	// Generate is a function that generates the next key. It must include the private key material. Keys without a key
+	// ID are given their RFC 7638 thumbprint as key ID.
+	//
+	// This defaults to generating a signing key for ALG.
+	Generate func(ctx context.Context) (JWK, error)
+
+	// GracePeriod is how long a retired key stays published, so signatures made before it was retired can be verified.
+	// It should be longer than the lifetime of the signed tokens.
+	//
+	// This defaults to 24 hours.
+	GracePeriod time.Duration
+
+	// PrePublish is how long before its activation the next key is generated and published. It should be longer than
+	// the time verifiers cache the JWK Set.
+	//
+	// This defaults to 24 hours.
+	PrePublish time.Duration
+
+	// RotationInterval is how long a key is the active signing key.
+	//
+	// This defaults to 30 days.
+	RotationInterval time.Duration
+
+	// StateStore persists the lifecycle of the managed keys. It is required. It must persist as long as the Storage for a
+	// new RotationManager to continue the schedule, such as NewFileRotationStateStore for a Storage backed by files.
+	// NewMemoryRotationStateStore is only suitable for an in-memory Storage.
+	StateStore RotationStateStore
+}
+
+// RotationStateStore persists the lifecycle of the keys managed by a RotationManager. It's kept apart from the Storage,
+// so the state is never mistaken for a key.
+type RotationStateStore interface {
+	// ReadState returns the lifecycle of the managed keys. It returns no lifecycles if no state was written yet.
+	ReadState(ctx context.Context) ([]KeyLifecycle, error)
+	// WriteState replaces the lifecycle of the managed keys.
+	WriteState(ctx context.Context, keys []KeyLifecycle) error
+}
+
+// RotationManager generates, activates, retires, and deletes the keys in a Storage on a schedule. The next key is
+// published PrePublish before it becomes the active signing key, and retired keys stay published for GracePeriod. The
+// lifecycle of each key is persisted in the RotationStateStore, so a new RotationManager for the same Storage and
+// RotationStateStore continues the schedule. Only one RotationManager should manage a Storage at a time. Keys in the
+// Storage that the RotationManager didn't create are left alone.
+//
+// Sign with the key returned by Active, or set SigningKeyOptions.Rotation for SelectSigningKey. By default,
+// SelectSigningKey prefers the newest key in the Storage, which is the pending key while the next key is pre-published.
+type RotationManager struct {
+	mux     sync.Mutex
+	now     func() time.Time
+	options RotationOptions
+	storage Storage
+}
+
+// NewRotationManager creates a new RotationManager for the Storage. If the Storage has no active key, one is generated
+// and activated immediately.
+func NewRotationManager(storage Storage, options RotationOptions) (*RotationManager, error) {
+	if options.StateStore == nil {
+		return nil, fmt.Errorf("%w: a rotation state store is required", ErrOptions)
+	}
+	if options.ALG == "" {
+		options.ALG = AlgES256
+	}
+	if options.CheckInterval == 0 {
+		options.CheckInterval = time.Minute
+	}
+	if options.Ctx == nil {
+		options.Ctx = context.Background()
+	}
+	if options.Generate == nil {
+		alg := options.ALG
+		options.Generate = func(context.Context) (JWK, error) {
+			key, err := generateKey(alg)
+			if err != nil {
+				return JWK{}, err
+			}
+			jwkOptions := JWKOptions{
+				Marshal: JWKMarshalOptions{
+					Private: true,
+				},
+				Metadata: JWKMetadataOptions{
+					ALG: alg,
+					USE: UseSig,
+				},
+			}
+			return NewJWKFromKey(key, jwkOptions)
+		}
+	}
+	if options.GracePeriod == 0 {
+		options.GracePeriod = 24 * time.Hour
+	}
+	if options.PrePublish == 0 {
+		options.PrePublish = 24 * time.Hour
+	}
+	if options.RotationInterval == 0 {
+		options.RotationInterval = 30 * 24 * time.Hour
+	}
+	r := &RotationManager{
+		now:     time.Now,
+		options: options,
+		storage: storage,
+	}
+	err := r.check(options.Ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.CheckInterval > 0 {
+		go func() { // Schedule goroutine.
+			ticker := time.NewTicker(options.CheckInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-options.Ctx.Done():
+					return
+				case <-ticker.C:
+					err := r.check(options.Ctx, false)
+					if err != nil && options.ErrorHandler != nil {
+						options.ErrorHandler(options.Ctx, err)
+					}
+				}
+			}
+		}()
+	}
+	return r, nil
+}
+
+// Active returns the active signing key.
+func (r *RotationManager) Active(ctx context.Context) (JWK, error) {
+	kid, err := r.activeKID(ctx)
+	if err != nil {
+		return JWK{}, err
+	}
+	return r.storage.KeyRead(ctx, kid)
+}
+
+func (r *RotationManager) activeKID(ctx context.Context) (string, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	state, err := r.readState(ctx)
+	if err != nil {
+		return "", err
+	}
+	active := state.active(r.now())
+	if active == -1 {
+		return "", fmt.Errorf("%w: no active key", ErrKeyNotFound)
+	}
+	return state.Keys[active].KID, nil
+}
+
+// Keys returns the lifecycle of the managed keys, in the order they were created.
+func (r *RotationManager) Keys(ctx context.Context) ([]KeyLifecycle, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	state, err := r.readState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return state.Keys, nil
+}
+
+// Rotate immediately retires the active key and activates the next key. If no next key was published yet, one is
+// generated. Prefer the schedule, because verifiers that cached the JWK Set before the next key was published can't
+// verify signatures made with it until they refresh.
+func (r *RotationManager) Rotate(ctx context.Context) error {
+	return r.check(ctx, true)
+}
+
+// check brings the keys up to date with the schedule. If force is true, the next key is activated now.
+func (r *RotationManager) check(ctx context.Context, force bool) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	now := r.now().UTC()
+	state, err := r.readState(ctx)
+	if err != nil {
+		return err
+	}
+	changed := false
+
+	active, pending := state.active(now), -1
+	for i, lifecycle := range state.Keys {
+		if lifecycle.State(now) == KeyStatePending && (pending == -1 || lifecycle.Activated.Before(state.Keys[pending].Activated)) {
+			pending = i
+		}
+	}
+	switch {
+	case pending != -1 && (force || active == -1):
+		state.Keys[pending].Activated = now
+		changed = true
+	case force || active == -1:
+		err = r.generate(ctx, &state, now)
+		if err != nil {
+			return err
+		}
+		changed = true
+	case pending == -1:
+		activated := state.Keys[active].Activated.Add(r.options.RotationInterval)
+		if now.Before(activated.Add(-r.options.PrePublish)) {
+			break
+		}
+		if activated.Before(now) {
+			activated = now
+		}
+		err = r.generate(ctx, &state, activated)
+		if err != nil {
+			return err
+		}
+		changed = true
+	}
+
+	// Retire the keys that were active before the newest active key.
+	active = state.active(now)
+	for i := range state.Keys {
+		lifecycle := &state.Keys[i]
+		if i == active || lifecycle.State(now) != KeyStateActive {
+			continue
+		}
+		lifecycle.Retired = state.Keys[active].Activated
+		lifecycle.DeleteAfter = lifecycle.Retired.Add(r.options.GracePeriod)
+		changed = true
+	}
+
+	keys := state.Keys[:0]
+	for _, lifecycle := range state.Keys {
+		if lifecycle.DeleteAfter.IsZero() || now.Before(lifecycle.DeleteAfter) {
+			keys = append(keys, lifecycle)
+			continue
+		}
+		_, err = r.storage.KeyDelete(ctx, lifecycle.KID)
+		if err != nil {
+			return fmt.Errorf("failed to delete retired key %q: %w", lifecycle.KID, errors.Join(err, ErrRotation))
+		}
+		changed = true
+	}
+	state.Keys = keys
+
+	if !changed {
+		return nil
+	}
+	return r.writeState(ctx, state)
+}
+
+// generate generates, publishes, and adds a key to the state.
+func (r *RotationManager) generate(ctx context.Context, state *rotationState, activated time.Time) error {
+	jwk, err := r.options.Generate(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", errors.Join(err, ErrRotation))
+	}
+	if jwk.Marshal().KID == "" {
+		jwk, err = withThumbprintKeyID(jwk)
+		if err != nil {
+			return fmt.Errorf("failed to set key ID of generated key: %w", errors.Join(err, ErrRotation))
+		}
+	}
+	err = r.storage.KeyWrite(ctx, jwk)
+	if err != nil {
+		return fmt.Errorf("failed to write generated key: %w", errors.Join(err, ErrRotation))
+	}
+	state.Keys = append(state.Keys, KeyLifecycle{
+		Activated: activated,
+		Created:   r.now().UTC(),
+		KID:       jwk.Marshal().KID,
+	})
+	return nil
+}
+
+// readState reads the state from the RotationStateStore. Keys that are no longer in the Storage are left out, so a
+// failure between deleting a key and writing the state doesn't leave it in the state.
+func (r *RotationManager) readState(ctx context.Context) (rotationState, error) {
+	var state rotationState
+	keys, err := r.options.StateStore.ReadState(ctx)
+	if err != nil {
+		return state, fmt.Errorf("failed to read rotation state: %w", errors.Join(err, ErrRotation))
+	}
+	for _, lifecycle := range keys {
+		_, err = r.storage.KeyRead(ctx, lifecycle.KID)
+		if errors.Is(err, ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return state, fmt.Errorf("failed to read managed key %q: %w", lifecycle.KID, errors.Join(err, ErrRotation))
+		}
+		state.Keys = append(state.Keys, lifecycle)
+	}
+	return state, nil
+}
+
+func (r *RotationManager) writeState(ctx context.Context, state rotationState) error {
+	err := r.options.StateStore.WriteState(ctx, state.Keys)
+	if err != nil {
+		return fmt.Errorf("failed to write rotation state: %w", errors.Join(err, ErrRotation))
+	}
+	return nil
+}
+
+// memoryRotationStateStore is an in-memory RotationStateStore.
+type memoryRotationStateStore struct {
+	mux  sync.Mutex
+	keys []KeyLifecycle
+}
+
+// NewMemoryRotationStateStore creates a new in-memory RotationStateStore. The state is lost when the process exits.
+func NewMemoryRotationStateStore() RotationStateStore {
+	return &memoryRotationStateStore{}
+}
+
+func (m *memoryRotationStateStore) ReadState(context.Context) ([]KeyLifecycle, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return slices.Clone(m.keys), nil
+}
+func (m *memoryRotationStateStore) WriteState(_ context.Context, keys []KeyLifecycle) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.keys = slices.Clone(keys)
+	return nil
+}
+
+// fileRotationStateStore is a RotationStateStore backed by a JSON file.
+type fileRotationStateStore struct {
+	name string
+}
+
+// NewFileRotationStateStore creates a new RotationStateStore that persists the state as JSON in the named file. The
+// file is replaced atomically on every write and is created if it doesn't exist.
+func NewFileRotationStateStore(name string) RotationStateStore {
+	return &fileRotationStateStore{
+		name: name,
+	}
+}
+
+func (f *fileRotationStateStore) ReadState(context.Context) ([]KeyLifecycle, error) {
+	data, err := os.ReadFile(f.name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rotation state file: %w", err)
+	}
+	var state rotationState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode rotation state file: %w", err)
+	}
+	return state.Keys, nil
+}
+func (f *fileRotationStateStore) WriteState(_ context.Context, keys []KeyLifecycle) error {
+	data, err := json.Marshal(rotationState{Keys: keys})
+	if err != nil {
+		return fmt.Errorf("failed to encode rotation state: %w", err)
+	}
+	err = writeFileAtomic(f.name, data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write rotation state file: %w", err)
+	}
+	return nil
+}
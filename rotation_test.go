@@ -0,0 +1,118 @@
+package jwkset
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotationManager(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStorage()
+	options := RotationOptions{
+		CheckInterval:    -1,
+		GracePeriod:      time.Hour,
+		PrePublish:       2 * time.Hour,
+		RotationInterval: 10 * time.Hour,
+		StateStore:       NewFileRotationStateStore(filepath.Join(t.TempDir(), "rotation.json")),
+	}
+	manager, err := NewRotationManager(store, options)
+	if err != nil {
+		t.Fatalf("Failed to create the rotation manager.\nError: %s", err)
+	}
+	_, err = NewRotationManager(store, RotationOptions{})
+	if !errors.Is(err, ErrOptions) {
+		t.Fatalf("Expected an options error without a state store, but got %v.", err)
+	}
+	start := time.Now()
+	now := start
+	manager.now = func() time.Time { return now }
+	check := func(elapsed time.Duration, states ...KeyState) []KeyLifecycle {
+		now = start.Add(elapsed)
+		err := manager.check(ctx, false)
+		if err != nil {
+			t.Fatalf("Failed to check the keys.\nError: %s", err)
+		}
+		return assertKeyStates(t, manager, now, states...)
+	}
+
+	first, err := manager.Active(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get the active key.\nError: %s", err)
+	}
+	if first.Marshal().ALG != AlgES256 || first.Marshal().D == "" {
+		t.Fatalf("Expected an ES256 private key to be generated.")
+	}
+	all, err := store.KeyReadAll(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read the JWKs.\nError: %s", err)
+	}
+	if len(all) != 1 {
+		t.Fatalf("Expected only the active key in the Storage, but got %d keys.", len(all))
+	}
+
+	check(7*time.Hour, KeyStateActive)
+	keys := check(8*time.Hour+time.Minute, KeyStateActive, KeyStatePending)
+	if !keys[1].Activated.Equal(keys[0].Activated.Add(options.RotationInterval)) {
+		t.Fatalf("Expected the next key to be activated after the rotation interval.")
+	}
+	_, err = store.KeyRead(ctx, keys[1].KID)
+	if err != nil {
+		t.Fatalf("Expected the pending key to be published.\nError: %s", err)
+	}
+	active, err := manager.Active(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get the active key.\nError: %s", err)
+	}
+	if active.Marshal().KID != first.Marshal().KID {
+		t.Fatalf("Expected the first key to stay active until the next key is activated.")
+	}
+
+	keys = check(10*time.Hour+time.Minute, KeyStateRetired, KeyStateActive)
+	if !keys[0].DeleteAfter.Equal(keys[1].Activated.Add(options.GracePeriod)) {
+		t.Fatalf("Expected the retired key to be deleted after the grace period.")
+	}
+	check(11*time.Hour+2*time.Minute, KeyStateActive)
+	_, err = store.KeyRead(ctx, first.Marshal().KID)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Expected the retired key to be deleted, but got %s.", err)
+	}
+
+	err = manager.Rotate(ctx)
+	if err != nil {
+		t.Fatalf("Failed to rotate.\nError: %s", err)
+	}
+	keys = assertKeyStates(t, manager, now, KeyStateRetired, KeyStateActive)
+
+	reopened, err := NewRotationManager(store, options)
+	if err != nil {
+		t.Fatalf("Failed to create the second rotation manager.\nError: %s", err)
+	}
+	reopened.now = manager.now
+	assertKeyStates(t, reopened, now, KeyStateRetired, KeyStateActive)
+	active, err = reopened.Active(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get the active key.\nError: %s", err)
+	}
+	if active.Marshal().KID != keys[1].KID {
+		t.Fatalf("Expected the persisted active key to be used.")
+	}
+}
+
+func assertKeyStates(t *testing.T, manager *RotationManager, now time.Time, states ...KeyState) []KeyLifecycle {
+	keys, err := manager.Keys(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get the key lifecycles.\nError: %s", err)
+	}
+	if len(keys) != len(states) {
+		t.Fatalf("Expected %d keys, but got %d.", len(states), len(keys))
+	}
+	for i, key := range keys {
+		if key.State(now) != states[i] {
+			t.Fatalf("Expected key %d to be %s, but it's %s.", i, states[i], key.State(now))
+		}
+	}
+	return keys
+}
@@ -0,0 +1,127 @@
+package jwkset
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// SigningKeyOptions are used to configure the behavior of SelectSigningKey and SigningKeys.
+type SigningKeyOptions struct {
+	// ALG restricts the keys to the given algorithms. If empty, any algorithm is allowed.
+	ALG []ALG
+
+	// Compare orders the eligible keys from least to most preferred. It must be deterministic, for example by
+	// comparing a timestamp in the key ID. The order of keys that compare equal is kept.
+	//
+	// This defaults to the order of the Storage, with the last key preferred. The Storage implementations in this package
+	// keep keys in the order they were first written, so the newest key is preferred. For a Storage managed by a
+	// RotationManager, the newest key is the pending key once it's published, so set Rotation instead.
+	Compare func(a, b JWK) int
+
+	// KID pins the key ID of the signing key. If the key is not eligible, no key is selected. It takes precedence over
+	// Rotation.
+	KID string
+
+	// KTY restricts the keys to the given key types. If empty, any key type is allowed.
+	KTY []KTY
+
+	// Rotation pins the signing key to the active key of the RotationManager that manages the Storage, so pending keys
+	// are not used before they are activated and retired keys are not used after.
+	Rotation *RotationManager
+
+	// Time is the time at which the X.509 certificates of the keys must be valid.
+	//
+	// This defaults to time.Now().
+	Time time.Time
+}
+
+// SelectSigningKey selects the key to sign with from the Storage. It's the most preferred key returned by SigningKeys.
+// If no key is eligible, the error wraps ErrKeyNotFound.
+func SelectSigningKey(ctx context.Context, storage Storage, options SigningKeyOptions) (JWK, error) {
+	keys, err := SigningKeys(ctx, storage, options)
+	if err != nil {
+		return JWK{}, err
+	}
+	if len(keys) == 0 {
+		if options.KID != "" {
+			return JWK{}, fmt.Errorf("%w: pinned kid %q is not eligible for signing", ErrKeyNotFound, options.KID)
+		}
+		return JWK{}, fmt.Errorf("%w: no key is eligible for signing", ErrKeyNotFound)
+	}
+	return keys[len(keys)-1], nil
+}
+
+// SigningKeys returns the keys in the Storage that are eligible for signing, ordered from least to most preferred. A
+// key is eligible if it:
+//   - has an algorithm (alg), which is needed to sign, matching SigningKeyOptions.ALG if set,
+//   - has a key type (kty) matching SigningKeyOptions.KTY if set,
+//   - has the key use (use) sig or no key use,
+//   - has the key operation (key_ops) sign or no key operations,
+//   - has private key material,
+//   - and has an X.509 certificate, if any, that is valid at SigningKeyOptions.Time.
+func SigningKeys(ctx context.Context, storage Storage, options SigningKeyOptions) ([]JWK, error) {
+	if options.Time.IsZero() {
+		options.Time = time.Now()
+	}
+	if options.KID == "" && options.Rotation != nil {
+		kid, err := options.Rotation.activeKID(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read active key of rotation manager: %w", err)
+		}
+		options.KID = kid
+	}
+	var keys []JWK
+	if options.KID != "" {
+		jwk, err := storage.KeyRead(ctx, options.KID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pinned signing key: %w", err)
+		}
+		keys = []JWK{jwk}
+	} else {
+		var err error
+		keys, err = storage.KeyReadAll(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read keys from storage: %w", err)
+		}
+	}
+	keys = slices.DeleteFunc(keys, func(jwk JWK) bool {
+		return !canSign(jwk, options)
+	})
+	if options.Compare != nil {
+		slices.SortStableFunc(keys, options.Compare)
+	}
+	return keys, nil
+}
+
+// canSign reports whether the key is eligible for signing with the options.
+func canSign(jwk JWK, options SigningKeyOptions) bool {
+	marshal := jwk.Marshal()
+	if marshal.ALG == "" || len(options.ALG) > 0 && !slices.Contains(options.ALG, marshal.ALG) {
+		return false
+	}
+	if len(options.KTY) > 0 && !slices.Contains(options.KTY, marshal.KTY) {
+		return false
+	}
+	if marshal.USE != "" && marshal.USE != UseSig {
+		return false
+	}
+	if len(marshal.KEYOPS) > 0 && !slices.Contains(marshal.KEYOPS, KeyOpsSign) {
+		return false
+	}
+	switch jwk.Key().(type) {
+	case *ecdsa.PrivateKey, ed25519.PrivateKey, *rsa.PrivateKey, []byte:
+	default:
+		return false
+	}
+	if certs := jwk.X509().X5C; len(certs) > 0 {
+		if options.Time.Before(certs[0].NotBefore) || options.Time.After(certs[0].NotAfter) {
+			return false
+		}
+	}
+	return true
+}
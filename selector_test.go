@@ -0,0 +1,168 @@
+package jwkset
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelectSigningKey(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStorage()
+	write := func(key any, metadata JWKMetadataOptions, certs ...*x509.Certificate) {
+		options := JWKOptions{
+			Marshal: JWKMarshalOptions{
+				Private: true,
+			},
+			Metadata: metadata,
+			X509: JWKX509Options{
+				X5C: certs,
+			},
+		}
+		jwk, err := NewJWKFromKey(key, options)
+		if err != nil {
+			t.Fatalf("Failed to create the JWK %q.\nError: %s", metadata.KID, err)
+		}
+		err = store.KeyWrite(ctx, jwk)
+		if err != nil {
+			t.Fatalf("Failed to write the JWK.\nError: %s", err)
+		}
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate the Ed25519 key.\nError: %s", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate the ECDSA key.\nError: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "signer"},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     time.Now().Add(-time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &ecKey.PublicKey, ecKey)
+	if err != nil {
+		t.Fatalf("Failed to create a certificate.\nError: %s", err)
+	}
+	expired, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse the certificate.\nError: %s", err)
+	}
+
+	write(edKey, JWKMetadataOptions{ALG: AlgEdDSA, KID: "ed", USE: UseSig})
+	write(ecKey, JWKMetadataOptions{ALG: AlgES256, KEYOPS: []KEYOPS{KeyOpsSign}, KID: "ec"})
+	write(&ecKey.PublicKey, JWKMetadataOptions{ALG: AlgES256, KID: "public"})
+	write(ecKey, JWKMetadataOptions{ALG: AlgES256, KID: "enc", USE: UseEnc})
+	write(ecKey, JWKMetadataOptions{ALG: AlgES256, KEYOPS: []KEYOPS{KeyOpsVerify}, KID: "verify"})
+	write(hmacKey1, JWKMetadataOptions{KID: "no alg"})
+	write(ecKey, JWKMetadataOptions{ALG: AlgES256, KID: "expired"}, expired)
+
+	tc := []struct {
+		name    string
+		options SigningKeyOptions
+		kid     string
+	}{
+		{name: "Newest", kid: "ec"},
+		{name: "ALG", options: SigningKeyOptions{ALG: []ALG{AlgEdDSA}}, kid: "ed"},
+		{name: "KTY", options: SigningKeyOptions{KTY: []KTY{KtyOKP}}, kid: "ed"},
+		{name: "Pinned", options: SigningKeyOptions{KID: "ed"}, kid: "ed"},
+		{name: "Compare", options: SigningKeyOptions{Compare: func(a, b JWK) int {
+			return strings.Compare(a.Marshal().KID, b.Marshal().KID)
+		}}, kid: "ed"},
+		{name: "Time", options: SigningKeyOptions{ALG: []ALG{AlgES256}, Time: template.NotBefore.Add(time.Minute)}, kid: "expired"},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			jwk, err := SelectSigningKey(ctx, store, tt.options)
+			if err != nil {
+				t.Fatalf("Failed to select the signing key.\nError: %s", err)
+			}
+			if jwk.Marshal().KID != tt.kid {
+				t.Fatalf("Expected key ID %q, but got %q.", tt.kid, jwk.Marshal().KID)
+			}
+		})
+	}
+
+	for _, kid := range []string{"public", "enc", "verify", "no alg", "expired", kidMissing} {
+		_, err = SelectSigningKey(ctx, store, SigningKeyOptions{KID: kid})
+		if !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("Expected the pinned key %q to not be eligible, but got %s.", kid, err)
+		}
+	}
+	_, err = SelectSigningKey(ctx, store, SigningKeyOptions{ALG: []ALG{AlgRS256}})
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Expected no eligible key, but got %s.", err)
+	}
+}
+
+func TestSelectSigningKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStorage()
+	manager, err := NewRotationManager(store, RotationOptions{
+		CheckInterval:    -1,
+		PrePublish:       2 * time.Hour,
+		RotationInterval: 10 * time.Hour,
+		StateStore:       NewMemoryRotationStateStore(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the rotation manager.\nError: %s", err)
+	}
+	start := time.Now()
+	now := start.Add(8*time.Hour + time.Minute)
+	manager.now = func() time.Time { return now }
+	err = manager.check(ctx, false)
+	if err != nil {
+		t.Fatalf("Failed to check the keys.\nError: %s", err)
+	}
+	keys := assertKeyStates(t, manager, now, KeyStateActive, KeyStatePending)
+
+	selected, err := SelectSigningKey(ctx, store, SigningKeyOptions{})
+	if err != nil {
+		t.Fatalf("Failed to select the signing key.\nError: %s", err)
+	}
+	if selected.Marshal().KID != keys[1].KID {
+		t.Fatalf("Expected the default selection to prefer the newest key.")
+	}
+	options := SigningKeyOptions{
+		Rotation: manager,
+	}
+	selected, err = SelectSigningKey(ctx, store, options)
+	if err != nil {
+		t.Fatalf("Failed to select the signing key of the rotation manager.\nError: %s", err)
+	}
+	if selected.Marshal().KID != keys[0].KID {
+		t.Fatalf("Expected the active key to be selected instead of the pending key.")
+	}
+
+	now = start.Add(10*time.Hour + time.Minute)
+	err = manager.check(ctx, false)
+	if err != nil {
+		t.Fatalf("Failed to check the keys.\nError: %s", err)
+	}
+	selected, err = SelectSigningKey(ctx, store, options)
+	if err != nil {
+		t.Fatalf("Failed to select the signing key of the rotation manager.\nError: %s", err)
+	}
+	if selected.Marshal().KID != keys[1].KID {
+		t.Fatalf("Expected the next key to be selected once it's activated.")
+	}
+	options.KID = keys[0].KID
+	selected, err = SelectSigningKey(ctx, store, options)
+	if err != nil {
+		t.Fatalf("Failed to select the pinned signing key.\nError: %s", err)
+	}
+	if selected.Marshal().KID != keys[0].KID {
+		t.Fatalf("Expected the pinned key ID to take precedence over the rotation manager.")
+	}
+}
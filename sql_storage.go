@@ -0,0 +1,431 @@
+package jwkset
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrSQLConflict indicates that a key was changed by another writer since this Storage last read or wrote it. Read
+	// the key again before retrying the write.
+	ErrSQLConflict = errors.New("key was changed by another writer")
+	// ErrSQLStorage indicates that a database/sql Storage could not use its database.
+	ErrSQLStorage = errors.New("failed to use SQL storage")
+)
+
+// SQLDialect is the SQL dialect of a database used by NewStorageFromSQL.
+type SQLDialect string
+
+const (
+	// SQLDialectPostgres is the dialect of PostgreSQL.
+	SQLDialectPostgres SQLDialect = "postgres"
+	// SQLDialectSQLite is the dialect of SQLite.
+	SQLDialectSQLite SQLDialect = "sqlite"
+)
+
+// sqlMigrations are the schema migrations of each dialect, in order. A migration must never change after it's
+// released. The "{table}" placeholder is replaced with the table name.
+var sqlMigrations = map[SQLDialect][]string{
+	SQLDialectPostgres: {
+		`CREATE TABLE IF NOT EXISTS {table} (
+	kid TEXT PRIMARY KEY,
+	kty TEXT NOT NULL,
+	alg TEXT NOT NULL,
+	key_use TEXT NOT NULL,
+	thumbprint TEXT NOT NULL,
+	jwk TEXT NOT NULL,
+	version BIGINT NOT NULL,
+	created TIMESTAMPTZ NOT NULL,
+	updated TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS {table}_thumbprint ON {table} (thumbprint);`,
+	},
+	SQLDialectSQLite: {
+		`CREATE TABLE IF NOT EXISTS {table} (
+	kid TEXT PRIMARY KEY,
+	kty TEXT NOT NULL,
+	alg TEXT NOT NULL,
+	key_use TEXT NOT NULL,
+	thumbprint TEXT NOT NULL,
+	jwk TEXT NOT NULL,
+	version INTEGER NOT NULL,
+	created TIMESTAMP NOT NULL,
+	updated TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS {table}_thumbprint ON {table} (thumbprint);`,
+	},
+}
+
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SQLStorageOptions are used to configure the behavior of NewStorageFromSQL.
+type SQLStorageOptions struct {
+	// Dialect is the SQL dialect of the database. It is required.
+	Dialect SQLDialect
+
+	// NoMigrate skips the schema migrations. The migrations must then be applied some other way, such as with
+	// MigrateSQLStorage.
+	NoMigrate bool
+
+	// Table is the name of the table for keys. The table of applied migrations has the same name with the suffix
+	// "_migrations".
+	//
+	// This defaults to "jwkset_keys".
+	Table string
+}
+
+// sqlStorage is a Storage backed by a database/sql database. Each key is stored as its marshaled private JSON with
+// indexed columns.
+type sqlStorage struct {
+	db      *sql.DB
+	options SQLStorageOptions
+
+	mux      sync.Mutex
+	versions map[string]int64 // The version of each key this Storage last read with KeyRead or wrote.
+}
+
+// NewStorageFromSQL creates a new Storage backed by the given database. Several Storages, such as in replicas of a
+// service, can share one database.
+//
+// KeyWrite uses optimistic concurrency. If this Storage read or wrote the key before, the write fails with
+// ErrSQLConflict if another writer changed or deleted the key since, until the key is read again with KeyRead. If this
+// Storage never read or wrote the key, the write creates or overwrites it unconditionally. KeyReadAll and the other
+// reads of all keys don't change the versions KeyWrite expects.
+func NewStorageFromSQL(db *sql.DB, options SQLStorageOptions) (Storage, error) {
+	options, err := sqlStorageDefaults(options)
+	if err != nil {
+		return nil, err
+	}
+	if !options.NoMigrate {
+		err = MigrateSQLStorage(context.Background(), db, options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s := &sqlStorage{
+		db:       db,
+		options:  options,
+		versions: make(map[string]int64),
+	}
+	return s, nil
+}
+
+// MigrateSQLStorage applies the schema migrations for a Storage created with NewStorageFromSQL that have not been
+// applied yet. Each migration is applied in its own transaction. It's safe to call from several replicas at the same
+// time, each migration is applied by only one of them.
+func MigrateSQLStorage(ctx context.Context, db *sql.DB, options SQLStorageOptions) error {
+	options, err := sqlStorageDefaults(options)
+	if err != nil {
+		return err
+	}
+	migrationsTable := options.Table + "_migrations"
+	_, err = db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+migrationsTable+" (version INTEGER PRIMARY KEY)")
+	if err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", errors.Join(err, ErrSQLStorage))
+	}
+	var applied int
+	err = db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM "+migrationsTable).Scan(&applied)
+	if err != nil {
+		return fmt.Errorf("failed to read applied migrations: %w", errors.Join(err, ErrSQLStorage))
+	}
+	migrations := sqlMigrations[options.Dialect]
+	for i := applied; i < len(migrations); i++ {
+		err = migrateSQL(ctx, db, options, i+1, migrations[i])
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, errors.Join(err, ErrSQLStorage))
+		}
+	}
+	return nil
+}
+
+func migrateSQL(ctx context.Context, db *sql.DB, options SQLStorageOptions, version int, migration string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer tx.Rollback()
+	// Claim the version before applying the migration. If another replica claimed it concurrently, the insert waits
+	// for that transaction and affects no rows once it commits, so the migration is only applied once.
+	query := "INSERT INTO " + options.Table + "_migrations (version) VALUES (" + sqlPlaceholder(options.Dialect, 1) + ") ON CONFLICT (version) DO NOTHING"
+	result, err := tx.ExecContext(ctx, query, version)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return nil
+	}
+	for _, statement := range strings.Split(migration, ";") {
+		statement = strings.TrimSpace(statement)
+		if statement == "" {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, strings.ReplaceAll(statement, "{table}", options.Table))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func sqlStorageDefaults(options SQLStorageOptions) (SQLStorageOptions, error) {
+	if _, ok := sqlMigrations[options.Dialect]; !ok {
+		return options, fmt.Errorf("%w: unsupported SQL dialect %q", ErrOptions, options.Dialect)
+	}
+	if options.Table == "" {
+		options.Table = "jwkset_keys"
+	}
+	if !sqlIdentifier.MatchString(options.Table) {
+		return options, fmt.Errorf("%w: invalid SQL table name %q", ErrOptions, options.Table)
+	}
+	return options, nil
+}
+
+// sqlPlaceholder returns the placeholder for the nth argument of a query.
+func sqlPlaceholder(dialect SQLDialect, n int) string {
+	if dialect == SQLDialectPostgres {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// query replaces the "{table}" placeholder and the numbered "{n}" argument placeholders of the query.
+func (s *sqlStorage) query(query string) string {
+	query = strings.ReplaceAll(query, "{table}", s.options.Table)
+	for n := 1; strings.Contains(query, "{"+strconv.Itoa(n)+"}"); n++ {
+		query = strings.ReplaceAll(query, "{"+strconv.Itoa(n)+"}", sqlPlaceholder(s.options.Dialect, n))
+	}
+	return query
+}
+
+func (s *sqlStorage) KeyDelete(ctx context.Context, keyID string) (ok bool, err error) {
+	result, err := s.db.ExecContext(ctx, s.query("DELETE FROM {table} WHERE kid = {1}"), keyID)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete key: %w", errors.Join(err, ErrSQLStorage))
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get deleted rows: %w", errors.Join(err, ErrSQLStorage))
+	}
+	s.mux.Lock()
+	delete(s.versions, keyID)
+	s.mux.Unlock()
+	return affected > 0, nil
+}
+func (s *sqlStorage) KeyRead(ctx context.Context, keyID string) (JWK, error) {
+	var raw string
+	var version int64
+	err := s.db.QueryRowContext(ctx, s.query("SELECT jwk, version FROM {table} WHERE kid = {1}"), keyID).Scan(&raw, &version)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.mux.Lock()
+		delete(s.versions, keyID)
+		s.mux.Unlock()
+		return JWK{}, fmt.Errorf("%w: kid %q", ErrKeyNotFound, keyID)
+	}
+	if err != nil {
+		return JWK{}, fmt.Errorf("failed to read key: %w", errors.Join(err, ErrSQLStorage))
+	}
+	jwk, err := sqlUnmarshalJWK(raw)
+	if err != nil {
+		return JWK{}, err
+	}
+	s.mux.Lock()
+	s.versions[keyID] = version
+	s.mux.Unlock()
+	return jwk, nil
+}
+func (s *sqlStorage) KeyReadAll(ctx context.Context) ([]JWK, error) {
+	return s.readKeys(ctx, "")
+}
+func (s *sqlStorage) KeyQuery(ctx context.Context, filter KeyFilter) ([]JWK, error) {
+	var conditions []string
+	var args []any
+	for _, column := range []struct {
+		name  string
+		value string
+	}{
+		{name: "kty", value: string(filter.KTY)},
+		{name: "alg", value: string(filter.ALG)},
+		{name: "key_use", value: string(filter.USE)},
+		{name: "thumbprint", value: filter.Thumbprint},
+	} {
+		if column.value != "" {
+			args = append(args, column.value)
+			conditions = append(conditions, column.name+" = {"+strconv.Itoa(len(args))+"}")
+		}
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	jwks, err := s.readKeys(ctx, where, args...)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(jwks, func(jwk JWK) bool {
+		return !filter.Matches(jwk) // The columns don't cover every field of the filter.
+	}), nil
+}
+
+// readKeys reads the keys selected by the WHERE clause, in the order of KeyReadAll. A non-empty WHERE clause starts
+// with a space.
+func (s *sqlStorage) readKeys(ctx context.Context, where string, args ...any) ([]JWK, error) {
+	rows, err := s.db.QueryContext(ctx, s.query("SELECT jwk FROM {table}"+where+" ORDER BY created, kid"), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keys: %w", errors.Join(err, ErrSQLStorage))
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer rows.Close()
+	var jwks []JWK
+	for rows.Next() {
+		var raw string
+		err = rows.Scan(&raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan key: %w", errors.Join(err, ErrSQLStorage))
+		}
+		jwk, err := sqlUnmarshalJWK(raw)
+		if err != nil {
+			return nil, err
+		}
+		jwks = append(jwks, jwk)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keys: %w", errors.Join(err, ErrSQLStorage))
+	}
+	return jwks, nil
+}
+func (s *sqlStorage) KeyWrite(ctx context.Context, jwk JWK) error {
+	options := jwk.options
+	options.Marshal = JWKMarshalOptions{
+		Private: true,
+	}
+	marshal, err := keyMarshal(jwk.Key(), options)
+	if err != nil {
+		return fmt.Errorf("failed to marshal key: %w", err)
+	}
+	raw, err := json.Marshal(marshal)
+	if err != nil {
+		return fmt.Errorf("failed to marshal key: %w", err)
+	}
+	thumbprint, err := jwk.Thumbprint()
+	if err != nil {
+		return fmt.Errorf("failed to compute key thumbprint: %w", err)
+	}
+	keyID := marshal.KID
+	now := time.Now().UTC()
+
+	s.mux.Lock()
+	version, seen := s.versions[keyID]
+	s.mux.Unlock()
+	if !seen {
+		// The key was never seen, so there is no version to expect.
+		err = s.db.QueryRowContext(ctx, s.query(`INSERT INTO {table} (kid, kty, alg, key_use, thumbprint, jwk, version, created, updated) VALUES ({1}, {2}, {3}, {4}, {5}, {6}, 1, {7}, {8}) ON CONFLICT (kid) DO UPDATE SET kty = excluded.kty, alg = excluded.alg, key_use = excluded.key_use, thumbprint = excluded.thumbprint, jwk = excluded.jwk, version = {table}.version + 1, updated = excluded.updated RETURNING version`),
+			keyID, string(marshal.KTY), string(marshal.ALG), string(marshal.USE), thumbprint, string(raw), now, now).Scan(&version)
+		if err != nil {
+			return fmt.Errorf("failed to write key: %w", errors.Join(err, ErrSQLStorage))
+		}
+		s.mux.Lock()
+		s.versions[keyID] = version
+		s.mux.Unlock()
+		return nil
+	}
+
+	result, err := s.db.ExecContext(ctx, s.query(`UPDATE {table} SET kty = {1}, alg = {2}, key_use = {3}, thumbprint = {4}, jwk = {5}, version = version + 1, updated = {6} WHERE kid = {7} AND version = {8}`),
+		string(marshal.KTY), string(marshal.ALG), string(marshal.USE), thumbprint, string(raw), now, keyID, version)
+	if err != nil {
+		return fmt.Errorf("failed to write key: %w", errors.Join(err, ErrSQLStorage))
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get written rows: %w", errors.Join(err, ErrSQLStorage))
+	}
+	if affected == 0 {
+		return fmt.Errorf("%w: kid %q", ErrSQLConflict, keyID)
+	}
+	s.mux.Lock()
+	s.versions[keyID] = version + 1
+	s.mux.Unlock()
+	return nil
+}
+
+func (s *sqlStorage) JSON(ctx context.Context) (json.RawMessage, error) {
+	m, err := s.memory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.JSON(ctx)
+}
+func (s *sqlStorage) JSONPublic(ctx context.Context) (json.RawMessage, error) {
+	m, err := s.memory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.JSONPublic(ctx)
+}
+func (s *sqlStorage) JSONPrivate(ctx context.Context) (json.RawMessage, error) {
+	m, err := s.memory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.JSONPrivate(ctx)
+}
+func (s *sqlStorage) JSONWithOptions(ctx context.Context, marshalOptions JWKMarshalOptions, validationOptions JWKValidateOptions) (json.RawMessage, error) {
+	m, err := s.memory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.JSONWithOptions(ctx, marshalOptions, validationOptions)
+}
+func (s *sqlStorage) Marshal(ctx context.Context) (JWKSMarshal, error) {
+	m, err := s.memory(ctx)
+	if err != nil {
+		return JWKSMarshal{}, err
+	}
+	return m.Marshal(ctx)
+}
+func (s *sqlStorage) MarshalWithOptions(ctx context.Context, marshalOptions JWKMarshalOptions, validationOptions JWKValidateOptions) (JWKSMarshal, error) {
+	m, err := s.memory(ctx)
+	if err != nil {
+		return JWKSMarshal{}, err
+	}
+	return m.MarshalWithOptions(ctx, marshalOptions, validationOptions)
+}
+
+// memory returns an in-memory Storage with a snapshot of all keys.
+func (s *sqlStorage) memory(ctx context.Context) (Storage, error) {
+	jwks, err := s.KeyReadAll(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot keys due to error: %w", err)
+	}
+	m := NewMemoryStorage()
+	err = m.(BatchStorage).ReplaceAll(ctx, jwks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write keys to memory storage due to error: %w", err)
+	}
+	return m, nil
+}
+
+func sqlUnmarshalJWK(raw string) (JWK, error) {
+	marshalOptions := JWKMarshalOptions{
+		Private: true,
+	}
+	jwk, err := NewJWKFromRawJSON(json.RawMessage(raw), marshalOptions, JWKValidateOptions{})
+	if err != nil {
+		return JWK{}, fmt.Errorf("failed to create JWK from stored JSON: %w", errors.Join(err, ErrSQLStorage))
+	}
+	return jwk, nil
+}
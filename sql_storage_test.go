@@ -0,0 +1,316 @@
+package jwkset
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSQLKeyDelete(t *testing.T) {
+	testStorageKeyDelete(t, setupSQL(t))
+}
+
+func TestSQLKeyRead(t *testing.T) {
+	testStorageKeyRead(t, setupSQL(t))
+}
+
+func TestSQLKeyReadAll(t *testing.T) {
+	testStorageKeyReadAll(t, setupSQL(t))
+}
+
+func TestSQLKeyWrite(t *testing.T) {
+	testStorageKeyWrite(t, setupSQL(t))
+}
+
+func TestSQLSharedKeyWrite(t *testing.T) {
+	testStorageSharedKeyWrite(t, setupSQL(t))
+}
+
+func TestSQLKeyQuery(t *testing.T) {
+	testStorageKeyQuery(t, setupSQL(t))
+}
+
+func TestSQLJSON(t *testing.T) {
+	params := setupSQL(t)
+	defer params.cancel()
+	testJSON(params.ctx, t, params.jwks)
+}
+
+func TestSQLConflict(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	db := sql.OpenDB(fakeSQLConnector{db: newFakeSQLDB()})
+	defer db.Close()
+	options := SQLStorageOptions{
+		Dialect: SQLDialectSQLite,
+	}
+	replica1, err := NewStorageFromSQL(db, options)
+	if err != nil {
+		t.Fatalf("Failed to create the SQL storage.\nError: %s", err)
+	}
+	replica2, err := NewStorageFromSQL(db, options)
+	if err != nil {
+		t.Fatalf("Failed to create the second SQL storage.\nError: %s", err)
+	}
+
+	testStorageConflict(ctx, t, replica1, replica2, ErrSQLConflict)
+
+	_, err = NewStorageFromSQL(db, options)
+	if err != nil {
+		t.Fatalf("Failed to create an SQL storage with the migrations already applied.\nError: %s", err)
+	}
+	_, err = NewStorageFromSQL(db, SQLStorageOptions{Dialect: SQLDialectSQLite, Table: "keys; DROP TABLE keys"})
+	if !errors.Is(err, ErrOptions) {
+		t.Fatalf("Expected an invalid table name to be rejected, but got %s.", err)
+	}
+}
+
+func TestSQLConcurrentMigration(t *testing.T) {
+	fake := newFakeSQLDB()
+	db := sql.OpenDB(fakeSQLConnector{db: fake})
+	defer db.Close()
+	options := SQLStorageOptions{
+		Dialect: SQLDialectSQLite,
+	}
+	_, err := NewStorageFromSQL(db, options)
+	if err != nil {
+		t.Fatalf("Failed to create the SQL storage.\nError: %s", err)
+	}
+
+	fake.mux.Lock()
+	fake.staleMigrations = true
+	fake.mux.Unlock()
+	_, err = NewStorageFromSQL(db, options)
+	if err != nil {
+		t.Fatalf("Failed to create an SQL storage that raced another replica's migrations.\nError: %s", err)
+	}
+	fake.mux.Lock()
+	defer fake.mux.Unlock()
+	if len(fake.migrations) != len(sqlMigrations[SQLDialectSQLite]) {
+		t.Fatalf("Expected each migration to be recorded once, but got %v.", fake.migrations)
+	}
+}
+
+func setupSQL(t *testing.T) (params storageTestParams) {
+	db := sql.OpenDB(fakeSQLConnector{db: newFakeSQLDB()})
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	store, err := NewStorageFromSQL(db, SQLStorageOptions{Dialect: SQLDialectSQLite})
+	if err != nil {
+		t.Fatalf("Failed to create the SQL storage.\nError: %s", err)
+	}
+	shared, err := NewStorageFromSQL(db, SQLStorageOptions{Dialect: SQLDialectSQLite})
+	if err != nil {
+		t.Fatalf("Failed to create the second SQL storage.\nError: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	params = storageTestParams{
+		ctx:    ctx,
+		cancel: cancel,
+		jwks:   store,
+		shared: shared,
+	}
+	return params
+}
+
+// fakeSQLDB is an in-memory database that understands only the statements of the SQL storage, so the SQL storage can be
+// tested without a database driver dependency.
+type fakeSQLDB struct {
+	mux        sync.Mutex
+	migrations []int64
+	rows       map[string]fakeSQLRow
+	// staleMigrations makes reads of the applied migrations return none, like a replica that read them just before
+	// another replica applied them.
+	staleMigrations bool
+}
+
+type fakeSQLRow struct {
+	kid, kty, alg, use, thumbprint, jwk string
+	version                             int64
+	created, updated                    time.Time
+}
+
+func newFakeSQLDB() *fakeSQLDB {
+	return &fakeSQLDB{
+		rows: make(map[string]fakeSQLRow),
+	}
+}
+
+type fakeSQLConnector struct {
+	db *fakeSQLDB
+}
+
+func (c fakeSQLConnector) Connect(context.Context) (driver.Conn, error) {
+	return fakeSQLConn(c), nil
+}
+func (c fakeSQLConnector) Driver() driver.Driver {
+	return nil
+}
+
+type fakeSQLConn struct {
+	db *fakeSQLDB
+}
+
+func (c fakeSQLConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+func (c fakeSQLConn) Close() error {
+	return nil
+}
+func (c fakeSQLConn) Begin() (driver.Tx, error) {
+	return fakeSQLTx{}, nil
+}
+
+type fakeSQLTx struct{}
+
+func (fakeSQLTx) Commit() error {
+	return nil
+}
+func (fakeSQLTx) Rollback() error {
+	return nil
+}
+
+func (c fakeSQLConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	db := c.db
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	v := func(i int) driver.Value { return args[i].Value }
+	switch {
+	case strings.HasPrefix(query, "CREATE"):
+		return driver.RowsAffected(0), nil
+	case strings.HasPrefix(query, "INSERT INTO jwkset_keys_migrations"):
+		if slices.Contains(db.migrations, v(0).(int64)) {
+			if strings.HasSuffix(query, "ON CONFLICT (version) DO NOTHING") {
+				return driver.RowsAffected(0), nil
+			}
+			return nil, errors.New("UNIQUE constraint failed: jwkset_keys_migrations.version")
+		}
+		db.migrations = append(db.migrations, v(0).(int64))
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(query, "UPDATE jwkset_keys "):
+		kid := v(6).(string)
+		row, ok := db.rows[kid]
+		if !ok || row.version != v(7).(int64) {
+			return driver.RowsAffected(0), nil
+		}
+		row.kty, row.alg, row.use = v(0).(string), v(1).(string), v(2).(string)
+		row.thumbprint, row.jwk = v(3).(string), v(4).(string)
+		row.updated = v(5).(time.Time)
+		row.version++
+		db.rows[kid] = row
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(query, "DELETE FROM jwkset_keys "):
+		kid := v(0).(string)
+		if _, ok := db.rows[kid]; !ok {
+			return driver.RowsAffected(0), nil
+		}
+		delete(db.rows, kid)
+		return driver.RowsAffected(1), nil
+	}
+	return nil, fmt.Errorf("unsupported statement: %s", query)
+}
+
+func (c fakeSQLConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	db := c.db
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	v := func(i int) driver.Value { return args[i].Value }
+	switch {
+	case strings.HasPrefix(query, "INSERT INTO jwkset_keys "): // An upsert returning the version.
+		kid := v(0).(string)
+		row, ok := db.rows[kid]
+		if !ok {
+			row = fakeSQLRow{
+				kid:     kid,
+				created: v(6).(time.Time),
+			}
+		}
+		row.kty, row.alg, row.use = v(1).(string), v(2).(string), v(3).(string)
+		row.thumbprint, row.jwk = v(4).(string), v(5).(string)
+		row.updated = v(7).(time.Time)
+		row.version++
+		db.rows[kid] = row
+		return &fakeSQLRows{columns: []string{"version"}, values: [][]driver.Value{{row.version}}}, nil
+	case strings.HasPrefix(query, "SELECT COALESCE(MAX(version), 0) FROM jwkset_keys_migrations"):
+		var applied int64
+		for _, version := range db.migrations {
+			if !db.staleMigrations {
+				applied = max(applied, version)
+			}
+		}
+		return &fakeSQLRows{columns: []string{"max"}, values: [][]driver.Value{{applied}}}, nil
+	case strings.HasPrefix(query, "SELECT jwk, version FROM jwkset_keys "):
+		rows := &fakeSQLRows{columns: []string{"jwk", "version"}}
+		if row, ok := db.rows[args[0].Value.(string)]; ok {
+			rows.values = append(rows.values, []driver.Value{row.jwk, row.version})
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT jwk FROM jwkset_keys "):
+		var conditions []string // Columns that must equal the arguments, in order.
+		if _, where, ok := strings.Cut(query, " WHERE "); ok {
+			where, _, _ = strings.Cut(where, " ORDER BY ")
+			for _, condition := range strings.Split(where, " AND ") {
+				column, _, _ := strings.Cut(condition, " = ")
+				conditions = append(conditions, column)
+			}
+		}
+		sorted := make([]fakeSQLRow, 0, len(db.rows))
+	rows:
+		for _, row := range db.rows {
+			values := map[string]string{"kty": row.kty, "alg": row.alg, "key_use": row.use, "thumbprint": row.thumbprint}
+			for i, column := range conditions {
+				value, ok := values[column]
+				if !ok {
+					return nil, fmt.Errorf("unsupported column: %s", column)
+				}
+				if value != args[i].Value.(string) {
+					continue rows
+				}
+			}
+			sorted = append(sorted, row)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			if !sorted[i].created.Equal(sorted[j].created) {
+				return sorted[i].created.Before(sorted[j].created)
+			}
+			return sorted[i].kid < sorted[j].kid
+		})
+		rows := &fakeSQLRows{columns: []string{"jwk"}}
+		for _, row := range sorted {
+			rows.values = append(rows.values, []driver.Value{row.jwk})
+		}
+		return rows, nil
+	}
+	return nil, fmt.Errorf("unsupported query: %s", query)
+}
+
+type fakeSQLRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string {
+	return r.columns
+}
+func (r *fakeSQLRows) Close() error {
+	return nil
+}
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
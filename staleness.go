@@ -0,0 +1,119 @@
+package jwkset
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// KeyRead reads a key from the underlying Storage. If the MaxStaleness option is set and the Storage is stale, it
+// returns ErrStaleJWKSet instead, unless stale keys are evicted.
+func (s *httpStorage) KeyRead(ctx context.Context, keyID string) (JWK, error) {
+	if !s.options.MaxStalenessEvict && s.isStale() {
+		return JWK{}, fmt.Errorf("%w: kid %q", ErrStaleJWKSet, keyID)
+	}
+	return s.Storage.KeyRead(ctx, keyID)
+}
+
+// KeyQuery queries the underlying Storage. Like KeyRead, it returns ErrStaleJWKSet if the Storage is stale, unless
+// stale keys are evicted. A client created with NewHTTPClient queries its sources with it, so it fails the same way.
+func (s *httpStorage) KeyQuery(ctx context.Context, filter KeyFilter) ([]JWK, error) {
+	if !s.options.MaxStalenessEvict && s.isStale() {
+		return nil, fmt.Errorf("%w: query", ErrStaleJWKSet)
+	}
+	return QueryKeys(ctx, s.Storage, filter)
+}
+
+func (s *httpStorage) isStale() bool {
+	if s.options.MaxStaleness <= 0 {
+		return false
+	}
+	s.staleMux.Lock()
+	defer s.staleMux.Unlock()
+	return s.stale
+}
+
+// resetStaleness schedules the Storage to become stale MaxStaleness after the given time of the last successful
+// refresh. If the Storage was stale, it is no longer stale.
+func (s *httpStorage) resetStaleness(succeeded time.Time) {
+	if s.options.MaxStaleness <= 0 {
+		return
+	}
+	s.staleMux.Lock()
+	if s.staleTimer != nil {
+		s.staleTimer.Stop()
+	}
+	if s.ctx.Err() == nil {
+		s.staleTimer = time.AfterFunc(time.Until(succeeded.Add(s.options.MaxStaleness)), s.becomeStale)
+	}
+	wasStale := s.stale
+	s.stale = false
+	s.staleMux.Unlock()
+	if wasStale && s.options.StaleHandler != nil {
+		s.options.StaleHandler(s.ctx, false)
+	}
+}
+
+// becomeStale is called by the staleness timer.
+func (s *httpStorage) becomeStale() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.statusMux.RLock()
+	succeeded := s.status.Succeeded
+	s.statusMux.RUnlock()
+	if succeeded.IsZero() {
+		succeeded = s.created
+	}
+	if time.Since(succeeded) < s.options.MaxStaleness {
+		return // A refresh succeeded after the timer fired.
+	}
+
+	s.staleMux.Lock()
+	wasStale := s.stale
+	s.stale = true
+	s.staleMux.Unlock()
+	if wasStale {
+		return
+	}
+
+	if s.options.MaxStalenessEvict {
+		err := s.evict(s.ctx)
+		if err != nil && s.options.RefreshErrorHandler != nil {
+			s.options.RefreshErrorHandler(s.ctx, fmt.Errorf("failed to evict stale keys: %w", err))
+		}
+	}
+	if s.options.StaleHandler != nil {
+		s.options.StaleHandler(s.ctx, true)
+	}
+}
+
+// evict deletes all keys from the underlying Storage. The caller must hold s.mux.
+func (s *httpStorage) evict(ctx context.Context) error {
+	keys, err := s.Storage.KeyReadAll(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot of all keys from storage: %w", err)
+	}
+	var changes KeyChanges
+	for _, jwk := range keys {
+		changes.Removed = append(changes.Removed, jwk.Marshal().KID)
+	}
+	if batch, ok := s.Storage.(BatchStorage); ok {
+		err = batch.ReplaceAll(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to replace keys in storage: %w", err)
+		}
+	} else {
+		for _, kid := range changes.Removed {
+			_, err = s.Storage.KeyDelete(ctx, kid)
+			if err != nil {
+				return fmt.Errorf("failed to delete JWK from storage: %w", err)
+			}
+		}
+	}
+	clear(s.removedAt)
+	if !changes.Empty() && s.options.RefreshChangeHandler != nil {
+		s.options.RefreshChangeHandler(ctx, changes)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package jwkset
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaxStaleness(t *testing.T) {
+	for _, evict := range []bool{false, true} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+		serverStore := NewMemoryStorage()
+		err := serverStore.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+		if err != nil {
+			t.Fatalf("Failed to write the JWK to the server store.\nError: %s", err)
+		}
+		var fail atomic.Bool
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if fail.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			rawJWKS, err := serverStore.JSONPrivate(r.Context())
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = w.Write(rawJWKS)
+		}))
+		u, err := url.ParseRequestURI(server.URL)
+		if err != nil {
+			t.Fatalf("Failed to parse the server URL.\nError: %s", err)
+		}
+
+		staleChanges := make(chan bool, 2)
+		options := HTTPClientStorageOptions{
+			Ctx:               ctx,
+			MaxStaleness:      100 * time.Millisecond,
+			MaxStalenessEvict: evict,
+			StaleHandler: func(_ context.Context, stale bool) {
+				staleChanges <- stale
+			},
+		}
+		clientStore, handle, err := NewStorageFromHTTPWithHandle(u, options)
+		if err != nil {
+			t.Fatalf("Failed to create the HTTP storage.\nError: %s", err)
+		}
+		_, err = clientStore.KeyRead(ctx, kidWritten)
+		if err != nil {
+			t.Fatalf("Failed to read the JWK.\nError: %s", err)
+		}
+
+		fail.Store(true)
+		_ = handle.Refresh(ctx)
+		if stale := <-staleChanges; !stale {
+			t.Fatalf("Expected the storage to become stale.")
+		}
+		expected := ErrStaleJWKSet
+		if evict {
+			expected = ErrKeyNotFound
+		}
+		_, err = clientStore.KeyRead(ctx, kidWritten)
+		if !errors.Is(err, expected) {
+			t.Fatalf("Unexpected error when reading a stale key.\n  Actual: %s\n  Expected: %s", err, expected)
+		}
+		client, err := NewHTTPClient(HTTPClientOptions{
+			Sources: []HTTPSource{{Name: "stale", Storage: clientStore}},
+		})
+		if err != nil {
+			t.Fatalf("Failed to create the HTTP client.\nError: %s", err)
+		}
+		for _, store := range []Storage{clientStore, client} {
+			jwks, err := QueryKeys(ctx, store, KeyFilter{})
+			switch {
+			case evict && (err != nil || len(jwks) != 0):
+				t.Fatalf("Expected no keys when querying an evicted storage, but got %d keys and %v.", len(jwks), err)
+			case !evict && !errors.Is(err, ErrStaleJWKSet):
+				t.Fatalf("Unexpected error when querying a stale storage.\n  Actual: %v\n  Expected: %s", err, ErrStaleJWKSet)
+			}
+		}
+
+		fail.Store(false)
+		err = handle.Refresh(ctx)
+		if err != nil {
+			t.Fatalf("Failed to refresh.\nError: %s", err)
+		}
+		if stale := <-staleChanges; stale {
+			t.Fatalf("Expected the storage to no longer be stale.")
+		}
+		_, err = clientStore.KeyRead(ctx, kidWritten)
+		if err != nil {
+			t.Fatalf("Failed to read the JWK after a successful refresh.\nError: %s", err)
+		}
+
+		_ = handle.Close()
+		server.Close()
+		cancel()
+	}
+}
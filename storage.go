@@ -2,13 +2,26 @@ package jwkset
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"reflect"
 	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -17,6 +30,15 @@ var (
 	ErrKeyNotFound = errors.New("key not found")
 	// ErrInvalidHTTPStatusCode is returned when the HTTP status code is invalid.
 	ErrInvalidHTTPStatusCode = errors.New("invalid HTTP status code")
+	// ErrStaleJWKSet is returned when reading a key from an HTTP storage that was not refreshed successfully within the
+	// MaxStaleness option.
+	ErrStaleJWKSet = errors.New("JWK Set was not refreshed successfully within the maximum staleness")
+	// ErrHTTPContentType is returned when the Content-Type of a response is not for a JWK Set.
+	ErrHTTPContentType = errors.New("unexpected HTTP Content-Type")
+	// ErrHTTPResponseTooLarge is returned when a response body is larger than the maximum size.
+	ErrHTTPResponseTooLarge = errors.New("HTTP response body too large")
+	// ErrHTTPStorageClosed is returned when refreshing an HTTP storage after it was closed.
+	ErrHTTPStorageClosed = errors.New("HTTP storage is closed")
 )
 
 // Storage handles storage operations for a JWKSet.
@@ -51,55 +73,236 @@ type Storage interface {
 
 var _ Storage = &memoryJWKSet{}
 
+// BatchStorage is optionally implemented by a Storage that can change several keys atomically, such as the in-memory
+// Storage. Concurrent readers observe either none or all of the changes of a call, and a call that returns an error
+// changes nothing.
+type BatchStorage interface {
+	// KeyDeleteBatch deletes the keys with the key IDs. It returns the number of key IDs that were present.
+	KeyDeleteBatch(ctx context.Context, keyIDs []string) (deleted int, err error)
+	// KeyWriteBatch writes the keys in order, as if by KeyWrite.
+	KeyWriteBatch(ctx context.Context, jwks []JWK) error
+	// ReplaceAll replaces all keys in the storage with the keys, in order. Like KeyWriteBatch, the last key of a key ID
+	// wins.
+	ReplaceAll(ctx context.Context, jwks []JWK) error
+}
+
+var _ BatchStorage = &memoryJWKSet{}
+
 type memoryJWKSet struct {
-	set []JWK
-	mux sync.RWMutex
+	mux      sync.Mutex // Serializes writers. Readers only load the snapshot.
+	snapshot atomic.Pointer[memorySnapshot]
+	watches  keyWatchers
+}
+
+// memorySnapshot is an immutable state of a memoryJWKSet. Writers replace the snapshot instead of changing it, so
+// readers never need a lock.
+type memorySnapshot struct {
+	keys    []*JWK         // In insertion order. Pointers make copying the slice cheap.
+	index   map[string]int // Key ID to the position of the first key with that key ID.
+	version uint64         // Incremented by every write.
+
+	// marshaled caches the results of MarshalWithOptions and JSONWithOptions without validation options, indexed by
+	// whether private key material is included.
+	marshaled [2]memoryMarshaled
+
+	// thumbprints indexes the keys by thumbprint and X.509 certificate thumbprint for KeyQuery. It's built on first use.
+	thumbprints memoryThumbprints
+}
+
+// memoryThumbprints maps thumbprints to the positions of the keys in a memorySnapshot.
+type memoryThumbprints struct {
+	once       sync.Once
+	thumbprint map[string][]int
+	x5tS256    map[string][]int
+}
+
+type memoryMarshaled struct {
+	once sync.Once
+	jwks JWKSMarshal
+	json JSONSnapshot
+	err  error
 }
 
-// NewMemoryStorage creates a new in-memory Storage implementation.
+func newMemorySnapshot(keys []*JWK, version uint64) *memorySnapshot {
+	index := make(map[string]int, len(keys))
+	for i, jwk := range keys {
+		kid := jwk.Marshal().KID
+		if _, ok := index[kid]; !ok {
+			index[kid] = i
+		}
+	}
+	return &memorySnapshot{
+		keys:    keys,
+		index:   index,
+		version: version,
+	}
+}
+
+// NewMemoryStorage creates a new in-memory Storage implementation. Reads are lock-free and take constant time. Writes
+// copy the key index, so they take time proportional to the number of keys.
 func NewMemoryStorage() Storage {
-	return &memoryJWKSet{}
+	m := &memoryJWKSet{}
+	m.snapshot.Store(newMemorySnapshot(nil, 0))
+	return m
 }
 
 func (m *memoryJWKSet) KeyDelete(_ context.Context, keyID string) (ok bool, err error) {
 	m.mux.Lock()
 	defer m.mux.Unlock()
-	for i, jwk := range m.set {
-		if jwk.Marshal().KID == keyID {
-			m.set = append(m.set[:i], m.set[i+1:]...)
-			return true, nil
-		}
+	s := m.snapshot.Load()
+	i, ok := s.index[keyID]
+	if !ok {
+		return false, nil
+	}
+	m.snapshot.Store(newMemorySnapshot(slices.Delete(slices.Clone(s.keys), i, i+1), s.version+1))
+	if m.watches.active() {
+		event, _ := keyEvent(keyID, s.keys[i], nil)
+		m.watches.notify(event)
 	}
-	return ok, nil
+	return true, nil
 }
 func (m *memoryJWKSet) KeyRead(_ context.Context, keyID string) (JWK, error) {
-	m.mux.RLock()
-	defer m.mux.RUnlock()
-	for _, jwk := range m.set {
-		if jwk.Marshal().KID == keyID {
-			return jwk, nil
-		}
+	s := m.snapshot.Load()
+	i, ok := s.index[keyID]
+	if !ok {
+		return JWK{}, fmt.Errorf("%w: kid %q", ErrKeyNotFound, keyID)
 	}
-	return JWK{}, fmt.Errorf("%w: kid %q", ErrKeyNotFound, keyID)
+	return *s.keys[i], nil
 }
 func (m *memoryJWKSet) KeyReadAll(_ context.Context) ([]JWK, error) {
-	m.mux.RLock()
-	defer m.mux.RUnlock()
-	return slices.Clone(m.set), nil
+	s := m.snapshot.Load()
+	jwks := make([]JWK, len(s.keys))
+	for i, jwk := range s.keys {
+		jwks[i] = *jwk
+	}
+	return jwks, nil
+}
+func (m *memoryJWKSet) KeyQuery(_ context.Context, filter KeyFilter) ([]JWK, error) {
+	s := m.snapshot.Load()
+	var candidates []int // Positions of the keys to filter, or all keys if nil.
+	switch {
+	case filter.Thumbprint != "":
+		candidates = s.indexThumbprints().thumbprint[filter.Thumbprint]
+	case filter.X5TS256 != "":
+		candidates = s.indexThumbprints().x5tS256[filter.X5TS256]
+	default:
+		candidates = make([]int, len(s.keys))
+		for i := range candidates {
+			candidates[i] = i
+		}
+	}
+	var jwks []JWK
+	for _, i := range candidates {
+		if filter.Matches(*s.keys[i]) {
+			jwks = append(jwks, *s.keys[i])
+		}
+	}
+	return jwks, nil
 }
 func (m *memoryJWKSet) KeyWrite(_ context.Context, jwk JWK) error {
 	m.mux.Lock()
 	defer m.mux.Unlock()
-	for i, j := range m.set {
-		if j.Marshal().KID == jwk.Marshal().KID {
-			m.set[i] = jwk
-			return nil
+	s := m.snapshot.Load()
+	kid := jwk.Marshal().KID
+	keys := slices.Clip(s.keys) // Appending must not write to the shared backing array.
+	index := s.index
+	if i, ok := s.index[kid]; ok {
+		keys = slices.Clone(s.keys)
+		keys[i] = &jwk
+	} else {
+		keys = append(keys, &jwk)
+		index = maps.Clone(s.index)
+		index[kid] = len(keys) - 1
+	}
+	m.snapshot.Store(&memorySnapshot{
+		keys:    keys,
+		index:   index,
+		version: s.version + 1,
+	})
+	if m.watches.active() {
+		var old *JWK
+		if i, ok := s.index[kid]; ok {
+			old = s.keys[i]
+		}
+		if event, ok := keyEvent(kid, old, &jwk); ok {
+			m.watches.notify(event)
 		}
 	}
-	m.set = append(m.set, jwk)
 	return nil
 }
 
+func (m *memoryJWKSet) KeyDeleteBatch(_ context.Context, keyIDs []string) (deleted int, err error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	s := m.snapshot.Load()
+	remove := make(map[int]bool, len(keyIDs))
+	for _, keyID := range keyIDs {
+		if i, ok := s.index[keyID]; ok && !remove[i] {
+			remove[i] = true
+			deleted++
+		}
+	}
+	if deleted == 0 {
+		return 0, nil
+	}
+	keys := make([]*JWK, 0, len(s.keys)-deleted)
+	for i, jwk := range s.keys {
+		if !remove[i] {
+			keys = append(keys, jwk)
+		}
+	}
+	m.replace(s, keys)
+	return deleted, nil
+}
+func (m *memoryJWKSet) KeyWriteBatch(_ context.Context, jwks []JWK) error {
+	if len(jwks) == 0 {
+		return nil
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	s := m.snapshot.Load()
+	keys := slices.Clone(s.keys)
+	index := maps.Clone(s.index)
+	for i := range jwks {
+		jwk := jwks[i]
+		kid := jwk.Marshal().KID
+		if i, ok := index[kid]; ok {
+			keys[i] = &jwk
+		} else {
+			index[kid] = len(keys)
+			keys = append(keys, &jwk)
+		}
+	}
+	m.replace(s, keys)
+	return nil
+}
+func (m *memoryJWKSet) ReplaceAll(_ context.Context, jwks []JWK) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	keys := make([]*JWK, 0, len(jwks))
+	index := make(map[string]int, len(jwks))
+	for i := range jwks {
+		jwk := jwks[i]
+		kid := jwk.Marshal().KID
+		if i, ok := index[kid]; ok {
+			keys[i] = &jwk // Like KeyWriteBatch, the last key of a key ID wins.
+		} else {
+			index[kid] = len(keys)
+			keys = append(keys, &jwk)
+		}
+	}
+	m.replace(m.snapshot.Load(), keys)
+	return nil
+}
+
+// replace stores the keys as the snapshot after old and notifies the watches. The caller must hold m.mux.
+func (m *memoryJWKSet) replace(old *memorySnapshot, keys []*JWK) {
+	m.snapshot.Store(newMemorySnapshot(keys, old.version+1))
+	if m.watches.active() {
+		m.watches.notify(keyEvents(old.keys, keys)...)
+	}
+}
+
 func (m *memoryJWKSet) JSON(ctx context.Context) (json.RawMessage, error) {
 	jwks, err := m.Marshal(ctx)
 	if err != nil {
@@ -117,12 +320,33 @@ func (m *memoryJWKSet) JSONPrivate(ctx context.Context) (json.RawMessage, error)
 	return m.JSONWithOptions(ctx, marshalOptions, JWKValidateOptions{})
 }
 func (m *memoryJWKSet) JSONWithOptions(ctx context.Context, marshalOptions JWKMarshalOptions, validationOptions JWKValidateOptions) (json.RawMessage, error) {
+	if reflect.ValueOf(validationOptions).IsZero() {
+		snapshot, err := m.JSONSnapshot(ctx, marshalOptions)
+		if err != nil {
+			return nil, err
+		}
+		return slices.Clone(snapshot.JSON), nil
+	}
 	jwks, err := m.MarshalWithOptions(ctx, marshalOptions, validationOptions)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal JWK Set with options: %w", err)
 	}
 	return json.Marshal(jwks)
 }
+
+func (m *memoryJWKSet) Watch(ctx context.Context) (<-chan KeyEvent, error) {
+	return m.watches.watch(ctx), nil
+}
+
+// JSONSnapshot implements JSONSnapshotter. The result is computed once per change to the keys.
+func (m *memoryJWKSet) JSONSnapshot(_ context.Context, marshalOptions JWKMarshalOptions) (JSONSnapshot, error) {
+	s := m.snapshot.Load()
+	cached := s.cached(marshalOptions)
+	if cached.err != nil {
+		return JSONSnapshot{}, cached.err
+	}
+	return cached.json, nil
+}
 func (m *memoryJWKSet) Marshal(ctx context.Context) (JWKSMarshal, error) {
 	keys, err := m.KeyReadAll(ctx)
 	if err != nil {
@@ -134,14 +358,91 @@ func (m *memoryJWKSet) Marshal(ctx context.Context) (JWKSMarshal, error) {
 	}
 	return jwks, nil
 }
-func (m *memoryJWKSet) MarshalWithOptions(ctx context.Context, marshalOptions JWKMarshalOptions, validationOptions JWKValidateOptions) (JWKSMarshal, error) {
-	jwks := JWKSMarshal{}
+func (m *memoryJWKSet) MarshalWithOptions(_ context.Context, marshalOptions JWKMarshalOptions, validationOptions JWKValidateOptions) (JWKSMarshal, error) {
+	s := m.snapshot.Load()
+	if !reflect.ValueOf(validationOptions).IsZero() {
+		return marshalKeys(s.keys, marshalOptions, validationOptions)
+	}
+	cached := s.cached(marshalOptions)
+	if cached.err != nil {
+		return JWKSMarshal{}, cached.err
+	}
+	return JWKSMarshal{Keys: slices.Clone(cached.jwks.Keys)}, nil
+}
 
-	keys, err := m.KeyReadAll(ctx)
-	if err != nil {
-		return JWKSMarshal{}, fmt.Errorf("failed to read snapshot of all keys from storage: %w", err)
+// indexThumbprints returns the thumbprint indexes of the snapshot, building them on first use.
+func (s *memorySnapshot) indexThumbprints() *memoryThumbprints {
+	t := &s.thumbprints
+	t.once.Do(func() {
+		t.thumbprint = make(map[string][]int, len(s.keys))
+		t.x5tS256 = make(map[string][]int)
+		for i, jwk := range s.keys {
+			thumbprint, err := jwk.Thumbprint()
+			if err == nil {
+				t.thumbprint[thumbprint] = append(t.thumbprint[thumbprint], i)
+			}
+			if x5tS256 := jwk.Marshal().X5TS256; x5tS256 != "" {
+				t.x5tS256[x5tS256] = append(t.x5tS256[x5tS256], i)
+			}
+		}
+	})
+	return t
+}
+
+// cached returns the marshaled keys and JSON for the marshal options, computing them on first use.
+func (s *memorySnapshot) cached(marshalOptions JWKMarshalOptions) *memoryMarshaled {
+	i := 0
+	if marshalOptions.Private {
+		i = 1
+	}
+	cached := &s.marshaled[i]
+	cached.once.Do(func() {
+		cached.jwks, cached.err = marshalKeys(s.keys, marshalOptions, JWKValidateOptions{})
+		if cached.err != nil {
+			return
+		}
+		raw, err := json.Marshal(cached.jwks)
+		if err != nil {
+			cached.err = fmt.Errorf("failed to marshal JWK Set with options: %w", err)
+			return
+		}
+		cached.json = newJSONSnapshot(raw, s.version)
+	})
+	return cached
+}
+
+// JSONSnapshot is the serialized JSON of a JWK Set at one point in time.
+type JSONSnapshot struct {
+	// ETag is a strong HTTP entity tag for JSON, including the surrounding quotes.
+	ETag string
+	// JSON is the serialized JWK Set. It may be shared with other callers, so it must not be modified.
+	JSON json.RawMessage
+	// Version changes every time the keys in the Storage change. It is only comparable between snapshots of the same
+	// Storage.
+	Version uint64
+}
+
+// JSONSnapshotter is implemented by Storage implementations that cache their serialized JWK Set until the keys change,
+// such as the in-memory Storage. HTTP handlers can use it to serve the JWK Set and answer conditional requests without
+// marshaling every key for each request.
+type JSONSnapshotter interface {
+	// JSONSnapshot returns the JSON of the JWK Set with the given marshal options.
+	JSONSnapshot(ctx context.Context, marshalOptions JWKMarshalOptions) (JSONSnapshot, error)
+}
+
+func newJSONSnapshot(raw json.RawMessage, version uint64) JSONSnapshot {
+	sum := sha256.Sum256(raw)
+	return JSONSnapshot{
+		ETag:    `"` + base64.RawURLEncoding.EncodeToString(sum[:]) + `"`,
+		JSON:    raw,
+		Version: version,
 	}
+}
 
+// marshalKeys marshals the keys with the given options. Keys that can't be marshaled with the options, such as
+// symmetric keys without private key material, are skipped.
+func marshalKeys(keys []*JWK, marshalOptions JWKMarshalOptions, validationOptions JWKValidateOptions) (JWKSMarshal, error) {
+	jwks := JWKSMarshal{}
 	for _, key := range keys {
 		options := key.options
 		options.Marshal = marshalOptions
@@ -155,63 +456,276 @@ func (m *memoryJWKSet) MarshalWithOptions(ctx context.Context, marshalOptions JW
 		}
 		jwks.Keys = append(jwks.Keys, marshal)
 	}
-
 	return jwks, nil
 }
 
+// KeyChanges describes how the keys in a Storage changed during an operation. Each field contains key IDs.
+type KeyChanges struct {
+	// Added are the key IDs that were not present before the operation.
+	Added []string
+	// Changed are the key IDs that were present before the operation, but whose JWK is different afterward.
+	Changed []string
+	// Removed are the key IDs that were present before the operation, but are no longer present.
+	Removed []string
+}
+
+// Empty reports whether there were no changes.
+func (k KeyChanges) Empty() bool {
+	return len(k.Added) == 0 && len(k.Changed) == 0 && len(k.Removed) == 0
+}
+
+// RetryOptions configure how failed HTTP requests are retried with exponential backoff. Only transient errors are
+// retried. These are HTTP 408, 429, and 5xx status codes, timeouts, and connections that are refused, reset, or closed
+// unexpectedly.
+//
+// Retries are disabled unless MaxRetries or Deadline is set. If both are set, retries stop when either is reached.
+type RetryOptions struct {
+	// Deadline is the maximum amount of time from the first attempt after which no more retries are made.
+	Deadline time.Duration
+
+	// InitialBackoff is the amount of time to wait before the first retry.
+	//
+	// This defaults to time.Second.
+	InitialBackoff time.Duration
+
+	// MaxBackoff is the maximum amount of time to wait between retries.
+	//
+	// This defaults to time.Minute.
+	MaxBackoff time.Duration
+
+	// MaxRetries is the maximum number of retries after the first attempt.
+	MaxRetries int
+
+	// Multiplier is the factor the wait time is multiplied by after each retry.
+	//
+	// This defaults to 2.
+	Multiplier float64
+}
+
+func (r RetryOptions) enabled() bool {
+	return r.MaxRetries > 0 || r.Deadline > 0
+}
+
 // HTTPClientStorageOptions are used to configure the behavior of NewStorageFromHTTP.
 type HTTPClientStorageOptions struct {
+	// BearerToken is a function that returns a token to send in the Authorization header with the Bearer scheme. It is
+	// called for each HTTP request, so it can return a token that changes over time.
+	BearerToken func(ctx context.Context) (string, error)
+
 	// Client is the HTTP client to use for requests.
 	//
 	// This defaults to http.DefaultClient.
 	Client *http.Client
 
+	// ClientCertificates are TLS client certificates to present for mutual TLS. The Client option is copied with a clone
+	// of its transport that has these certificates, so its transport must be nil or an *http.Transport. Use
+	// TLSCertificateFromJWK to create a certificate from a JWK with a private key and X.509 certificate chain.
+	ClientCertificates []tls.Certificate
+
 	// Ctx is used when performing HTTP requests. It is also used to end the refresh goroutine when it's no longer
 	// needed.
 	//
 	// This defaults to context.Background().
 	Ctx context.Context
 
+	// Decoder decodes the keys from the body of an HTTP response. Use DecodeX509CertificateMap, DecodeJWK, or DecodePEM
+	// for endpoints that do not publish a JWK Set.
+	//
+	// This defaults to DecodeJWKSet.
+	Decoder JWKSetDecoder
+
+	// HTTPCheckContentType requires the Content-Type of a response to be application/jwk-set+json or application/json.
+	// It should not be used with a Decoder for a format other than JSON, such as DecodePEM.
+	HTTPCheckContentType bool
+
 	// HTTPExpectedStatus is the expected HTTP status code for the HTTP request.
 	//
 	// This defaults to http.StatusOK.
 	HTTPExpectedStatus int
 
+	// HTTPHeader are headers added to each HTTP request.
+	HTTPHeader http.Header
+
+	// HTTPMaxBodySize is the maximum size of a response body in bytes. Larger responses fail the refresh.
+	//
+	// By default, there is no maximum size.
+	HTTPMaxBodySize int64
+
 	// HTTPMethod is the HTTP method to use for the HTTP request.
 	//
 	// This defaults to http.MethodGet.
 	HTTPMethod string
 
+	// HTTPRequestHook is a function that can modify each HTTP request before it is sent. It is called after all other
+	// request options are applied. Returning an error fails the refresh.
+	HTTPRequestHook func(req *http.Request) error
+
 	// HTTPTimeout is the timeout for the HTTP request. When the Ctx option is also provided, this value is used for a
 	// child context.
 	//
 	// This defaults to time.Minute.
 	HTTPTimeout time.Duration
 
+	// HTTPUserAgent is the User-Agent header to send with each HTTP request.
+	//
+	// This defaults to the User-Agent of the Go standard library.
+	HTTPUserAgent string
+
+	// NoConditionalRequests disables conditional HTTP requests. By default, the ETag and Last-Modified headers of the
+	// last successful response are sent back in the If-None-Match and If-Modified-Since headers, and an HTTP 304 Not
+	// Modified response is treated as a successful refresh that keeps the previously fetched JWK Set.
+	NoConditionalRequests bool
+
 	// NoErrorReturnFirstHTTPReq will create the Storage without error if the first HTTP request fails.
 	NoErrorReturnFirstHTTPReq bool
 
+	// MaxStaleness is the maximum amount of time since the last successful refresh during which keys are trusted. If
+	// the Storage was never refreshed successfully, the time is counted from its creation. Once the Storage is stale,
+	// KeyRead returns ErrStaleJWKSet until a refresh succeeds.
+	//
+	// By default, keys are trusted regardless of when the last successful refresh was.
+	MaxStaleness time.Duration
+
+	// MaxStalenessEvict deletes all keys from the Storage when it becomes stale instead of making KeyRead return
+	// ErrStaleJWKSet. The keys are restored by the next successful refresh. This is only effectual if MaxStaleness is set.
+	MaxStalenessEvict bool
+
+	// PersistentCacheDir is a directory to keep the last successfully fetched JWK Set in, along with when it was fetched
+	// and its ETag. There is one file per URL and it is updated after each successful refresh. If the first HTTP
+	// request fails, the file is loaded instead and the error is passed to the RefreshErrorHandler. The file may
+	// contain private key material if the remote HTTP resource does, so it is created with 0600 permissions.
+	//
+	// By default, there is no persistent cache.
+	PersistentCacheDir string
+
+	// PersistentCacheMaxAge is the maximum age of a persistent cache file that can be loaded. If the JWK Set in the
+	// file was fetched longer ago than this, its keys are not trusted and the first HTTP request fails as if there were
+	// no persistent cache. This is only effectual if PersistentCacheDir is set.
+	//
+	// By default, there is no maximum age.
+	PersistentCacheMaxAge time.Duration
+
+	// RefreshCacheHeaders derives the time until the next refresh from the Cache-Control max-age directive or the
+	// Expires header of the last response. The derived time is clamped between RefreshIntervalMin and
+	// RefreshIntervalMax. If the response has neither header, RefreshInterval is used. This is only effectual if
+	// RefreshInterval is set.
+	RefreshCacheHeaders bool
+
+	// RefreshChangeHandler is a function that consumes the key changes made to the Storage by a successful HTTP
+	// refresh. It is not called if a refresh did not change the Storage.
+	RefreshChangeHandler func(ctx context.Context, changes KeyChanges)
+
 	// RefreshErrorHandler is a function that consumes errors that happen during an HTTP refresh. This is only effectual
 	// if RefreshInterval is set.
 	//
 	// If NoErrorReturnFirstHTTPReq is set, this function will be called when if the first HTTP request fails.
 	RefreshErrorHandler func(ctx context.Context, err error)
 
+	// RefreshGracePeriod is the amount of time a key that is no longer present in the remote HTTP resource is kept in
+	// the Storage. The grace period starts at the first refresh that does not contain the key and is checked on every
+	// following refresh. Keys that reappear in the remote HTTP resource are no longer considered removed.
+	//
+	// By default, keys are removed from the Storage as soon as a refresh does not contain them.
+	RefreshGracePeriod time.Duration
+
 	// RefreshInterval is the interval at which the HTTP URL is refreshed and the JWK Set is processed. This option will
 	// launch a "refresh goroutine" to refresh the remote HTTP resource at the given interval.
 	//
 	// Provide the Ctx option to end the goroutine when it's no longer needed.
 	RefreshInterval time.Duration
 
-	// Storage is the underlying storage implementation to use.
+	// RefreshIntervalMax is the maximum time until the next refresh when it is derived from cache headers. This is only
+	// effectual if RefreshCacheHeaders is set.
+	//
+	// This defaults to 24 hours.
+	RefreshIntervalMax time.Duration
+
+	// RefreshIntervalMin is the minimum time until the next refresh when it is derived from cache headers. This is only
+	// effectual if RefreshCacheHeaders is set.
+	//
+	// This defaults to time.Minute.
+	RefreshIntervalMin time.Duration
+
+	// RefreshJitter is the maximum fraction of a wait time that is randomly added to or subtracted from it. It applies
+	// to the time until the next scheduled refresh and to the backoff between retries, so that many replicas do not
+	// refresh in lockstep. For example, 0.1 changes each wait time by up to 10%. Values are capped at 1.
+	RefreshJitter float64
+
+	// RefreshRetry configures retries of failed scheduled refreshes and of the first HTTP request. The
+	// RefreshErrorHandler is only called after the last attempt fails.
+	RefreshRetry RetryOptions
+
+	// StaleHandler is a function that is called with true when the Storage becomes stale and with false when it is no
+	// longer stale after a successful refresh. This is only effectual if MaxStaleness is set.
+	StaleHandler func(ctx context.Context, stale bool)
+
+	// Storage is the underlying storage implementation to use. Each refresh reconciles the Storage to match the remote
+	// HTTP resource, so keys written by other means may be removed. If the Storage implements BatchStorage, such as the
+	// Storage returned by NewMemoryStorage, the reconciliation is atomic. Otherwise, it's best-effort: keys are written
+	// and deleted one at a time, so readers may observe a partial reconciliation, and if a change fails, the previous
+	// keys are restored the same way before the refresh returns an error. The HTTP storage
+	// implements StorageWatcher by watching this Storage, so a Storage without support should be wrapped with
+	// NewWatchedStorage.
 	//
 	// This defaults to NewMemoryStorage().
 	Storage Storage
 }
 
+// HTTPRefreshStatus describes the most recent refresh of an HTTP storage.
+type HTTPRefreshStatus struct {
+	// Attempted is when the most recent refresh finished, successful or not. It is the zero value if no refresh
+	// finished yet.
+	Attempted time.Time
+	// Err is the error of the most recent refresh. It is nil if the most recent refresh was successful.
+	Err error
+	// ETag is the ETag header of the most recent successful response.
+	ETag string
+	// KeyCount is the number of keys in the remote HTTP resource as of the most recent successful refresh.
+	KeyCount int
+	// StatusCode is the HTTP status code of the most recent response. It is 0 if the most recent refresh did not get
+	// a response.
+	StatusCode int
+	// Succeeded is when the most recent successful refresh finished. It is the zero value if no refresh succeeded yet.
+	Succeeded time.Time
+}
+
+// HTTPStorageHandle controls the lifecycle of a Storage created by NewStorageFromHTTPWithHandle.
+type HTTPStorageHandle interface {
+	// Close stops the refresh goroutine and waits for it to exit. Keys that were already fetched can still be read
+	// from the Storage. Close always returns nil.
+	Close() error
+	// LastRefresh returns the status of the most recent refresh.
+	LastRefresh() HTTPRefreshStatus
+	// Refresh requests the remote HTTP resource and reconciles the Storage with it. It returns after the refresh
+	// completes or the context is over. If another refresh is in progress, its result is shared instead.
+	Refresh(ctx context.Context) error
+}
+
 type httpStorage struct {
 	options HTTPClientStorageOptions
-	refresh func(ctx context.Context) error
+	u       *url.URL
+	flight  flightGroup
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	statusMux sync.RWMutex
+	status    HTTPRefreshStatus
+
+	created    time.Time
+	staleMux   sync.Mutex
+	stale      bool
+	staleTimer *time.Timer
+
+	mux          sync.Mutex // Held for the duration of a refresh.
+	cacheFor     time.Duration
+	etag         string
+	fetched      []JWK
+	lastModified string
+	raw          []byte
+	removedAt    map[string]time.Time
+
 	Storage
 }
 
@@ -219,13 +733,31 @@ type httpStorage struct {
 // the RefreshInterval option is not set, the remote HTTP resource will be requested and processed before returning. If
 // the RefreshInterval option is set, a background goroutine will be launched to refresh the remote HTTP resource and
 // not block the return of this function.
+//
+// Each refresh replaces the keys in the Storage with the keys in the remote HTTP resource, subject to the
+// RefreshGracePeriod option.
+//
+// Use NewStorageFromHTTPWithHandle to stop the refresh goroutine or refresh on demand.
 func NewStorageFromHTTP(u *url.URL, options HTTPClientStorageOptions) (Storage, error) {
+	store, _, err := NewStorageFromHTTPWithHandle(u, options)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// NewStorageFromHTTPWithHandle is the same as NewStorageFromHTTP, but it also returns a handle to control the lifecycle
+// of the Storage and report the status of its refreshes.
+func NewStorageFromHTTPWithHandle(u *url.URL, options HTTPClientStorageOptions) (Storage, HTTPStorageHandle, error) {
 	if options.Client == nil {
 		options.Client = http.DefaultClient
 	}
 	if options.Ctx == nil {
 		options.Ctx = context.Background()
 	}
+	if options.Decoder == nil {
+		options.Decoder = DecodeJWKSet
+	}
 	if options.HTTPExpectedStatus == 0 {
 		options.HTTPExpectedStatus = http.StatusOK
 	}
@@ -235,83 +767,528 @@ func NewStorageFromHTTP(u *url.URL, options HTTPClientStorageOptions) (Storage,
 	if options.HTTPMethod == "" {
 		options.HTTPMethod = http.MethodGet
 	}
+	if options.RefreshIntervalMax == 0 {
+		options.RefreshIntervalMax = 24 * time.Hour
+	}
+	if options.RefreshIntervalMin == 0 {
+		options.RefreshIntervalMin = time.Minute
+	}
+	options.RefreshJitter = min(max(options.RefreshJitter, 0), 1)
+	if options.RefreshRetry.InitialBackoff == 0 {
+		options.RefreshRetry.InitialBackoff = time.Second
+	}
+	if options.RefreshRetry.MaxBackoff == 0 {
+		options.RefreshRetry.MaxBackoff = time.Minute
+	}
+	if options.RefreshRetry.Multiplier == 0 {
+		options.RefreshRetry.Multiplier = 2
+	}
+	if len(options.ClientCertificates) > 0 {
+		client, err := clientWithCertificates(options.Client, options.ClientCertificates)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to configure client certificates: %w", err)
+		}
+		options.Client = client
+	}
 	store := options.Storage
 	if store == nil {
 		store = NewMemoryStorage()
 	}
 
-	refresh := func(ctx context.Context) error {
-		req, err := http.NewRequestWithContext(ctx, options.HTTPMethod, u.String(), nil)
-		if err != nil {
-			return fmt.Errorf("failed to create HTTP request for JWK Set refresh: %w", err)
-		}
-		resp, err := options.Client.Do(req)
-		if err != nil {
-			return fmt.Errorf("failed to perform HTTP request for JWK Set refresh: %w", err)
-		}
-		//goland:noinspection GoUnhandledErrorResult
-		defer resp.Body.Close()
-		if resp.StatusCode != options.HTTPExpectedStatus {
-			return fmt.Errorf("%w: %d", ErrInvalidHTTPStatusCode, resp.StatusCode)
-		}
-		var jwks JWKSMarshal
-		err = json.NewDecoder(resp.Body).Decode(&jwks)
-		if err != nil {
-			return fmt.Errorf("failed to decode JWK Set response: %w", err)
-		}
-		for _, marshal := range jwks.Keys {
-			marshalOptions := JWKMarshalOptions{
-				Private: true,
-			}
-			jwk, err := NewJWKFromMarshal(marshal, marshalOptions, JWKValidateOptions{})
-			if err != nil {
-				return fmt.Errorf("failed to create JWK from JWK Marshal: %w", err)
-			}
-			err = store.KeyWrite(options.Ctx, jwk)
-			if err != nil {
-				return fmt.Errorf("failed to write JWK to memory storage: %w", err)
-			}
-		}
-		return nil
+	ctx, cancel := context.WithCancel(options.Ctx)
+	s := &httpStorage{
+		options: options,
+		u:       u,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		flight: flightGroup{
+			stop:    ctx,
+			timeout: options.HTTPTimeout,
+		},
+		created:   time.Now(),
+		cacheFor:  -1,
+		removedAt: make(map[string]time.Time),
+		Storage:   store,
 	}
 
 	if options.RefreshInterval != 0 {
 		go func() { // Refresh goroutine.
-			ticker := time.NewTicker(options.RefreshInterval)
-			defer ticker.Stop()
+			defer close(s.done)
+			timer := time.NewTimer(jitter(options.RefreshInterval, options.RefreshJitter))
+			defer timer.Stop()
 			for {
 				select {
-				case <-options.Ctx.Done():
+				case <-ctx.Done():
 					return
-				case <-ticker.C:
-					ctx, cancel := context.WithTimeout(options.Ctx, options.HTTPTimeout)
-					err := refresh(ctx)
-					cancel()
+				case <-timer.C:
+					err := s.refreshWithRetry(ctx)
 					if err != nil && options.RefreshErrorHandler != nil {
 						options.RefreshErrorHandler(ctx, err)
 					}
+					timer.Reset(jitter(s.nextRefresh(), options.RefreshJitter))
 				}
 			}
 		}()
+	} else {
+		close(s.done)
 	}
 
-	ctx, cancel := context.WithTimeout(options.Ctx, options.HTTPTimeout)
-	defer cancel()
-	err := refresh(ctx)
-	cancel()
+	err := s.refreshWithRetry(ctx)
+	if err != nil {
+		s.resetStaleness(s.created)
+	}
+	if err != nil && options.PersistentCacheDir != "" {
+		cacheErr := s.loadPersistentCache(ctx)
+		if cacheErr == nil {
+			if options.RefreshErrorHandler != nil {
+				options.RefreshErrorHandler(ctx, fmt.Errorf("using persistent cache after failed first HTTP request for JWK Set: %w", err))
+			}
+			return s, s, nil
+		}
+		err = errors.Join(err, cacheErr)
+	}
 	if err != nil {
 		if options.NoErrorReturnFirstHTTPReq {
-			options.RefreshErrorHandler(ctx, err)
-			return store, nil
+			if options.RefreshErrorHandler != nil {
+				options.RefreshErrorHandler(ctx, err)
+			}
+			return s, s, nil
 		}
-		return nil, fmt.Errorf("failed to perform first HTTP request for JWK Set: %w", err)
+		_ = s.Close()
+		return nil, nil, fmt.Errorf("failed to perform first HTTP request for JWK Set: %w", err)
 	}
 
-	s := httpStorage{
-		options: options,
-		refresh: refresh,
-		Storage: store,
+	return s, s, nil
+}
+
+func (s *httpStorage) Close() error {
+	s.cancel()
+	<-s.done
+	s.staleMux.Lock()
+	if s.staleTimer != nil {
+		s.staleTimer.Stop()
+	}
+	s.staleMux.Unlock()
+	return nil
+}
+func (s *httpStorage) LastRefresh() HTTPRefreshStatus {
+	s.statusMux.RLock()
+	defer s.statusMux.RUnlock()
+	return s.status
+}
+func (s *httpStorage) Refresh(ctx context.Context) error {
+	if s.ctx.Err() != nil {
+		return ErrHTTPStorageClosed
+	}
+	return s.refresh(ctx)
+}
+func (s *httpStorage) Watch(ctx context.Context) (<-chan KeyEvent, error) {
+	watcher, ok := s.Storage.(StorageWatcher)
+	if !ok {
+		return nil, fmt.Errorf("%w: the underlying Storage does not implement StorageWatcher", ErrWatchUnsupported)
+	}
+	return watcher.Watch(ctx)
+}
+
+func (s *httpStorage) refreshOnDemand(ctx context.Context) error {
+	refreshCtx, cancel := context.WithTimeout(ctx, s.options.HTTPTimeout)
+	defer cancel()
+	err := s.refresh(refreshCtx)
+	if err != nil && s.options.RefreshErrorHandler != nil {
+		s.options.RefreshErrorHandler(ctx, err)
+	}
+	return err
+}
+
+// refresh fetches the remote HTTP resource and reconciles the Storage with it. Concurrent calls share the result of a
+// single HTTP request, which is limited by the HTTPTimeout option and ends when the Storage is closed, not when the
+// context of the caller that started it is over.
+func (s *httpStorage) refresh(ctx context.Context) error {
+	return s.flight.do(ctx, "", func(ctx context.Context) error {
+		return s.fetchAndReconcile(ctx)
+	})
+}
+
+func (s *httpStorage) fetchAndReconcile(ctx context.Context) (err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	var statusCode int
+	defer func() {
+		now := time.Now()
+		s.statusMux.Lock()
+		s.status.Attempted = now
+		s.status.Err = err
+		s.status.StatusCode = statusCode
+		if err == nil {
+			s.status.ETag = s.etag
+			s.status.KeyCount = len(s.fetched)
+			s.status.Succeeded = now
+		}
+		s.statusMux.Unlock()
+		if err == nil {
+			s.resetStaleness(now)
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, s.options.HTTPMethod, s.u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request for JWK Set refresh: %w", err)
+	}
+	conditional := !s.options.NoConditionalRequests && s.fetched != nil
+	if conditional {
+		if s.etag != "" {
+			req.Header.Set("If-None-Match", s.etag)
+		}
+		if s.lastModified != "" {
+			req.Header.Set("If-Modified-Since", s.lastModified)
+		}
+	}
+	err = s.prepareRequest(req)
+	if err != nil {
+		return fmt.Errorf("failed to prepare HTTP request for JWK Set refresh: %w", err)
+	}
+	resp, err := s.options.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to perform HTTP request for JWK Set refresh: %w", err)
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+	statusCode = resp.StatusCode
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		s.cacheFor = cacheLifetime(resp.Header, time.Now())
+		err = s.reconcile(ctx, s.fetched)
+		if err != nil {
+			return err
+		}
+		s.savePersistentCache(ctx)
+		return nil
+	}
+	if resp.StatusCode != s.options.HTTPExpectedStatus {
+		return httpStatusError{statusCode: resp.StatusCode}
+	}
+	if s.options.HTTPCheckContentType {
+		err = checkJWKSetContentType(resp.Header.Get("Content-Type"))
+		if err != nil {
+			return err
+		}
+	}
+	raw, err := readBody(resp.Body, s.options.HTTPMaxBodySize)
+	if err != nil {
+		return fmt.Errorf("failed to read JWK Set response: %w", err)
+	}
+	fetched, err := s.options.Decoder(raw)
+	if err != nil {
+		return err
+	}
+	err = s.reconcile(ctx, fetched)
+	if err != nil {
+		return err
+	}
+	s.cacheFor = cacheLifetime(resp.Header, time.Now())
+	s.etag = resp.Header.Get("ETag")
+	s.fetched = fetched
+	s.lastModified = resp.Header.Get("Last-Modified")
+	s.raw = raw
+	s.savePersistentCache(ctx)
+	return nil
+}
+
+// prepareRequest applies the request options to an HTTP request.
+func (s *httpStorage) prepareRequest(req *http.Request) error {
+	for name, values := range s.options.HTTPHeader {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if s.options.HTTPUserAgent != "" {
+		req.Header.Set("User-Agent", s.options.HTTPUserAgent)
+	}
+	if s.options.BearerToken != nil {
+		token, err := s.options.BearerToken(req.Context())
+		if err != nil {
+			return fmt.Errorf("failed to get bearer token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if s.options.HTTPRequestHook != nil {
+		err := s.options.HTTPRequestHook(req)
+		if err != nil {
+			return fmt.Errorf("failed to run HTTP request hook: %w", err)
+		}
+	}
+	return nil
+}
+
+// readBody reads a response body up to maxSize bytes. A maxSize of 0 or less means there is no maximum size.
+func readBody(body io.Reader, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		return io.ReadAll(body)
+	}
+	raw, err := io.ReadAll(io.LimitReader(body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(raw)) > maxSize {
+		return nil, fmt.Errorf("%w: exceeds %d bytes", ErrHTTPResponseTooLarge, maxSize)
+	}
+	return raw, nil
+}
+
+// checkJWKSetContentType returns an error if the given Content-Type header is not for a JWK Set.
+func checkJWKSetContentType(contentType string) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("failed to parse Content-Type %q: %w", contentType, errors.Join(err, ErrHTTPContentType))
+	}
+	switch mediaType {
+	case "application/jwk-set+json", "application/json":
+		return nil
 	}
+	return fmt.Errorf("%w: %q", ErrHTTPContentType, mediaType)
+}
 
-	return s, nil
+// clientWithCertificates returns a copy of the client with a transport that presents the given TLS client certificates.
+func clientWithCertificates(client *http.Client, certs []tls.Certificate) (*http.Client, error) {
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	t, ok := transport.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("%w: client transport must be an *http.Transport to add client certificates, but got %T", ErrOptions, transport)
+	}
+	t = t.Clone()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.Certificates = append(slices.Clone(t.TLSClientConfig.Certificates), certs...)
+	c := *client
+	c.Transport = t
+	return &c, nil
+}
+
+// refreshWithRetry performs a refresh, limited by the HTTPTimeout option, and retries it according to the RefreshRetry
+// option.
+func (s *httpStorage) refreshWithRetry(ctx context.Context) error {
+	retry := s.options.RefreshRetry
+	start := time.Now()
+	backoff := retry.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		reqCtx, cancel := context.WithTimeout(ctx, s.options.HTTPTimeout)
+		err := s.refresh(reqCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if !retry.enabled() || !transientError(err) || ctx.Err() != nil {
+			return err
+		}
+		if retry.MaxRetries > 0 && attempt > retry.MaxRetries {
+			return fmt.Errorf("failed to refresh JWK Set after %d attempts: %w", attempt, err)
+		}
+		wait := jitter(backoff, s.options.RefreshJitter)
+		if retry.Deadline > 0 && time.Since(start)+wait > retry.Deadline {
+			return fmt.Errorf("failed to refresh JWK Set after %d attempts within %s: %w", attempt, retry.Deadline, err)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff = min(time.Duration(float64(backoff)*retry.Multiplier), retry.MaxBackoff)
+	}
+}
+
+// nextRefresh returns the time to wait before the next scheduled refresh.
+func (s *httpStorage) nextRefresh() time.Duration {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if !s.options.RefreshCacheHeaders || s.cacheFor < 0 {
+		return s.options.RefreshInterval
+	}
+	return min(max(s.cacheFor, s.options.RefreshIntervalMin), s.options.RefreshIntervalMax)
+}
+
+// httpStatusError is returned when a response has an unexpected HTTP status code.
+type httpStatusError struct {
+	statusCode int
+}
+
+func (e httpStatusError) Error() string {
+	return fmt.Sprintf("%s: %d", ErrInvalidHTTPStatusCode, e.statusCode)
+}
+func (e httpStatusError) Unwrap() error {
+	return ErrInvalidHTTPStatusCode
+}
+
+// transientError reports whether a failed HTTP request is worth retrying.
+func transientError(err error) bool {
+	var statusErr httpStatusError
+	if errors.As(err, &statusErr) {
+		switch code := statusErr.statusCode; {
+		case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests, code >= 500:
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// jitter randomly changes d by up to the given fraction of d in either direction.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 || d <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*fraction*float64(d))
+}
+
+// cacheLifetime determines how long a response is fresh from its Cache-Control and Expires headers, as described in
+// RFC 9111. If neither header is present, the returned duration is negative.
+func cacheLifetime(header http.Header, now time.Time) time.Duration {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-cache", "no-store":
+			return 0
+		case "max-age":
+			seconds, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+			if err != nil || seconds < 0 {
+				return 0
+			}
+			lifetime := time.Duration(seconds) * time.Second
+			if age, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && age > 0 {
+				lifetime -= time.Duration(age) * time.Second
+			}
+			return max(lifetime, 0)
+		}
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0 // Invalid dates, such as "0", represent a time in the past.
+		}
+		if date, err := http.ParseTime(header.Get("Date")); err == nil {
+			now = date
+		}
+		return max(t.Sub(now), 0)
+	}
+	return -1
+}
+
+// reconcile makes the underlying Storage match the fetched keys, keeping removed keys during the grace period. It's
+// atomic only if the Storage implements BatchStorage. Otherwise, a failure restores the previous keys on a best-effort
+// basis, and the error says whether that succeeded. The caller must hold s.mux.
+func (s *httpStorage) reconcile(ctx context.Context, fetched []JWK) error {
+	old, err := s.Storage.KeyReadAll(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot of all keys from storage: %w", err)
+	}
+	oldByKID := make(map[string]JWK, len(old))
+	for _, jwk := range old {
+		oldByKID[jwk.Marshal().KID] = jwk
+	}
+
+	var changes KeyChanges
+	final := make([]JWK, 0, len(fetched))
+	index := make(map[string]int, len(fetched))
+	for _, jwk := range fetched {
+		kid := jwk.Marshal().KID
+		if i, ok := index[kid]; ok {
+			final[i] = jwk // Match the overwrite behavior of KeyWrite for duplicate key IDs.
+			continue
+		}
+		index[kid] = len(final)
+		final = append(final, jwk)
+	}
+	for _, jwk := range final {
+		kid := jwk.Marshal().KID
+		delete(s.removedAt, kid)
+		prev, ok := oldByKID[kid]
+		switch {
+		case !ok:
+			changes.Added = append(changes.Added, kid)
+		case !reflect.DeepEqual(prev.Marshal(), jwk.Marshal()):
+			changes.Changed = append(changes.Changed, kid)
+		}
+	}
+
+	now := time.Now()
+	var removed []string
+	for _, jwk := range old {
+		kid := jwk.Marshal().KID
+		if _, ok := index[kid]; ok {
+			continue
+		}
+		if s.options.RefreshGracePeriod > 0 {
+			removedAt, ok := s.removedAt[kid]
+			if !ok {
+				removedAt = now
+				s.removedAt[kid] = now
+			}
+			if now.Sub(removedAt) < s.options.RefreshGracePeriod {
+				index[kid] = len(final)
+				final = append(final, jwk)
+				continue
+			}
+		}
+		delete(s.removedAt, kid)
+		removed = append(removed, kid)
+	}
+	for kid := range s.removedAt {
+		if _, ok := oldByKID[kid]; !ok {
+			delete(s.removedAt, kid) // The key was deleted from the Storage by other means.
+		}
+	}
+	changes.Removed = removed
+
+	if batch, ok := s.Storage.(BatchStorage); ok {
+		err = batch.ReplaceAll(ctx, final)
+		if err != nil {
+			return fmt.Errorf("failed to replace keys in storage: %w", err)
+		}
+	} else {
+		err = s.applyKeys(ctx, final, removed)
+		if err != nil {
+			restoreErr := s.applyKeys(ctx, old, changes.Added)
+			if restoreErr != nil {
+				return fmt.Errorf("failed to reconcile storage and to restore the previous keys, so it may hold a mix of both: %w", errors.Join(err, restoreErr))
+			}
+			return fmt.Errorf("failed to reconcile storage, restored the previous keys: %w", err)
+		}
+	}
+
+	if !changes.Empty() && s.options.RefreshChangeHandler != nil {
+		s.options.RefreshChangeHandler(ctx, changes)
+	}
+	return nil
+}
+
+// applyKeys writes the keys and then deletes the key IDs, one at a time, for a Storage that doesn't implement
+// BatchStorage. It stops at the first error.
+func (s *httpStorage) applyKeys(ctx context.Context, jwks []JWK, deleteKIDs []string) error {
+	for _, jwk := range jwks {
+		err := s.Storage.KeyWrite(ctx, jwk)
+		if err != nil {
+			return fmt.Errorf("failed to write JWK to storage: %w", err)
+		}
+	}
+	for _, kid := range deleteKIDs {
+		_, err := s.Storage.KeyDelete(ctx, kid)
+		if err != nil {
+			return fmt.Errorf("failed to delete JWK from storage: %w", err)
+		}
+	}
+	return nil
 }
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"slices"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -23,10 +25,16 @@ type storageTestParams struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 	jwks   Storage
+	// shared is another Storage with the same keys as jwks, such as a replica over the same database. It's nil for
+	// Storage implementations that can't be shared.
+	shared Storage
 }
 
 func TestMemoryKeyDelete(t *testing.T) {
-	params := setupMemory()
+	testStorageKeyDelete(t, setupMemory())
+}
+
+func testStorageKeyDelete(t *testing.T, params storageTestParams) {
 	defer params.cancel()
 	store := params.jwks
 
@@ -54,7 +62,10 @@ func TestMemoryKeyDelete(t *testing.T) {
 }
 
 func TestMemoryKeyRead(t *testing.T) {
-	params := setupMemory()
+	testStorageKeyRead(t, setupMemory())
+}
+
+func testStorageKeyRead(t *testing.T, params storageTestParams) {
 	defer params.cancel()
 	store := params.jwks
 
@@ -105,7 +116,10 @@ func TestMemoryKeyRead(t *testing.T) {
 }
 
 func TestMemoryKeyReadAll(t *testing.T) {
-	params := setupMemory()
+	testStorageKeyReadAll(t, setupMemory())
+}
+
+func testStorageKeyReadAll(t *testing.T, params storageTestParams) {
 	defer params.cancel()
 	store := params.jwks
 
@@ -149,7 +163,10 @@ func TestMemoryKeyReadAll(t *testing.T) {
 }
 
 func TestMemoryKeyWrite(t *testing.T) {
-	params := setupMemory()
+	testStorageKeyWrite(t, setupMemory())
+}
+
+func testStorageKeyWrite(t *testing.T, params storageTestParams) {
 	defer params.cancel()
 	store := params.jwks
 
@@ -166,6 +183,258 @@ func TestMemoryKeyWrite(t *testing.T) {
 	}
 }
 
+func testStorageSharedKeyWrite(t *testing.T, params storageTestParams) {
+	defer params.cancel()
+	store := params.jwks
+
+	err := store.KeyWrite(params.ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write key. %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		err = params.shared.KeyWrite(params.ctx, newStorageTestJWK(t, hmacKey2, kidWritten))
+		if err != nil {
+			t.Fatalf("Failed to overwrite key from another Storage. %s", err)
+		}
+	}
+	jwk, err := store.KeyRead(params.ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Failed to read key. %s", err)
+	}
+	if !bytes.Equal(jwk.Key().([]byte), hmacKey2) {
+		t.Fatalf("Expected the key written by the other Storage.")
+	}
+}
+
+// testStorageConflict tests the optimistic concurrency of two Storages over the same keys, whose KeyWrite fails with
+// the conflict error if the key changed since the Storage read or wrote it.
+func testStorageConflict(ctx context.Context, t *testing.T, replica1, replica2 Storage, conflict error) {
+	err := replica1.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK.\nError: %s", err)
+	}
+	err = replica2.KeyWrite(ctx, newStorageTestJWK(t, hmacKey2, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to overwrite a JWK the Storage never saw.\nError: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		err = replica1.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+		if !errors.Is(err, conflict) {
+			t.Fatalf("Expected a conflict when writing a key changed by another writer, but got %v.", err)
+		}
+	}
+	_, err = replica1.KeyReadAll(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read the JWKs.\nError: %s", err)
+	}
+	err = replica1.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if !errors.Is(err, conflict) {
+		t.Fatalf("Expected reading all keys to keep the conflict, but got %v.", err)
+	}
+	_, err = replica1.KeyRead(ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Failed to read the JWK.\nError: %s", err)
+	}
+	err = replica1.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK after reading it.\nError: %s", err)
+	}
+
+	_, err = replica2.KeyDelete(ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Failed to delete the JWK.\nError: %s", err)
+	}
+	err = replica1.KeyWrite(ctx, newStorageTestJWK(t, hmacKey2, kidWritten))
+	if !errors.Is(err, conflict) {
+		t.Fatalf("Expected a conflict when writing a key deleted by another writer, but got %v.", err)
+	}
+	_, err = replica1.KeyRead(ctx, kidWritten)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Expected the deleted JWK to be missing, but got %v.", err)
+	}
+	err = replica1.KeyWrite(ctx, newStorageTestJWK(t, hmacKey2, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK after reading that it's missing.\nError: %s", err)
+	}
+}
+
+func TestMemoryJSONSnapshot(t *testing.T) {
+	params := setupMemory()
+	defer params.cancel()
+	store := params.jwks.(JSONSnapshotter)
+
+	err := params.jwks.KeyWrite(params.ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write key. %s", err)
+	}
+	private := JWKMarshalOptions{Private: true}
+	snapshot, err := store.JSONSnapshot(params.ctx, private)
+	if err != nil {
+		t.Fatalf("Failed to get JSON snapshot. %s", err)
+	}
+	raw, err := params.jwks.JSONPrivate(params.ctx)
+	if err != nil {
+		t.Fatalf("Failed to get JSON. %s", err)
+	}
+	if !bytes.Equal(snapshot.JSON, raw) {
+		t.Fatalf("JSON snapshot does not match JSONPrivate.")
+	}
+	raw[0] = 'x'
+	cached, err := store.JSONSnapshot(params.ctx, private)
+	if err != nil {
+		t.Fatalf("Failed to get JSON snapshot. %s", err)
+	}
+	if cached.ETag != snapshot.ETag || cached.Version != snapshot.Version || cached.JSON[0] != '{' {
+		t.Fatalf("JSON snapshot changed without a write.")
+	}
+
+	public, err := store.JSONSnapshot(params.ctx, JWKMarshalOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get public JSON snapshot. %s", err)
+	}
+	if public.ETag == snapshot.ETag {
+		t.Fatalf("Public and private JSON snapshots should have different ETags.")
+	}
+
+	err = params.jwks.KeyWrite(params.ctx, newStorageTestJWK(t, hmacKey2, kidWritten2))
+	if err != nil {
+		t.Fatalf("Failed to write key. %s", err)
+	}
+	written, err := store.JSONSnapshot(params.ctx, private)
+	if err != nil {
+		t.Fatalf("Failed to get JSON snapshot. %s", err)
+	}
+	if written.ETag == snapshot.ETag || written.Version <= snapshot.Version {
+		t.Fatalf("JSON snapshot was not invalidated by a write.")
+	}
+
+	_, err = params.jwks.KeyDelete(params.ctx, kidWritten2)
+	if err != nil {
+		t.Fatalf("Failed to delete key. %s", err)
+	}
+	deleted, err := store.JSONSnapshot(params.ctx, private)
+	if err != nil {
+		t.Fatalf("Failed to get JSON snapshot. %s", err)
+	}
+	if deleted.ETag != snapshot.ETag || deleted.Version <= written.Version {
+		t.Fatalf("JSON snapshot was not invalidated by a delete.")
+	}
+}
+
+func TestMemoryBatchStorage(t *testing.T) {
+	params := setupMemory()
+	defer params.cancel()
+	store := params.jwks.(BatchStorage)
+	kids := func() []string {
+		keys, err := params.jwks.KeyReadAll(params.ctx)
+		if err != nil {
+			t.Fatalf("Failed to snapshot keys. %s", err)
+		}
+		var kids []string
+		for _, jwk := range keys {
+			kids = append(kids, jwk.Marshal().KID)
+		}
+		return kids
+	}
+
+	err := params.jwks.KeyWrite(params.ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write key. %s", err)
+	}
+	err = store.KeyWriteBatch(params.ctx, []JWK{
+		newStorageTestJWK(t, hmacKey1, kidWritten2),
+		newStorageTestJWK(t, hmacKey2, kidWritten),
+		newStorageTestJWK(t, hmacKey2, kidWritten2),
+	})
+	if err != nil {
+		t.Fatalf("Failed to write keys. %s", err)
+	}
+	if got := kids(); !slices.Equal(got, []string{kidWritten, kidWritten2}) {
+		t.Fatalf("Batch write should keep the key order, but got %q.", got)
+	}
+	for _, kid := range []string{kidWritten, kidWritten2} {
+		jwk, err := params.jwks.KeyRead(params.ctx, kid)
+		if err != nil {
+			t.Fatalf("Failed to read key. %s", err)
+		}
+		if !bytes.Equal(jwk.Key().([]byte), hmacKey2) {
+			t.Fatalf("Batch write should apply the last write of key ID %q.", kid)
+		}
+	}
+
+	deleted, err := store.KeyDeleteBatch(params.ctx, []string{kidWritten, kidMissing, kidWritten})
+	if err != nil {
+		t.Fatalf("Failed to delete keys. %s", err)
+	}
+	if deleted != 1 {
+		t.Fatalf("Batch delete should count 1 present key ID, but got %d.", deleted)
+	}
+	if got := kids(); !slices.Equal(got, []string{kidWritten2}) {
+		t.Fatalf("Batch delete should only keep %q, but got %q.", kidWritten2, got)
+	}
+
+	err = store.ReplaceAll(params.ctx, []JWK{
+		newStorageTestJWK(t, hmacKey1, kidWritten),
+		newStorageTestJWK(t, hmacKey1, kidWritten2),
+		newStorageTestJWK(t, hmacKey2, kidWritten),
+	})
+	if err != nil {
+		t.Fatalf("Failed to replace keys. %s", err)
+	}
+	if got := kids(); !slices.Equal(got, []string{kidWritten, kidWritten2}) {
+		t.Fatalf("Replacing should keep one key per key ID, but got %q.", got)
+	}
+	jwk, err := params.jwks.KeyRead(params.ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Failed to read key. %s", err)
+	}
+	if !bytes.Equal(jwk.Key().([]byte), hmacKey2) {
+		t.Fatalf("Replacing should keep the last key of key ID %q.", kidWritten)
+	}
+	ok, err := params.jwks.KeyDelete(params.ctx, kidWritten)
+	if err != nil || !ok {
+		t.Fatalf("Failed to delete key. %s", err)
+	}
+	_, err = params.jwks.KeyRead(params.ctx, kidWritten)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Expected the deleted key to be missing, but got %v.", err)
+	}
+
+	const setSize = 10
+	sets := [2][]JWK{}
+	for i := range sets {
+		for j := 0; j < setSize; j++ {
+			sets[i] = append(sets[i], newStorageTestJWK(t, hmacKey1, strconv.Itoa(i)+"-"+strconv.Itoa(j)))
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			err := store.ReplaceAll(params.ctx, sets[i%2])
+			if err != nil {
+				t.Errorf("Failed to replace keys. %s", err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if got := kids(); len(got) != setSize || got[0] != "1-0" {
+				t.Fatalf("Replacing should leave the last set, but got %q.", got)
+			}
+			return
+		default:
+		}
+		got := kids()
+		if len(got) == setSize && got[0][0] == got[setSize-1][0] || len(got) == 1 && got[0] == kidWritten2 {
+			continue
+		}
+		t.Fatalf("Readers should not observe a partially replaced set, but got %q.", got)
+	}
+}
+
 func setupMemory() (params storageTestParams) {
 	jwkSet := NewMemoryStorage()
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
@@ -194,3 +463,80 @@ func newStorageTestJWK(t *testing.T, key any, keyID string) JWK {
 	}
 	return jwk
 }
+
+func BenchmarkMemoryKeyRead(b *testing.B) {
+	ctx := context.Background()
+	store := setupMemoryBenchmark(b, 5000)
+	keyID := strconv.Itoa(4999)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := store.KeyRead(ctx, keyID)
+		if err != nil {
+			b.Fatalf("Failed to read key. %s", err)
+		}
+	}
+}
+
+func BenchmarkMemoryKeyWrite(b *testing.B) {
+	ctx := context.Background()
+	store := setupMemoryBenchmark(b, 5000)
+	jwk, err := store.KeyRead(ctx, strconv.Itoa(4999))
+	if err != nil {
+		b.Fatalf("Failed to read key. %s", err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = store.KeyWrite(ctx, jwk)
+		if err != nil {
+			b.Fatalf("Failed to write key. %s", err)
+		}
+	}
+}
+
+func BenchmarkMemoryJSONPrivate(b *testing.B) {
+	ctx := context.Background()
+	store := setupMemoryBenchmark(b, 5000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := store.JSONPrivate(ctx)
+		if err != nil {
+			b.Fatalf("Failed to get JSON. %s", err)
+		}
+	}
+}
+
+func BenchmarkMemoryJSONSnapshot(b *testing.B) {
+	ctx := context.Background()
+	store := setupMemoryBenchmark(b, 5000).(JSONSnapshotter)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := store.JSONSnapshot(ctx, JWKMarshalOptions{})
+		if err != nil {
+			b.Fatalf("Failed to get JSON snapshot. %s", err)
+		}
+	}
+}
+
+func setupMemoryBenchmark(b *testing.B, keys int) Storage {
+	ctx := context.Background()
+	store := NewMemoryStorage()
+	for i := 0; i < keys; i++ {
+		options := JWKOptions{
+			Marshal: JWKMarshalOptions{
+				Private: true,
+			},
+			Metadata: JWKMetadataOptions{
+				KID: strconv.Itoa(i),
+			},
+		}
+		jwk, err := NewJWKFromKey([]byte(strconv.Itoa(i)), options)
+		if err != nil {
+			b.Fatalf("Failed to create JWK. %s", err)
+		}
+		err = store.KeyWrite(ctx, jwk)
+		if err != nil {
+			b.Fatalf("Failed to write key. %s", err)
+		}
+	}
+	return store
+}
@@ -0,0 +1,293 @@
+package jwkset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrWatchUnsupported indicates that a Storage can't notify about changes to its keys. Use NewWatchedStorage to add
+	// support.
+	ErrWatchUnsupported = errors.New("storage does not support watching")
+)
+
+// keyWatchBuffer is the number of events a Storage buffers for each watch.
+const keyWatchBuffer = 64
+
+// KeyEventType is the kind of change in a KeyEvent.
+type KeyEventType string
+
+const (
+	// KeyAdded is a key ID that was not in the Storage before.
+	KeyAdded KeyEventType = "added"
+	// KeyUpdated is a key ID whose JWK changed.
+	KeyUpdated KeyEventType = "updated"
+	// KeyRemoved is a key ID that is no longer in the Storage.
+	KeyRemoved KeyEventType = "removed"
+)
+
+// KeyEvent is a change of a key in a Storage.
+type KeyEvent struct {
+	// KID is the key ID of the changed key.
+	KID string
+	// New is the JWK after the change. It's the zero value for KeyRemoved.
+	New JWK
+	// Old is the JWK before the change. It's the zero value for KeyAdded.
+	Old JWK
+	// Type is the kind of change.
+	Type KeyEventType
+}
+
+// StorageWatcher is optionally implemented by a Storage that can notify about changes to its keys, such as the
+// in-memory Storage and the Storage created by NewStorageFromHTTP.
+type StorageWatcher interface {
+	// Watch sends the changes of keys until the context is over. The channel is closed when the watch ends, including
+	// when the receiver falls too far behind. Then KeyReadAll should be called again before starting a new watch.
+	Watch(ctx context.Context) (<-chan KeyEvent, error)
+}
+
+// keyWatchers sends the changes of a Storage to its watches. The zero value is ready to use.
+type keyWatchers struct {
+	mux     sync.Mutex
+	watches map[chan KeyEvent]struct{}
+}
+
+func (w *keyWatchers) watch(ctx context.Context) <-chan KeyEvent {
+	events := make(chan KeyEvent, keyWatchBuffer)
+	w.mux.Lock()
+	if w.watches == nil {
+		w.watches = make(map[chan KeyEvent]struct{})
+	}
+	w.watches[events] = struct{}{}
+	w.mux.Unlock()
+	go func() {
+		<-ctx.Done()
+		w.mux.Lock()
+		defer w.mux.Unlock()
+		w.end(events)
+	}()
+	return events
+}
+
+// active reports whether there are watches, so changes don't need to be compared without them.
+func (w *keyWatchers) active() bool {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return len(w.watches) > 0
+}
+
+// notify sends the events to all watches. Callers must serialize their calls to keep the events in order.
+func (w *keyWatchers) notify(events ...KeyEvent) {
+	if len(events) == 0 {
+		return
+	}
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	for watch := range w.watches {
+	send:
+		for _, event := range events {
+			select {
+			case watch <- event:
+			default:
+				w.end(watch) // The receiver fell behind.
+				break send
+			}
+		}
+	}
+}
+
+// end closes the watch if it's still open. The caller must hold w.mux.
+func (w *keyWatchers) end(watch chan KeyEvent) {
+	if _, ok := w.watches[watch]; ok {
+		delete(w.watches, watch)
+		close(watch)
+	}
+}
+
+// keyEvent returns the event for changing a key from old to new, or false if the key didn't change. A nil JWK means the
+// key is not in the Storage.
+func keyEvent(kid string, old, new *JWK) (KeyEvent, bool) {
+	event := KeyEvent{
+		KID: kid,
+	}
+	switch {
+	case old == nil && new == nil:
+		return KeyEvent{}, false
+	case old == nil:
+		event.Type = KeyAdded
+		event.New = *new
+	case new == nil:
+		event.Type = KeyRemoved
+		event.Old = *old
+	case reflect.DeepEqual(old.Marshal(), new.Marshal()):
+		return KeyEvent{}, false
+	default:
+		event.Type = KeyUpdated
+		event.New = *new
+		event.Old = *old
+	}
+	return event, true
+}
+
+// keyEvents returns the events for changing the keys from old to new. Only the first key of each key ID is considered,
+// like KeyRead does. Removals come first, in the old order, followed by additions and updates, in the new order.
+func keyEvents(old, new []*JWK) []KeyEvent {
+	firstByKID := func(keys []*JWK) map[string]*JWK {
+		byKID := make(map[string]*JWK, len(keys))
+		for _, jwk := range keys {
+			kid := jwk.Marshal().KID
+			if _, ok := byKID[kid]; !ok {
+				byKID[kid] = jwk
+			}
+		}
+		return byKID
+	}
+	oldByKID, newByKID := firstByKID(old), firstByKID(new)
+	var events []KeyEvent
+	for _, jwk := range old {
+		kid := jwk.Marshal().KID
+		if oldByKID[kid] != jwk {
+			continue
+		}
+		if _, ok := newByKID[kid]; !ok {
+			event, _ := keyEvent(kid, jwk, nil)
+			events = append(events, event)
+		}
+	}
+	for _, jwk := range new {
+		kid := jwk.Marshal().KID
+		if newByKID[kid] != jwk {
+			continue
+		}
+		if event, ok := keyEvent(kid, oldByKID[kid], jwk); ok {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// WatchedStorageOptions are used to configure the behavior of NewWatchedStorage.
+type WatchedStorageOptions struct {
+	// Ctx is used to end the poll goroutine when it's no longer needed.
+	//
+	// This defaults to context.Background().
+	Ctx context.Context
+
+	// PollErrorHandler is a function that consumes errors that happen when polling the Storage.
+	PollErrorHandler func(ctx context.Context, err error)
+
+	// PollInterval is the interval at which KeyReadAll is compared to the last known keys, to notice changes made
+	// without the returned Storage. If zero, only changes made through the returned Storage are noticed.
+	PollInterval time.Duration
+}
+
+// watchedStorage adds StorageWatcher support to a Storage.
+type watchedStorage struct {
+	mux     sync.Mutex // Held while changing the keys, so events are in order.
+	known   []*JWK
+	watches keyWatchers
+
+	Storage
+}
+
+// NewWatchedStorage adds StorageWatcher support to a Storage that lacks it. The returned Storage implements
+// StorageWatcher and notifies about the changes made through it and, if PollInterval is set, the changes noticed by
+// polling. If the Storage already implements StorageWatcher, it is returned as is.
+func NewWatchedStorage(storage Storage, options WatchedStorageOptions) (Storage, error) {
+	if _, ok := storage.(StorageWatcher); ok {
+		return storage, nil
+	}
+	if options.Ctx == nil {
+		options.Ctx = context.Background()
+	}
+	w := &watchedStorage{
+		Storage: storage,
+	}
+	err := w.poll(options.Ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.PollInterval > 0 {
+		go func() { // Poll goroutine.
+			ticker := time.NewTicker(options.PollInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-options.Ctx.Done():
+					return
+				case <-ticker.C:
+					err := w.poll(options.Ctx)
+					if err != nil && options.PollErrorHandler != nil {
+						options.PollErrorHandler(options.Ctx, err)
+					}
+				}
+			}
+		}()
+	}
+	return w, nil
+}
+
+func (w *watchedStorage) KeyDelete(ctx context.Context, keyID string) (ok bool, err error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	ok, err = w.Storage.KeyDelete(ctx, keyID)
+	if err != nil || !ok {
+		return ok, err
+	}
+	for i, jwk := range w.known {
+		if jwk.Marshal().KID == keyID {
+			w.known = append(w.known[:i:i], w.known[i+1:]...)
+			event, _ := keyEvent(keyID, jwk, nil)
+			w.watches.notify(event)
+			break
+		}
+	}
+	return true, nil
+}
+func (w *watchedStorage) KeyWrite(ctx context.Context, jwk JWK) error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	err := w.Storage.KeyWrite(ctx, jwk)
+	if err != nil {
+		return err
+	}
+	kid := jwk.Marshal().KID
+	for i, old := range w.known {
+		if old.Marshal().KID == kid {
+			w.known[i] = &jwk
+			if event, ok := keyEvent(kid, old, &jwk); ok {
+				w.watches.notify(event)
+			}
+			return nil
+		}
+	}
+	w.known = append(w.known, &jwk)
+	event, _ := keyEvent(kid, nil, &jwk)
+	w.watches.notify(event)
+	return nil
+}
+func (w *watchedStorage) Watch(ctx context.Context) (<-chan KeyEvent, error) {
+	return w.watches.watch(ctx), nil
+}
+
+// poll compares the keys in the Storage to the last known keys and notifies about the differences.
+func (w *watchedStorage) poll(ctx context.Context) error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	keys, err := w.Storage.KeyReadAll(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot of all keys from storage: %w", err)
+	}
+	current := make([]*JWK, len(keys))
+	for i := range keys {
+		current[i] = &keys[i]
+	}
+	w.watches.notify(keyEvents(w.known, current)...)
+	w.known = current
+	return nil
+}
@@ -0,0 +1,191 @@
+package jwkset
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMemoryWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := NewMemoryStorage()
+	events, err := store.(StorageWatcher).Watch(ctx)
+	if err != nil {
+		t.Fatalf("Failed to watch the storage.\nError: %s", err)
+	}
+
+	write := func(key []byte, kid string) {
+		err := store.KeyWrite(ctx, newStorageTestJWK(t, key, kid))
+		if err != nil {
+			t.Fatalf("Failed to write the JWK.\nError: %s", err)
+		}
+	}
+	write(hmacKey1, kidWritten)
+	assertKeyEvent(t, events, KeyAdded, kidWritten)
+	write(hmacKey1, kidWritten) // Unchanged, so no event.
+	write(hmacKey2, kidWritten)
+	event := assertKeyEvent(t, events, KeyUpdated, kidWritten)
+	if event.Old.Marshal().K == event.New.Marshal().K {
+		t.Fatalf("Expected the old and new JWK of the update.")
+	}
+	_, err = store.KeyDelete(ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Failed to delete the JWK.\nError: %s", err)
+	}
+	event = assertKeyEvent(t, events, KeyRemoved, kidWritten)
+	if event.Old.Marshal().KID != kidWritten {
+		t.Fatalf("Expected the old JWK of the removal.")
+	}
+
+	write(hmacKey1, kidWritten)
+	assertKeyEvent(t, events, KeyAdded, kidWritten)
+	err = store.(BatchStorage).ReplaceAll(ctx, []JWK{newStorageTestJWK(t, hmacKey2, kidWritten2)})
+	if err != nil {
+		t.Fatalf("Failed to replace the JWKs.\nError: %s", err)
+	}
+	assertKeyEvent(t, events, KeyRemoved, kidWritten)
+	assertKeyEvent(t, events, KeyAdded, kidWritten2)
+
+	for i := 0; i <= keyWatchBuffer; i++ {
+		write(hmacKey1, string(rune('a'+i)))
+	}
+	for range events { // The receiver fell behind, so the watch ends after the buffered events.
+	}
+
+	ended, cancelEnded := context.WithCancel(ctx)
+	events, err = store.(StorageWatcher).Watch(ended)
+	if err != nil {
+		t.Fatalf("Failed to watch the storage.\nError: %s", err)
+	}
+	cancelEnded()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatalf("Expected no event after the context ended.")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the watch to end with its context.")
+	}
+}
+
+func TestHTTPWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverStore := NewMemoryStorage()
+	err := serverStore.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the server store.\nError: %s", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawJWKS, err := serverStore.JSONPrivate(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(rawJWKS)
+	}))
+	defer server.Close()
+	u, err := url.ParseRequestURI(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse the server URL.\nError: %s", err)
+	}
+
+	clientStore, handle, err := NewStorageFromHTTPWithHandle(u, HTTPClientStorageOptions{Ctx: ctx})
+	if err != nil {
+		t.Fatalf("Failed to create the HTTP storage.\nError: %s", err)
+	}
+	events, err := clientStore.(StorageWatcher).Watch(ctx)
+	if err != nil {
+		t.Fatalf("Failed to watch the storage.\nError: %s", err)
+	}
+	err = serverStore.KeyWrite(ctx, newStorageTestJWK(t, hmacKey2, kidWritten2))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK to the server store.\nError: %s", err)
+	}
+	err = handle.Refresh(ctx)
+	if err != nil {
+		t.Fatalf("Failed to refresh the HTTP storage.\nError: %s", err)
+	}
+	assertKeyEvent(t, events, KeyAdded, kidWritten2)
+
+	unsupported, err := NewStorageFromHTTP(u, HTTPClientStorageOptions{Ctx: ctx, Storage: unwatchedStorage{NewMemoryStorage()}})
+	if err != nil {
+		t.Fatalf("Failed to create the HTTP storage.\nError: %s", err)
+	}
+	_, err = unsupported.(StorageWatcher).Watch(ctx)
+	if !errors.Is(err, ErrWatchUnsupported) {
+		t.Fatalf("Expected an error watching an HTTP storage without watch support, but got %s.", err)
+	}
+}
+
+func TestWatchedStorage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	inner := unwatchedStorage{NewMemoryStorage()}
+	err := inner.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK.\nError: %s", err)
+	}
+	store, err := NewWatchedStorage(inner, WatchedStorageOptions{Ctx: ctx, PollInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to create the watched storage.\nError: %s", err)
+	}
+	events, err := store.(StorageWatcher).Watch(ctx)
+	if err != nil {
+		t.Fatalf("Failed to watch the storage.\nError: %s", err)
+	}
+
+	err = store.KeyWrite(ctx, newStorageTestJWK(t, hmacKey2, kidWritten))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK.\nError: %s", err)
+	}
+	assertKeyEvent(t, events, KeyUpdated, kidWritten)
+	_, err = store.KeyDelete(ctx, kidWritten)
+	if err != nil {
+		t.Fatalf("Failed to delete the JWK.\nError: %s", err)
+	}
+	assertKeyEvent(t, events, KeyRemoved, kidWritten)
+
+	err = inner.KeyWrite(ctx, newStorageTestJWK(t, hmacKey1, kidWritten2))
+	if err != nil {
+		t.Fatalf("Failed to write the JWK.\nError: %s", err)
+	}
+	assertKeyEvent(t, events, KeyAdded, kidWritten2)
+
+	memory := NewMemoryStorage()
+	same, err := NewWatchedStorage(memory, WatchedStorageOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create the watched storage.\nError: %s", err)
+	}
+	if same != memory {
+		t.Fatalf("Expected a Storage with watch support to be returned as is.")
+	}
+}
+
+// unwatchedStorage hides the StorageWatcher implementation of a Storage.
+type unwatchedStorage struct {
+	Storage
+}
+
+func assertKeyEvent(t *testing.T, events <-chan KeyEvent, eventType KeyEventType, kid string) KeyEvent {
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatalf("Expected a %s event for %q, but the watch ended.", eventType, kid)
+		}
+		if event.Type != eventType || event.KID != kid {
+			t.Fatalf("Expected a %s event for %q, but got a %s event for %q.", eventType, kid, event.Type, event.KID)
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a %s event for %q.", eventType, kid)
+	}
+	return KeyEvent{}
+}
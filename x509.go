@@ -1,10 +1,12 @@
 package jwkset
 
 import (
+	"crypto"
 	"crypto/ecdh"
 	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
@@ -57,6 +59,32 @@ func LoadCertificates(rawPEM []byte) ([]*x509.Certificate, error) {
 	return certs, nil
 }
 
+// TLSCertificateFromJWK creates a TLS certificate from a JWK with a private key and an X.509 certificate chain (x5c).
+// It can be used for mutual TLS, such as with the ClientCertificates option of HTTPClientStorageOptions.
+func TLSCertificateFromJWK(jwk JWK) (tls.Certificate, error) {
+	certs := jwk.X509().X5C
+	if len(certs) == 0 {
+		return tls.Certificate{}, fmt.Errorf("%w: JWK has no X.509 certificates", ErrOptions)
+	}
+	signer, ok := jwk.Key().(crypto.Signer)
+	if !ok {
+		return tls.Certificate{}, fmt.Errorf("%w: JWK key of type %T is not a private key that can sign", ErrUnsupportedKey, jwk.Key())
+	}
+	switch signer.(type) {
+	case *ecdsa.PrivateKey, ed25519.PrivateKey, *rsa.PrivateKey:
+	default:
+		return tls.Certificate{}, fmt.Errorf("%w: %T", ErrUnsupportedKey, signer)
+	}
+	c := tls.Certificate{
+		PrivateKey: signer,
+		Leaf:       certs[0],
+	}
+	for _, cert := range certs {
+		c.Certificate = append(c.Certificate, cert.Raw)
+	}
+	return c, nil
+}
+
 // LoadX509KeyInfer loads an X509 key from a PEM block.
 func LoadX509KeyInfer(pemBlock *pem.Block) (key any, err error) {
 	switch pemBlock.Type {